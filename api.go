@@ -0,0 +1,401 @@
+package main
+
+import (
+	"SignTools/src/assets"
+	"SignTools/src/storage"
+	"encoding/json"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"os"
+	"strings"
+	"time"
+)
+
+// The JSON API reuses the logic of the HTML handlers, but responds with JSON objects, including errors.
+const apiPrefix = "/api/v1"
+
+func addApiHandlers(e *echo.Echo, auth func(storage.Scope) echo.MiddlewareFunc) {
+	readAuth, signAuth, adminAuth := auth(storage.ScopeRead), auth(storage.ScopeSign), auth(storage.ScopeAdmin)
+	e.GET(apiPrefix+"/openapi.json", getOpenApi)
+	g := e.Group(apiPrefix, apiErrorHandler)
+	g.GET("/apps", getAppList, readAuth)
+	g.POST("/apps", apiCreateApp, audit("app.create"), signAuth)
+	g.GET("/apps/:id", apiAppResolver(apiGetApp), readAuth)
+	g.PATCH("/apps/:id", apiAppResolver(apiUpdateApp), audit("app.update"), signAuth)
+	g.DELETE("/apps/:id", apiAppResolver(apiDeleteApp), audit("app.delete"), adminAuth)
+	g.POST("/apps/:id/resign", apiAppResolver(apiResignApp), audit("app.resign"), signAuth)
+	g.POST("/apps/:id/2fa", apiAppResolver(apiSet2FA), audit("app.2fa"), signAuth)
+	g.POST("/apps/:id/share", apiAppResolver(apiShareApp), audit("app.share"), signAuth)
+	g.GET("/apps/:id/entitlements", apiAppResolver(getEntitlements), readAuth)
+	g.GET("/profiles", apiGetProfiles, readAuth)
+	g.POST("/profiles", apiImportProfile, audit("profile.import"), adminAuth)
+	g.GET("/profiles/:id", apiProfileResolver(apiGetProfile), readAuth)
+	g.GET("/builders", apiGetBuilders, readAuth)
+	g.GET("/jobs", apiGetJobs, readAuth)
+	g.GET("/tokens", apiGetTokens, adminAuth)
+	g.POST("/tokens", apiCreateToken, audit("token.create"), adminAuth)
+	g.DELETE("/tokens/:id", apiRevokeToken, audit("token.revoke"), adminAuth)
+}
+
+// Documents the JSON API, the tus upload flow and the builder protocol. It's public, so that clients can be
+// generated without credentials.
+func getOpenApi(c echo.Context) error {
+	return c.Blob(200, echo.MIMEApplicationJSON, assets.OpenApiJson)
+}
+
+type apiErrorJson struct {
+	Error apiError `json:"error"`
+}
+
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Responds with an apiErrorJson for every error. The message of an *echo.HTTPError is passed to the client,
+// while other errors are logged and reported as internal errors.
+func apiErrorHandler(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+		if err == nil || c.Response().Committed {
+			return err
+		}
+		var httpErr *echo.HTTPError
+		if !errors.As(err, &httpErr) {
+			log.Err(err).Str("method", c.Request().Method).Str("path", c.Request().URL.Path).Msg("api request")
+			httpErr = echo.NewHTTPError(500, "Internal server error")
+		}
+		return c.JSON(httpErr.Code, apiErrorJson{Error: apiError{
+			Code:    httpErr.Code,
+			Message: fmt.Sprint(httpErr.Message),
+		}})
+	}
+}
+
+func apiAppResolver(handler func(echo.Context, storage.App) error) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		id := c.Param("id")
+		app, ok := storage.Apps.Get(id)
+		if !ok || !canAccessApp(c, app) {
+			return echo.NewHTTPError(404, "No app with id "+id)
+		}
+		auditApp(c, app)
+		return handler(c, app)
+	}
+}
+
+func apiProfileResolver(handler func(echo.Context, storage.Profile) error) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		id := c.Param("id")
+		profile, ok := storage.Profiles.GetById(id)
+		if !ok {
+			return echo.NewHTTPError(404, "No profile with id "+id)
+		}
+		if allowed, err := storage.IsProfileAllowed(profile, getUser(c)); err != nil {
+			return err
+		} else if !allowed {
+			return echo.NewHTTPError(404, "No profile with id "+id)
+		}
+		getAuditEntry(c).ProfileId = profile.GetId()
+		return handler(c, profile)
+	}
+}
+
+// Decodes the JSON request body, rejecting unknown fields so that typos don't go unnoticed.
+func bindJson(c echo.Context, value any) error {
+	decoder := json.NewDecoder(c.Request().Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(value); err != nil {
+		return echo.NewHTTPError(400, "Invalid JSON body: "+err.Error())
+	}
+	return nil
+}
+
+func isJsonRequest(c echo.Context) bool {
+	return strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON)
+}
+
+func apiGetApp(c echo.Context, app storage.App) error {
+	return c.JSON(200, makeAppJson(makeAppListEntry(app, map[string]string{})))
+}
+
+// Accepts the parameters either as JSON, or as a form with the same names as the index page. A form
+// may also contain the app itself as a "file" part, instead of referencing it with file_id or file_url.
+func apiCreateApp(c echo.Context) error {
+	var params *signParams
+	if isJsonRequest(c) {
+		params = &signParams{}
+		if err := bindJson(c, params); err != nil {
+			return err
+		}
+	} else {
+		params = parseSignForm(c)
+		if fileHeader, err := c.FormFile("file"); err == nil {
+			file, err := fileHeader.Open()
+			if err != nil {
+				return err
+			}
+			tempFile, err := copyToTempFile(file)
+			file.Close()
+			if err != nil {
+				return err
+			}
+			defer os.Remove(tempFile.Name())
+			defer tempFile.Close()
+			params.file = tempFile
+			params.fileName = fileHeader.Filename
+		}
+	}
+	app, err := newSignedApp(c, params)
+	if err != nil {
+		return err
+	}
+	return c.JSON(201, makeAppJson(makeAppListEntry(app, map[string]string{})))
+}
+
+// Fields that are missing or null are left unchanged.
+type appUpdateJson struct {
+	Name   *string   `json:"name"`
+	Folder *string   `json:"folder"`
+	Tags   *[]string `json:"tags"`
+	Notes  *string   `json:"notes"`
+}
+
+func apiUpdateApp(c echo.Context, app storage.App) error {
+	var update appUpdateJson
+	if err := bindJson(c, &update); err != nil {
+		return err
+	}
+	if update.Name != nil {
+		if err := app.SetString(storage.AppName, *update.Name); err != nil {
+			return err
+		}
+	}
+	var tags *string
+	if update.Tags != nil {
+		joined := strings.Join(*update.Tags, "\n")
+		tags = &joined
+	}
+	if err := saveAppDetails(app, update.Folder, tags, update.Notes); err != nil {
+		return err
+	}
+	return apiGetApp(c, app)
+}
+
+func apiDeleteApp(c echo.Context, app storage.App) error {
+	if err := storage.Apps.Delete(app.GetId()); err != nil {
+		return err
+	}
+	return c.NoContent(204)
+}
+
+func apiResignApp(c echo.Context, app storage.App) error {
+	if err := resign(app, getUser(c)); err != nil {
+		return err
+	}
+	return apiGetApp(c, app)
+}
+
+type shareCreateJson struct {
+	// Zero for the default expiry.
+	ExpiresInHours uint64 `json:"expires_in_hours"`
+	// Zero for unlimited downloads.
+	MaxDownloads int `json:"max_downloads"`
+}
+
+type shareJson struct {
+	// The install page of the app, with the share token.
+	Url          string    `json:"url"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"max_downloads"`
+}
+
+func apiShareApp(c echo.Context, app storage.App) error {
+	var body shareCreateJson
+	if err := bindJson(c, &body); err != nil {
+		return err
+	}
+	link, shareUrl, err := newShareLink(c, app, body.ExpiresInHours, body.MaxDownloads)
+	if err != nil {
+		return err
+	}
+	return c.JSON(201, shareJson{Url: shareUrl, Expires: link.Expires, MaxDownloads: link.MaxDownloads})
+}
+
+type twoFactorJson struct {
+	Code string `json:"code"`
+}
+
+func apiSet2FA(c echo.Context, app storage.App) error {
+	var body twoFactorJson
+	if err := bindJson(c, &body); err != nil {
+		return err
+	}
+	job, ok := storage.Jobs.GetByAppId(app.GetId())
+	if !ok {
+		return echo.NewHTTPError(409, "No running job for app "+app.GetId())
+	}
+	job.TwoFactorCode.Store(body.Code)
+	return c.NoContent(204)
+}
+
+type profileJson struct {
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	IsAccount bool   `json:"is_account"`
+	IsRevoked bool   `json:"is_revoked"`
+}
+
+func makeProfileJson(profile assets.Profile) profileJson {
+	return profileJson{
+		Id:        profile.Id,
+		Name:      profile.Name,
+		IsAccount: profile.IsAccount,
+		IsRevoked: profile.IsRevoked,
+	}
+}
+
+func apiGetProfiles(c echo.Context) error {
+	profiles, err := getAllowedProfiles(getUser(c))
+	if err != nil {
+		return err
+	}
+	result := []profileJson{}
+	for _, profile := range profiles {
+		result = append(result, makeProfileJson(profile))
+	}
+	return c.JSON(200, result)
+}
+
+func apiGetProfile(c echo.Context, profile storage.Profile) error {
+	entry, err := makeProfileEntry(profile)
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, makeProfileJson(entry))
+}
+
+// Imports a profile bundle, like the form of importProfile.
+func apiImportProfile(c echo.Context) error {
+	fileHeader, err := c.FormFile("bundle")
+	if err != nil {
+		return echo.NewHTTPError(400, "Missing profile bundle file")
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	profile, err := storage.Profiles.Import(file, c.FormValue("password"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Failed to import profile: "+err.Error())
+	}
+	getAuditEntry(c).ProfileId = profile.GetId()
+	checkImportedProfile(profile)
+	entry, err := makeProfileEntry(profile)
+	if err != nil {
+		return err
+	}
+	return c.JSON(201, makeProfileJson(entry))
+}
+
+type builderJson struct {
+	Id string `json:"id"`
+}
+
+func apiGetBuilders(c echo.Context) error {
+	result := []builderJson{}
+	for _, builder := range getBuilders() {
+		result = append(result, builderJson{Id: builder.Id})
+	}
+	return c.JSON(200, result)
+}
+
+type jobJson struct {
+	// Empty while the job is waiting for a builder.
+	Id      string    `json:"id,omitempty"`
+	AppId   string    `json:"app_id"`
+	Status  string    `json:"status"`
+	Created time.Time `json:"created"`
+}
+
+func apiGetJobs(c echo.Context) error {
+	result := []jobJson{}
+	for _, job := range storage.Jobs.GetAll() {
+		if app, ok := storage.Apps.Get(job.AppId); (ok && !canAccessApp(c, app)) || (!ok && !isAdmin(c)) {
+			continue
+		}
+		status := appStatusNames[assets.AppStatusProcessing]
+		if job.Id == "" {
+			status = appStatusNames[assets.AppStatusWaiting]
+		}
+		result = append(result, jobJson{
+			Id:      job.Id,
+			AppId:   job.AppId,
+			Status:  status,
+			Created: job.Ts,
+		})
+	}
+	return c.JSON(200, result)
+}
+
+type tokenJson struct {
+	Id      string    `json:"id"`
+	Name    string    `json:"name"`
+	Scope   string    `json:"scope"`
+	User    string    `json:"user"`
+	Created time.Time `json:"created"`
+	// Only returned when the token is created.
+	Token string `json:"token,omitempty"`
+}
+
+func makeTokenJson(token storage.Token) tokenJson {
+	return tokenJson{
+		Id:      token.Id,
+		Name:    token.Name,
+		Scope:   string(token.Scope),
+		User:    token.User,
+		Created: token.Created,
+	}
+}
+
+func apiGetTokens(c echo.Context) error {
+	result := []tokenJson{}
+	for _, token := range storage.Tokens.GetAll() {
+		result = append(result, makeTokenJson(token))
+	}
+	return c.JSON(200, result)
+}
+
+type tokenCreateJson struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+}
+
+func apiCreateToken(c echo.Context) error {
+	var body tokenCreateJson
+	if err := bindJson(c, &body); err != nil {
+		return err
+	}
+	token, secret, err := newToken(body.Name, body.Scope, getUser(c))
+	if err != nil {
+		return err
+	}
+	getAuditEntry(c).Target = token.Id
+	result := makeTokenJson(token)
+	result.Token = secret
+	return c.JSON(201, result)
+}
+
+func apiRevokeToken(c echo.Context) error {
+	id := c.Param("id")
+	getAuditEntry(c).Target = id
+	if ok, err := storage.Tokens.Delete(id); err != nil {
+		return err
+	} else if !ok {
+		return echo.NewHTTPError(404, "No token with id "+id)
+	}
+	return c.NoContent(204)
+}
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"SignTools/src/assets"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/eventials/go-tus"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// A subcommand of the main binary, which talks to a running server over the JSON API.
+type cliCommand struct {
+	name        string
+	description string
+	run         func(args []string, out io.Writer) error
+}
+
+var cliCommands = []cliCommand{
+	{"sign", "Upload an app, wait for it to be signed and download the signed app.", runSignCommand},
+	{"list", "List apps.", runListCommand},
+	{"download", "Download the signed or unsigned app.", runDownloadCommand},
+	{"resign", "Sign an app again, wait for it to be signed and download the signed app.", runResignCommand},
+	{"delete", "Delete apps.", runDeleteCommand},
+	{"profiles", "List the profiles you may sign with.", runProfilesCommand},
+}
+
+func getCliCommand(name string) (cliCommand, bool) {
+	for _, command := range cliCommands {
+		if command.name == name {
+			return command, true
+		}
+	}
+	return cliCommand{}, false
+}
+
+func printUsage() {
+	out := flag.CommandLine.Output()
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(out, "Usage: %s [flags]\n  Starts the server.\n\n", name)
+	fmt.Fprintf(out, "Usage: %s <command> [flags] [args]\n  Talks to a running server. Commands:\n", name)
+	for _, command := range cliCommands {
+		fmt.Fprintf(out, "    %-9s %s\n", command.name, command.description)
+	}
+	fmt.Fprintf(out, "  Use \"%s <command> -help\" for the flags of a command.\n\nServer flags:\n", name)
+	flag.PrintDefaults()
+}
+
+func newCommandFlags(name string, usage string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s %s\n", filepath.Base(os.Args[0]), name, usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// The flags of the commands that wait for an app to be signed.
+type waitFlags struct {
+	wait         bool
+	out          string
+	timeout      time.Duration
+	pollInterval time.Duration
+}
+
+func addWaitFlags(flags *flag.FlagSet) *waitFlags {
+	result := waitFlags{}
+	flags.BoolVar(&result.wait, "wait", true, "Wait for the app to be signed and download it.")
+	flags.StringVar(&result.out, "out", "", "Where to save the signed app, by default named after the app.")
+	flags.DurationVar(&result.timeout, "timeout", 30*time.Minute, "How long to wait for the app to be signed.")
+	flags.DurationVar(&result.pollInterval, "poll-interval", 5*time.Second, "How often to check if the app is signed.")
+	return &result
+}
+
+func runSignCommand(args []string, out io.Writer) error {
+	flags := newCommandFlags("sign", "[flags] <file.ipa>")
+	client := addClientFlags(flags)
+	wait := addWaitFlags(flags)
+	fileUrl := flags.String("url", "", "Download the app from this url instead of uploading a file.")
+	profile := flags.String("profile", "", "The id or name of the profile, optional if there is only one.")
+	builder := flags.String("builder", "", "The id of the builder, optional if there is only one.")
+	var tweaks stringsFlag
+	flags.Var(&tweaks, "tweak", "A tweak to inject, can be repeated.")
+	params := signParams{}
+	flags.BoolVar(&params.AllDevices, "all-devices", false, "Register all devices with the account. Only for developer accounts.")
+	flags.BoolVar(&params.Mac, "mac", false, "Register the app for macOS too. Only for developer accounts.")
+	flags.BoolVar(&params.AppDebug, "debug", false, "Enable app debugging (get-task-allow).")
+	flags.BoolVar(&params.FileShare, "file-share", false, "Enable file sharing.")
+	bundleId := flags.String("bundle-id", "", "Sign with this bundle id.")
+	provBundleId := flags.Bool("prov-bundle-id", false, "Sign with the bundle id of the provisioning profile.")
+	flags.BoolVar(&params.IdEncode, "encode-ids", false, "Encode the ids of the app and its extensions.")
+	flags.BoolVar(&params.IdForceOriginal, "force-original-id", false, "Keep the original bundle id, even with a developer account.")
+	flags.BoolVar(&params.IdPatch, "patch-ids", false, "Patch the bundle id checks of the app.")
+	flags.StringVar(&params.BundleName, "bundle-name", "", "Sign a differently named copy that can be installed alongside the original.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if (flags.NArg() == 1) == (*fileUrl != "") {
+		flags.Usage()
+		return errors.New("expected either a file or -url")
+	}
+	switch {
+	case *bundleId != "" && *provBundleId:
+		return errors.New("-bundle-id and -prov-bundle-id are mutually exclusive")
+	case *bundleId != "":
+		params.IdType = formNames.FormIdCustom
+		params.IdCustomText = *bundleId
+	case *provBundleId:
+		params.IdType = formNames.FormIdProv
+	default:
+		params.IdType = formNames.FormIdOriginal
+	}
+
+	var err error
+	if params.ProfileId, err = client.findProfile(*profile); err != nil {
+		return err
+	}
+	if params.BuilderId, err = client.findBuilder(*builder); err != nil {
+		return err
+	}
+	for _, tweak := range tweaks {
+		tweakId, err := client.upload(tweak)
+		if err != nil {
+			return errors.WithMessagef(err, "upload tweak %s", tweak)
+		}
+		params.TweakIds = append(params.TweakIds, tweakId)
+	}
+	if *fileUrl != "" {
+		params.FileUrl = *fileUrl
+	} else if params.FileId, err = client.upload(flags.Arg(0)); err != nil {
+		return errors.WithMessage(err, "upload app")
+	}
+	var app appJson
+	if err := client.call("POST", "/apps", params, &app); err != nil {
+		return err
+	}
+	log.Info().Str("id", app.Id).Str("name", app.Name).Msg("created app")
+	return client.waitAndDownload(app, wait, out)
+}
+
+func runResignCommand(args []string, out io.Writer) error {
+	flags := newCommandFlags("resign", "[flags] <app id>")
+	client := addClientFlags(flags)
+	wait := addWaitFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("expected an app id")
+	}
+	var app appJson
+	if err := client.call("POST", "/apps/"+url.PathEscape(flags.Arg(0))+"/resign", nil, &app); err != nil {
+		return err
+	}
+	return client.waitAndDownload(app, wait, out)
+}
+
+func runListCommand(args []string, out io.Writer) error {
+	flags := newCommandFlags("list", "[flags]")
+	client := addClientFlags(flags)
+	query := url.Values{}
+	for _, name := range []string{"q", "status", "folder", "tag", "sort", "page", "per_page"} {
+		flags.Func(name, "The "+name+" parameter of the app list query.", func(value string) error {
+			query.Set(name, value)
+			return nil
+		})
+	}
+	asJson := flags.Bool("json", false, "Print the response as JSON.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	var list appListJson
+	if err := client.call("GET", "/apps?"+query.Encode(), nil, &list); err != nil {
+		return err
+	}
+	if *asJson {
+		return printJson(out, list)
+	}
+	writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tSTATUS\tNAME\tPROFILE\tMODIFIED")
+	for _, app := range list.Apps {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n",
+			app.Id, app.Status, app.Name, app.ProfileName, app.ModTime.Local().Format(time.RFC822))
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if len(list.Apps) < list.Total {
+		fmt.Fprintf(out, "Showing %d of %d apps, page %d.\n", len(list.Apps), list.Total, list.Page)
+	}
+	return nil
+}
+
+func runDownloadCommand(args []string, out io.Writer) error {
+	flags := newCommandFlags("download", "[flags] <app id>")
+	client := addClientFlags(flags)
+	unsigned := flags.Bool("unsigned", false, "Download the unsigned app instead.")
+	fileName := flags.String("out", "", "Where to save the app, by default named after the app.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("expected an app id")
+	}
+	var app appJson
+	if err := client.call("GET", "/apps/"+url.PathEscape(flags.Arg(0)), nil, &app); err != nil {
+		return err
+	}
+	fileType := "signed"
+	if *unsigned {
+		fileType = "unsigned"
+	}
+	if *fileName == "" {
+		*fileName = defaultAppFileName(app.Name, fileType)
+	}
+	return client.download(path.Join("/apps", app.Id, fileType), *fileName, out)
+}
+
+func runDeleteCommand(args []string, _ io.Writer) error {
+	flags := newCommandFlags("delete", "[flags] <app id>...")
+	client := addClientFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return errors.New("expected at least one app id")
+	}
+	for _, id := range flags.Args() {
+		if err := client.call("DELETE", "/apps/"+url.PathEscape(id), nil, nil); err != nil {
+			return err
+		}
+		log.Info().Str("id", id).Msg("deleted app")
+	}
+	return nil
+}
+
+func runProfilesCommand(args []string, out io.Writer) error {
+	flags := newCommandFlags("profiles", "[flags]")
+	client := addClientFlags(flags)
+	asJson := flags.Bool("json", false, "Print the response as JSON.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	var profiles []profileJson
+	if err := client.call("GET", "/profiles", nil, &profiles); err != nil {
+		return err
+	}
+	if *asJson {
+		return printJson(out, profiles)
+	}
+	writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tNAME\tTYPE\tREVOKED")
+	for _, profile := range profiles {
+		profileType := "provisioning profile"
+		if profile.IsAccount {
+			profileType = "developer account"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%t\n", profile.Id, profile.Name, profileType, profile.IsRevoked)
+	}
+	return writer.Flush()
+}
+
+func printJson(out io.Writer, value any) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// Names the downloaded file after the app, e.g. "My App-signed.ipa".
+func defaultAppFileName(appName string, fileType string) string {
+	name := filepath.Base(appName)
+	ext := filepath.Ext(name)
+	if ext == "" {
+		ext = ".ipa"
+	}
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(name, ext), fileType, ext)
+}
+
+// A flag that can be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// A client of the JSON API of a running server.
+type apiClient struct {
+	serverUrl string
+	username  string
+	password  string
+	token     string
+}
+
+func addClientFlags(flags *flag.FlagSet) *apiClient {
+	client := apiClient{}
+	flags.StringVar(&client.serverUrl, "server", getEnv("SIGNTOOLS_SERVER", "http://localhost:8080"),
+		"The url of the server. Defaults to $SIGNTOOLS_SERVER.")
+	flags.StringVar(&client.username, "username", os.Getenv("SIGNTOOLS_USERNAME"),
+		"The username, if the server has users. Defaults to $SIGNTOOLS_USERNAME.")
+	flags.StringVar(&client.password, "password", os.Getenv("SIGNTOOLS_PASSWORD"),
+		"The password of the user. Defaults to $SIGNTOOLS_PASSWORD.")
+	flags.StringVar(&client.token, "token", os.Getenv("SIGNTOOLS_TOKEN"),
+		"An API token, used instead of the username and password. Defaults to $SIGNTOOLS_TOKEN.")
+	return &client
+}
+
+func getEnv(name string, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return fallback
+}
+
+func (c *apiClient) url(path string) string {
+	return strings.TrimSuffix(c.serverUrl, "/") + path
+}
+
+func (c *apiClient) authorize(header http.Header) {
+	if c.token != "" {
+		header.Set("Authorization", "Bearer "+c.token)
+	} else if c.username != "" || c.password != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(c.username + ":" + c.password))
+		header.Set("Authorization", "Basic "+credentials)
+	}
+}
+
+// Calls the JSON API at the path relative to apiPrefix. The body and result are encoded as JSON and may be nil.
+func (c *apiClient) call(method string, path string, body any, result any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.url(apiPrefix+path), reader)
+	if err != nil {
+		return err
+	}
+	c.authorize(req.Header)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var apiErr apiErrorJson
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error.Message == "" {
+			return errors.Errorf("%s %s: %s", method, path, resp.Status)
+		}
+		return errors.Errorf("%s %s: %s", method, path, apiErr.Error.Message)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Finds a profile by id or name. If none is specified, the only profile is used.
+func (c *apiClient) findProfile(idOrName string) (string, error) {
+	var profiles []profileJson
+	if err := c.call("GET", "/profiles", nil, &profiles); err != nil {
+		return "", err
+	}
+	if idOrName == "" {
+		if len(profiles) != 1 {
+			return "", errors.Errorf("found %d profiles, specify one with -profile", len(profiles))
+		}
+		return profiles[0].Id, nil
+	}
+	for _, profile := range profiles {
+		if profile.Id == idOrName || profile.Name == idOrName {
+			return profile.Id, nil
+		}
+	}
+	return "", errors.New("no profile with id or name " + idOrName)
+}
+
+// If no builder is specified, the only builder is used.
+func (c *apiClient) findBuilder(id string) (string, error) {
+	if id != "" {
+		return id, nil
+	}
+	var builders []builderJson
+	if err := c.call("GET", "/builders", nil, &builders); err != nil {
+		return "", err
+	}
+	if len(builders) != 1 {
+		return "", errors.Errorf("found %d builders, specify one with -builder", len(builders))
+	}
+	return builders[0].Id, nil
+}
+
+const uploadAttempts = 3
+
+// Uploads the file with tus and returns the upload id. Interrupted uploads are resumed, also across runs.
+func (c *apiClient) upload(fileName string) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	upload, err := tus.NewUploadFromFile(file)
+	if err != nil {
+		return "", err
+	}
+	upload.Fingerprint = c.serverUrl + " " + upload.Fingerprint
+	store, err := openUploadStore()
+	if err != nil {
+		return "", err
+	}
+	defer store.Close()
+	tusConfig := tus.DefaultConfig()
+	tusConfig.Resume = true
+	tusConfig.Store = store
+	c.authorize(tusConfig.Header)
+	tusClient, err := tus.NewClient(c.url("/tus/"), tusConfig)
+	if err != nil {
+		return "", err
+	}
+	for attempt := 1; ; attempt++ {
+		uploader, err := tusClient.ResumeUpload(upload)
+		if err != nil {
+			uploader, err = tusClient.CreateUpload(upload)
+		}
+		if err == nil {
+			log.Info().Str("file", fileName).Int64("offset", uploader.Offset()).Int64("size", upload.Size()).Msg("uploading")
+			if err = uploader.Upload(); err == nil {
+				store.Delete(upload.Fingerprint)
+				return path.Base(uploader.Url()), nil
+			}
+		}
+		if attempt >= uploadAttempts {
+			return "", err
+		}
+		log.Warn().Err(err).Str("file", fileName).Msg("upload interrupted, resuming")
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+func (c *apiClient) download(path string, fileName string, out io.Writer) error {
+	req, err := http.NewRequest("GET", c.url(path), nil)
+	if err != nil {
+		return err
+	}
+	c.authorize(req.Header)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("GET %s: %s", path, resp.Status)
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		file.Close()
+		os.Remove(fileName)
+		return errors.WithMessage(err, "download")
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintln(out, fileName)
+	return nil
+}
+
+// Polls the app until it is signed or has failed, then downloads the signed app.
+func (c *apiClient) waitAndDownload(app appJson, flags *waitFlags, out io.Writer) error {
+	if !flags.wait {
+		fmt.Fprintln(out, app.Id)
+		return nil
+	}
+	log.Info().Str("id", app.Id).Msg("waiting for the app to be signed")
+	deadline := time.Now().Add(flags.timeout)
+	for app.Status != appStatusNames[assets.AppStatusSigned] {
+		if app.Status == appStatusNames[assets.AppStatusFailed] {
+			if app.FailReason != "" {
+				return errors.New("signing failed: " + app.FailReason)
+			}
+			return errors.New("signing failed, check the builder's logs")
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("app is still %s after %s", app.Status, flags.timeout)
+		}
+		time.Sleep(flags.pollInterval)
+		if err := c.call("GET", "/apps/"+url.PathEscape(app.Id), nil, &app); err != nil {
+			return err
+		}
+	}
+	fileName := flags.out
+	if fileName == "" {
+		fileName = defaultAppFileName(app.Name, "signed")
+	}
+	return c.download(path.Join("/apps", app.Id, "signed"), fileName, out)
+}
+
+// Remembers the urls of unfinished uploads, so that they can be resumed by the next run.
+type uploadStore struct {
+	mu       sync.Mutex
+	fileName string
+	urls     map[string]string
+}
+
+func openUploadStore() (*uploadStore, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	store := uploadStore{fileName: filepath.Join(cacheDir, "SignTools", "uploads.json"), urls: map[string]string{}}
+	data, err := os.ReadFile(store.fileName)
+	if os.IsNotExist(err) {
+		return &store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.urls); err != nil {
+		log.Warn().Err(err).Str("file", store.fileName).Msg("discarding unreadable upload store")
+	}
+	return &store, nil
+}
+
+func (s *uploadStore) Get(fingerprint string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.urls[fingerprint]
+	return value, ok
+}
+
+func (s *uploadStore) Set(fingerprint string, url string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.urls[fingerprint] = url
+	s.save()
+}
+
+func (s *uploadStore) Delete(fingerprint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.urls, fingerprint)
+	s.save()
+}
+
+func (s *uploadStore) Close() {}
+
+// Must be called with mu held. Failing to save only prevents resuming, so it's not fatal.
+func (s *uploadStore) save() {
+	data, err := json.Marshal(s.urls)
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(s.fileName), 0700); err == nil {
+			err = os.WriteFile(s.fileName, data, 0600)
+		}
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("file", s.fileName).Msg("save upload store")
+	}
+}
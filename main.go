@@ -4,11 +4,15 @@ import (
 	"SignTools/src/assets"
 	"SignTools/src/builders"
 	"SignTools/src/config"
+	"SignTools/src/ipa"
+	"SignTools/src/oidc"
 	"SignTools/src/storage"
 	"SignTools/src/tunnel"
 	"SignTools/src/util"
 	"archive/tar"
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"encoding/xml"
 	"flag"
 	"fmt"
@@ -26,14 +30,19 @@ import (
 	log3 "golang.org/x/exp/slog"
 	htmlTemplate "html/template"
 	"io"
+	"maps"
 	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
 	textTemplate "text/template"
 	"time"
 )
@@ -61,6 +70,19 @@ var formNames = assets.FormNames{
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := getCliCommand(os.Args[1]); ok {
+			log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+			if err := command.run(os.Args[2:], os.Stdout); errors.Is(err, flag.ErrHelp) {
+				return
+			} else if err != nil {
+				log.Fatal().Err(err).Msg(command.name)
+			}
+			return
+		}
+	}
+
+	flag.Usage = printUsage
 	host := flag.String("host", "", "Listen host, empty for all")
 	port := flag.Uint64("port", 8080, "Listen port")
 	configFile := flag.String("config", "signer-cfg.yml", "Configuration file")
@@ -70,6 +92,23 @@ func main() {
 		"Used to automatically parse the server_url")
 	logJson := flag.Bool("log-json", false, "If enabled, outputs logs in JSON instead of pretty printing them.")
 	logLevel := flag.Uint("log-level", uint(zerolog.InfoLevel), "Logging level, 0 (debug) - 5 (panic).")
+	encryptProfiles := flag.Bool("encrypt-profiles", false, "Encrypt all profile files in place with the master key, then exit.")
+	rotateMasterKey := flag.String("rotate-master-key", "", "Re-encrypt all profile files with the master key from this file, then exit. "+
+		"Afterwards, configure the new key in place of the old one.")
+	importBundle := flag.String("import-profile", "", "Import a profile from this bundle file, then exit.")
+	exportProfileId := flag.String("export-profile", "", "Export the profile with this id to a bundle file, then exit.")
+	exportProfileOut := flag.String("export-profile-out", "profile.bundle", "Where to save the exported profile bundle.")
+	profileBundlePass := flag.String("profile-bundle-pass", "", "Password of the imported or exported profile bundle, required for exporting.")
+	createTokenName := flag.String("create-token", "", "Create an API token with this name, print its secret, then exit.")
+	tokenScope := flag.String("token-scope", string(storage.ScopeSign), "Scope of the created API token: read, sign or admin.")
+	tokenUser := flag.String("token-user", "", "The user that the created API token acts as, required if any users exist.")
+	revokeTokenId := flag.String("revoke-token", "", "Revoke the API token with this id, then exit.")
+	listTokens := flag.Bool("list-tokens", false, "List the API tokens, then exit.")
+	createUserName := flag.String("create-user", "", "Create a user with this name, then exit.")
+	userRole := flag.String("user-role", string(storage.RoleAdmin), "Role of the created user: viewer, signer or admin.")
+	userPassword := flag.String("user-password", "", "Password of the created user. Read from stdin if empty.")
+	deleteUserName := flag.String("delete-user", "", "Delete the user with this name, then exit.")
+	listUsers := flag.Bool("list-users", false, "List the users, then exit.")
 	flag.Parse()
 
 	zerolog.SetGlobalLevel(zerolog.Level(*logLevel))
@@ -79,6 +118,97 @@ func main() {
 
 	config.Load(*configFile)
 	storage.Load()
+	if *encryptProfiles {
+		if err := storage.EncryptProfiles(); err != nil {
+			log.Fatal().Err(err).Msg("encrypt profiles")
+		}
+		log.Info().Msg("encrypted profiles")
+		return
+	}
+	if *rotateMasterKey != "" {
+		newKey, err := config.ReadMasterKeyFile(*rotateMasterKey)
+		if err != nil {
+			log.Fatal().Err(err).Msg("read new master key")
+		}
+		if err := storage.RotateProfileKey(newKey); err != nil {
+			log.Fatal().Err(err).Msg("rotate master key")
+		}
+		log.Info().Msg("rotated master key")
+		return
+	}
+	if *importBundle != "" {
+		if err := importProfileFile(*importBundle, *profileBundlePass); err != nil {
+			log.Fatal().Err(err).Msg("import profile")
+		}
+		return
+	}
+	if *exportProfileId != "" {
+		if err := exportProfileFile(*exportProfileId, *exportProfileOut, *profileBundlePass); err != nil {
+			log.Fatal().Err(err).Msg("export profile")
+		}
+		return
+	}
+	if *createUserName != "" {
+		password := *userPassword
+		if password == "" {
+			fmt.Fprint(os.Stderr, "Password: ")
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				log.Fatal().Err(err).Msg("read password")
+			}
+			password = strings.TrimRight(line, "\r\n")
+		}
+		if _, err := newUser(*createUserName, password, *userRole); err != nil {
+			log.Fatal().Err(err).Msg("create user")
+		}
+		return
+	}
+	if *deleteUserName != "" {
+		user, ok := storage.Users.GetByName(*deleteUserName)
+		if !ok {
+			log.Fatal().Str("user", *deleteUserName).Msg("no such user")
+		}
+		if _, err := storage.Users.Delete(user.Id); err != nil {
+			log.Fatal().Err(err).Msg("delete user")
+		}
+		log.Info().Str("user", user.Name).Msg("deleted user")
+		return
+	}
+	if *listUsers {
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "NAME\tROLE")
+		for _, user := range storage.Users.GetAll() {
+			fmt.Fprintf(writer, "%s\t%s\n", user.Name, user.Role)
+		}
+		writer.Flush()
+		return
+	}
+	if *createTokenName != "" {
+		token, secret, err := newToken(*createTokenName, *tokenScope, *tokenUser)
+		if err != nil {
+			log.Fatal().Err(err).Msg("create token")
+		}
+		fmt.Println(token.Id, secret)
+		return
+	}
+	if *revokeTokenId != "" {
+		if ok, err := storage.Tokens.Delete(*revokeTokenId); err != nil {
+			log.Fatal().Err(err).Msg("revoke token")
+		} else if !ok {
+			log.Fatal().Str("id", *revokeTokenId).Msg("no such token")
+		}
+		log.Info().Str("id", *revokeTokenId).Msg("revoked token")
+		return
+	}
+	if *listTokens {
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "ID\tNAME\tSCOPE\tUSER\tCREATED")
+		for _, token := range storage.Tokens.GetAll() {
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", token.Id, token.Name, token.Scope, token.User, token.Created.Format(time.RFC3339))
+		}
+		writer.Flush()
+		return
+	}
 	switch {
 	case *ngrokHost != "":
 		config.Current.ServerUrl = getPublicUrlFatal(&tunnel.Ngrok{Host: *ngrokHost, Proto: "https"})
@@ -90,6 +220,36 @@ func main() {
 	serve(*host, *port)
 }
 
+func importProfileFile(fileName string, password string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	profile, err := storage.Profiles.Import(file, password)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("id", profile.GetId()).Msg("imported profile")
+	return nil
+}
+
+func exportProfileFile(id string, fileName string, password string) error {
+	profile, ok := storage.Profiles.GetById(id)
+	if !ok {
+		return errors.New("no profile with id " + id)
+	}
+	var result bytes.Buffer
+	if err := storage.ExportProfile(profile, &result, password); err != nil {
+		return err
+	}
+	if err := os.WriteFile(fileName, result.Bytes(), 0600); err != nil {
+		return err
+	}
+	log.Info().Str("file", fileName).Msg("exported profile")
+	return nil
+}
+
 func getPublicUrlFatal(provider tunnel.Provider) string {
 	log.Info().Msg("obtaining server url")
 	serverUrl, err := tunnel.GetPublicUrl(provider, 15*time.Second)
@@ -110,9 +270,21 @@ func serve(host string, port uint64) {
 		for range time.Tick(interval) {
 			storage.Jobs.Cleanup(timeout)
 			storage.Uploads.Cleanup(timeout)
+			storage.ShareLinks.Cleanup()
+			authLimits.Cleanup(getLockoutDuration())
 		}
 	}()
 
+	if config.Current.RevocationCheck.Enable {
+		revocationInterval := time.Duration(config.Current.RevocationCheck.RefreshIntervalMins) * time.Minute
+		go func() {
+			for {
+				storage.Revocations.Refresh(config.Current.RevocationCheck.ResponderUrl)
+				time.Sleep(revocationInterval)
+			}
+		}()
+	}
+
 	log.Info().Msg("setting builder secrets")
 	for _, builder := range config.Current.Builder {
 		if err := setBuilderSecrets(builder); err != nil {
@@ -120,60 +292,396 @@ func serve(host string, port uint64) {
 		}
 	}
 
+	e, err := newServer()
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+	log.Fatal().Err(e.Start(fmt.Sprintf("%s:%d", host, port))).Send()
+}
+
+// Creates the server and registers all of its handlers. The JSON endpoints must be kept in sync
+// with assets.OpenApiJson.
+func newServer() (*echo.Echo, error) {
 	e := echo.New()
 	e.HideBanner = true
 	logger := lecho.From(log.Logger, lecho.WithLevel(log2.INFO))
 	e.Logger = logger
 	e.Use(lecho.Middleware(lecho.Config{Logger: logger}))
+	trustedProxies, err := parseTrustedProxies(config.Current.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	e.IPExtractor = makeIpExtractor(trustedProxies)
 
-	forcedBasicAuth := middleware.BasicAuth(func(username string, password string, c echo.Context) (bool, error) {
-		return username == config.Current.BasicAuth.Username && password == config.Current.BasicAuth.Password, nil
+	userAuth := makeUserAuth()
+	readAuth, signAuth, adminAuth := userAuth(storage.ScopeRead), userAuth(storage.ScopeSign), userAuth(storage.ScopeAdmin)
+	shareAuth := makeShareAuth(readAuth)
+	unsharedAuth := makeUnsharedAuth(readAuth)
+	keyAuth := middleware.KeyAuth(func(s string, c echo.Context) (bool, error) {
+		if s != config.Current.BuilderKey {
+			addAuthFailure(c)
+			return false, nil
+		}
+		return true, nil
 	})
-	basicAuth := func(f echo.HandlerFunc) echo.HandlerFunc {
-		if config.Current.BasicAuth.Enable {
-			return forcedBasicAuth(f)
-		} else {
-			return f
+	workflowKeyAuth := func(f echo.HandlerFunc) echo.HandlerFunc {
+		withKey := keyAuth(f)
+		return func(c echo.Context) error {
+			if err := checkAuthLockout(c); err != nil {
+				return err
+			}
+			return withKey(c)
 		}
 	}
-	workflowKeyAuth := middleware.KeyAuth(func(s string, c echo.Context) (bool, error) {
-		return s == config.Current.BuilderKey, nil
-	})
 
 	if config.Current.RedirectHttps {
 		e.Pre(middleware.HTTPSRedirectWithConfig(middleware.RedirectConfig{
 			Code: 302,
 		}))
 	}
+	if config.Current.RateLimit.Enable {
+		e.Use(makeRateLimit())
+	}
+	e.Use(makeCsrfProtection())
+
+	e.GET("/", renderIndex, readAuth)
+	e.GET("/favicon.png", getFavIcon)
+	e.GET("/login", renderLogin)
+	e.POST("/login", login, audit("user.login"))
+	e.POST("/logout", logout, audit("user.logout"))
+	e.GET("/login/oidc", startOidcLogin)
+	e.GET("/login/oidc/callback", finishOidcLogin, audit("user.login"))
+	e.GET("/apps", getAppList, readAuth)
+	e.POST("/apps", uploadUnsignedApp, audit("app.create"), signAuth)
+	getAndHead(e, "/apps/:id/signed", appResolver(getSignedApp), appResolver(getSignedApp), shareAuth)
+	getAndHead(e, "/apps/:id/tweaks", appResolver(getTweaks), appResolver(getEmpty200App), unsharedAuth)
+	getAndHead(e, "/apps/:id/unsigned", appResolver(getUnsignedApp), appResolver(getUnsignedApp), unsharedAuth)
+	getAndHead(e, "/apps/:id/icon", appResolver(getIcon), appResolver(getIcon))
+	e.GET("/apps/:id/install", appResolver(renderInstall), shareAuth)
+	e.GET("/apps/:id/manifest", appResolver(getManifest), shareAuth)
+	e.GET("/apps/:id/share", appResolver(renderShareApp), signAuth)
+	e.POST("/apps/:id/share", appResolver(shareApp), audit("app.share"), signAuth)
+	e.POST("/apps/:id/resign", appResolver(resignApp), audit("app.resign"), signAuth)
+	e.POST("/apps/:id/delete", appResolver(deleteApp), audit("app.delete"), adminAuth)
+	if config.Current.LegacyGetActions {
+		e.GET("/apps/:id/resign", appResolver(resignApp), audit("app.resign"), signAuth)
+		e.GET("/apps/:id/delete", appResolver(deleteApp), audit("app.delete"), adminAuth)
+	}
+	e.GET("/apps/:id/rename", appResolver(renderRenameApp), signAuth)
+	e.POST("/apps/:id/rename", appResolver(renameApp), audit("app.update"), signAuth)
+	e.GET("/apps/:id/details", appResolver(renderAppDetails), signAuth)
+	e.POST("/apps/:id/details", appResolver(setAppDetails), audit("app.update"), signAuth)
+	e.GET("/apps/:id/entitlements", appResolver(renderEntitlements), readAuth)
+	e.GET("/apps/:id/entitlements.json", appResolver(getEntitlements), readAuth)
+	e.POST("/profiles", importProfile, audit("profile.import"), adminAuth)
+	e.POST("/profiles/:id/export", profileResolver(exportProfile), audit("profile.export"), adminAuth)
+	e.GET("/apps/:id/2fa", appResolver(render2FAPage), signAuth)
+	e.POST("/apps/:id/2fa", appResolver(set2FA), audit("app.2fa"), signAuth)
+	e.GET("/tokens", renderTokens, adminAuth)
+	e.POST("/tokens", createToken, audit("token.create"), adminAuth)
+	e.POST("/tokens/:id/revoke", revokeToken, audit("token.revoke"), adminAuth)
+	e.GET("/users", renderUsers, adminAuth)
+	e.POST("/users", createUser, audit("user.create"), adminAuth)
+	e.POST("/users/:id", updateUser, audit("user.update"), adminAuth)
+	e.POST("/users/:id/delete", deleteUser, audit("user.delete"), adminAuth)
+	e.GET("/audit", renderAudit, adminAuth)
+	e.GET("/audit.jsonl", exportAudit, adminAuth)
+	// builders poll with HEAD, which isn't worth auditing
+	e.GET("/jobs", getLastJob, auditBuilder("job.take"), workflowKeyAuth)
+	e.HEAD("/jobs", getEmpty200, workflowKeyAuth)
+	e.GET("/jobs/:id/2fa", jobResolver(get2FA), auditBuilder("job.2fa"), workflowKeyAuth)
+	e.POST("/jobs/:id/signed", jobResolver(uploadSignedApp), auditBuilder("job.signed"), workflowKeyAuth)
+	e.GET("/jobs/:id/unsigned", jobResolver(getUnsignedAppJob), auditBuilder("job.unsigned"), workflowKeyAuth)
+	e.HEAD("/jobs/:id/unsigned", jobResolver(getUnsignedAppJob), workflowKeyAuth)
+	e.GET("/jobs/:id/fail", jobResolver(failJob), auditBuilder("job.fail"), workflowKeyAuth)
+	addApiHandlers(e, userAuth)
 
-	e.GET("/", renderIndex, basicAuth)
-	e.GET("/favicon.png", getFavIcon, basicAuth)
-	e.POST("/apps", uploadUnsignedApp, basicAuth)
-	getAndHead(e, "/apps/:id/signed", appResolver(getSignedApp), appResolver(getSignedApp))
-	getAndHead(e, "/apps/:id/tweaks", appResolver(getTweaks), appResolver(getEmpty200App))
-	getAndHead(e, "/apps/:id/unsigned", appResolver(getUnsignedApp), appResolver(getUnsignedApp))
-	e.GET("/apps/:id/install", appResolver(renderInstall))
-	e.GET("/apps/:id/manifest", appResolver(getManifest))
-	e.GET("/apps/:id/resign", appResolver(resignApp), basicAuth)
-	e.GET("/apps/:id/delete", appResolver(deleteApp), basicAuth)
-	e.GET("/apps/:id/rename", appResolver(renderRenameApp), basicAuth)
-	e.POST("/apps/:id/rename", appResolver(renameApp), basicAuth)
-	e.GET("/apps/:id/2fa", appResolver(render2FAPage), basicAuth)
-	e.POST("/apps/:id/2fa", appResolver(set2FA), basicAuth)
-	getAndHead(e, "/jobs", getLastJob, getEmpty200, workflowKeyAuth)
-	e.GET("/jobs/:id/2fa", jobResolver(get2FA), workflowKeyAuth)
-	e.POST("/jobs/:id/signed", jobResolver(uploadSignedApp), workflowKeyAuth)
-	getAndHead(e, "/jobs/:id/unsigned", jobResolver(getUnsignedAppJob), jobResolver(getUnsignedAppJob), workflowKeyAuth)
-	e.GET("/jobs/:id/fail", jobResolver(failJob), workflowKeyAuth)
-
-	if err := addTusHandlers(e, map[string]echo.MiddlewareFunc{
-		"/tus/":          basicAuth,
-		"/jobs/:id/tus/": workflowKeyAuth,
+	if err := addTusHandlers(e, map[string][]echo.MiddlewareFunc{
+		"/tus/":          {audit("upload.create"), signAuth},
+		"/jobs/:id/tus/": {auditBuilder("job.upload"), workflowKeyAuth},
 	}); err != nil {
-		log.Fatal().Err(err).Send()
+		return nil, err
 	}
+	return e, nil
+}
 
-	log.Fatal().Err(e.Start(fmt.Sprintf("%s:%d", host, port))).Send()
+const (
+	userContextKey    = "user"
+	scopeContextKey   = "scope"
+	sessionCookieName = "session"
+)
+
+// Returns the authenticated user. Empty if authentication is disabled, or for API tokens created while it was.
+func getUser(c echo.Context) string {
+	user, _ := c.Get(userContextKey).(string)
+	return user
+}
+
+// Whether the request is allowed to do everything, which is always the case if authentication is disabled.
+func isAdmin(c echo.Context) bool {
+	scope, _ := c.Get(scopeContextKey).(storage.Scope)
+	return scope.Allows(storage.ScopeAdmin)
+}
+
+// Whether the request can see the app. Admins can see all apps, and everyone else only their own. Routes without
+// authentication, like the install and download links, rely on the app id being impossible to guess instead.
+func canAccessApp(c echo.Context, app storage.App) bool {
+	if _, ok := c.Get(scopeContextKey).(storage.Scope); !ok {
+		return true
+	}
+	return isAdmin(c) || app.GetInfo().Owner == getUser(c)
+}
+
+var errNotLoggedIn = echo.NewHTTPError(401, "Not logged in")
+
+const (
+	csrfContextKey = "csrf"
+	csrfFormName   = "_csrf"
+)
+
+// Returns a middleware that rejects state-changing requests made by other websites in the user's browser.
+// Browsers that send Sec-Fetch-Site are checked with it, and older ones with a token that every form must
+// include, see getCsrfToken. Requests with an API token, including the builders', can't be made by other
+// websites, and neither can requests of scripts, which send no cookies.
+func makeCsrfProtection() echo.MiddlewareFunc {
+	return middleware.CSRFWithConfig(middleware.CSRFConfig{
+		Skipper: func(c echo.Context) bool {
+			request := c.Request()
+			if strings.HasPrefix(request.Header.Get(echo.HeaderAuthorization), "Bearer ") {
+				return true
+			}
+			return request.Header.Get(echo.HeaderSecFetchSite) == "" && len(request.Cookies()) == 0
+		},
+		TokenLookup:    "header:" + echo.HeaderXCSRFToken + ",form:" + csrfFormName,
+		ContextKey:     csrfContextKey,
+		CookieName:     csrfFormName,
+		CookiePath:     "/",
+		CookieMaxAge:   int(storage.SessionLifetime.Seconds()),
+		CookieSecure:   isSecureServerUrl(),
+		CookieHTTPOnly: true,
+		CookieSameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Returns the CSRF token that forms must send in the _csrf field, or scripts in the X-CSRF-Token header.
+func getCsrfToken(c echo.Context) string {
+	token, _ := c.Get(csrfContextKey).(string)
+	return token
+}
+
+// Whether requests must be authenticated, which is the case once any users exist or OIDC is enabled.
+func isAuthRequired() bool {
+	return storage.Users.Any() || config.Current.OIDC.Enable
+}
+
+// Returns a middleware factory that requires the given scope. Requests are authenticated with an API token,
+// the session cookie of the login page, or basic auth credentials. Users have the scope of their role, and
+// API tokens are limited to the role of their user. If no users exist, everyone is an admin.
+func makeUserAuth() func(scope storage.Scope) echo.MiddlewareFunc {
+	return func(scope storage.Scope) echo.MiddlewareFunc {
+		return func(f echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				user, granted, err := authenticate(c)
+				if errors.Is(err, errNotLoggedIn) && c.Request().Method == http.MethodGet && !strings.HasPrefix(c.Path(), apiPrefix) {
+					return c.Redirect(302, "/login?next="+url.QueryEscape(c.Request().URL.RequestURI()))
+				} else if err != nil {
+					return err
+				}
+				if !granted.Allows(scope) {
+					return echo.NewHTTPError(403, fmt.Sprintf("Your %s access doesn't allow this, it requires %s", granted, scope))
+				}
+				c.Set(userContextKey, user)
+				c.Set(scopeContextKey, granted)
+				return f(c)
+			}
+		}
+	}
+}
+
+// Returns the user of the request and what they are allowed to do.
+func authenticate(c echo.Context) (string, storage.Scope, error) {
+	if secret, isBearer := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer "); isBearer {
+		if err := checkAuthLockout(c); err != nil {
+			return "", "", err
+		}
+		token, ok := storage.Tokens.Authenticate(secret)
+		if !ok {
+			addAuthFailure(c)
+			return "", "", echo.NewHTTPError(401, "Invalid API token")
+		}
+		if !isAuthRequired() {
+			return token.User, token.Scope, nil
+		}
+		user, ok := storage.Users.GetByName(token.User)
+		if !ok {
+			return "", "", echo.NewHTTPError(401, "The user of the API token doesn't exist")
+		}
+		return user.Name, token.Scope.Limit(user.Role.Scope()), nil
+	}
+	if !isAuthRequired() {
+		return "", storage.ScopeAdmin, nil
+	}
+	if cookie, err := c.Cookie(sessionCookieName); err == nil {
+		if name, ok := storage.Sessions.Get(cookie.Value); ok {
+			if user, ok := storage.Users.GetByName(name); ok {
+				return user.Name, user.Role.Scope(), nil
+			}
+		}
+	}
+	if name, password, ok := c.Request().BasicAuth(); ok {
+		if err := checkAuthLockout(c); err != nil {
+			return "", "", err
+		}
+		user, ok := storage.Users.Authenticate(name, password)
+		if !ok {
+			addAuthFailure(c)
+			return "", "", echo.NewHTTPError(401, "Invalid username or password")
+		}
+		return user.Name, user.Role.Scope(), nil
+	}
+	return "", "", errNotLoggedIn
+}
+
+const (
+	shareContextKey = "share"
+	shareQueryName  = "share"
+	// How long the share tokens that the install page makes for logged in users are valid for.
+	installShareLifetime = time.Hour
+)
+
+// Returns a middleware for the routes that install and download apps. Without share links, they need no
+// authentication and rely on the app id being impossible to guess. With them, they need either a share token
+// for the app or a user that can see the app.
+func makeShareAuth(readAuth echo.MiddlewareFunc) echo.MiddlewareFunc {
+	return func(f echo.HandlerFunc) echo.HandlerFunc {
+		withUser := readAuth(f)
+		return func(c echo.Context) error {
+			if !config.Current.ShareLinks.Enable {
+				return f(c)
+			}
+			token := c.QueryParam(shareQueryName)
+			if token == "" {
+				return withUser(c)
+			}
+			link, err := storage.ShareLinks.Verify(token)
+			if errors.Is(err, storage.ErrShareLinkUsedUp) {
+				return c.String(403, "This link has no downloads left")
+			} else if err != nil || link.AppId != c.Param("id") {
+				return c.String(403, "This link is invalid or has expired")
+			}
+			c.Set(shareContextKey, link)
+			return f(c)
+		}
+	}
+}
+
+// Returns a middleware for the routes that download an app's other files. Like makeShareAuth, they need no
+// authentication without share links. With them, they need a user that can see the app, since share links
+// only give access to the signed app.
+func makeUnsharedAuth(readAuth echo.MiddlewareFunc) echo.MiddlewareFunc {
+	return func(f echo.HandlerFunc) echo.HandlerFunc {
+		withUser := readAuth(f)
+		return func(c echo.Context) error {
+			if !config.Current.ShareLinks.Enable {
+				return f(c)
+			}
+			return withUser(c)
+		}
+	}
+}
+
+// Returns the share token that the install page and manifest must pass on to the urls they link to, because
+// iOS downloads apps without the user's cookies. Logged in users get a new short-lived one.
+func getInstallShareToken(c echo.Context, app storage.App) (string, error) {
+	if !config.Current.ShareLinks.Enable {
+		return "", nil
+	}
+	if _, ok := c.Get(shareContextKey).(storage.ShareLink); ok {
+		return c.QueryParam(shareQueryName), nil
+	}
+	_, token, err := storage.ShareLinks.New(app.GetId(), installShareLifetime, 0)
+	return token, err
+}
+
+func withShareToken(rawUrl string, token string) string {
+	if token == "" {
+		return rawUrl
+	}
+	return rawUrl + "?" + url.Values{shareQueryName: {token}}.Encode()
+}
+
+const auditContextKey = "audit"
+
+// Returns a middleware that records the request in the audit log once it's handled. It must go before the auth
+// middleware, so that rejected requests are recorded too. Handlers and resolvers add the ids that the request
+// is about with getAuditEntry.
+func audit(action string) echo.MiddlewareFunc {
+	return auditAs(action, getUser)
+}
+
+// Like audit, but for the routes of builders. They all share the builder key, so the builder is identified by
+// the app of the job instead.
+func auditBuilder(action string) echo.MiddlewareFunc {
+	return auditAs(action, func(c echo.Context) string {
+		if app, ok := storage.Apps.Get(getAuditEntry(c).AppId); ok {
+			if builderId, err := app.GetString(storage.AppBuilderId); err == nil {
+				return "builder:" + builderId
+			}
+		}
+		return "builder"
+	})
+}
+
+func auditAs(action string, getActor func(c echo.Context) string) echo.MiddlewareFunc {
+	return func(f echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			entry := &storage.AuditEntry{Time: time.Now(), Action: action, Ip: c.RealIP()}
+			c.Set(auditContextKey, entry)
+			// the tus middleware replaces the response of the context
+			response := c.Response()
+			err := f(c)
+			if entry.Actor == "" {
+				entry.Actor = getActor(c)
+			}
+			entry.Status = response.Status
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				entry.Status = httpErr.Code
+				entry.Error = fmt.Sprint(httpErr.Message)
+			} else if err != nil {
+				entry.Status = 500
+				entry.Error = err.Error()
+			}
+			if err := storage.Audit.Add(*entry); err != nil {
+				log.Err(err).Str("action", action).Msg("add audit entry")
+			}
+			return err
+		}
+	}
+}
+
+// Returns the audit entry of the request. If the route isn't audited, a throwaway entry is returned.
+func getAuditEntry(c echo.Context) *storage.AuditEntry {
+	if entry, ok := c.Get(auditContextKey).(*storage.AuditEntry); ok {
+		return entry
+	}
+	return &storage.AuditEntry{}
+}
+
+func auditApp(c echo.Context, app storage.App) {
+	entry := getAuditEntry(c)
+	entry.AppId = app.GetId()
+	entry.ProfileId, _ = app.GetString(storage.AppProfileId)
+}
+
+func auditJob(c echo.Context, job *storage.ReturnJob) {
+	entry := getAuditEntry(c)
+	entry.JobId = job.Id
+	if app, ok := storage.Apps.Get(job.AppId); ok {
+		auditApp(c, app)
+	} else {
+		entry.AppId = job.AppId
+	}
 }
 
 func getAndHead(e *echo.Echo, path string, getHandler func(c echo.Context) error, headHandler func(c echo.Context) error, m ...echo.MiddlewareFunc) {
@@ -185,19 +693,24 @@ func renderInstall(c echo.Context, app storage.App) error {
 	usingManifestProxy := false
 	baseUrl := getBaseUrl(c)
 	manifestUrl := ""
-	var err error
+	shareToken, err := getInstallShareToken(c, app)
+	if err != nil {
+		return err
+	}
 	if strings.HasPrefix(baseUrl, "https") {
 		// must be a full URL
 		manifestUrl, err = util.JoinUrls(baseUrl, "/apps", app.GetId(), "manifest")
 		if err != nil {
 			return errors.WithMessage(err, "build manifest url")
 		}
+		manifestUrl = withShareToken(manifestUrl, shareToken)
 	} else {
 		usingManifestProxy = true
 		downloadFullUrl, err := util.JoinUrls(baseUrl, "/apps", app.GetId(), "signed")
 		if err != nil {
 			return errors.WithMessage(err, "build download url")
 		}
+		downloadFullUrl = withShareToken(downloadFullUrl, shareToken)
 		proxyUrl := url.URL{
 			Scheme: "https",
 			Host:   "ota.signtools.workers.dev",
@@ -224,9 +737,14 @@ func renderInstall(c echo.Context, app storage.App) error {
 	if err != nil {
 		return err
 	}
+	iconUrl := ""
+	if hasIcon(app) {
+		iconUrl = path.Join("/apps", app.GetId(), "icon")
+	}
 	data := assets.InstallData{
 		ManifestUrl: manifestUrl,
 		AppName:     appName,
+		IconUrl:     iconUrl,
 	}
 	t, err := htmlTemplate.New("").Parse(assets.InstallHtml)
 	if err != nil {
@@ -240,7 +758,7 @@ func renderInstall(c echo.Context, app storage.App) error {
 }
 
 // https://tus.github.io/tusd/advanced-topics/usage-package/
-func addTusHandlers(e *echo.Echo, uploadEndpoints map[string]echo.MiddlewareFunc) error {
+func addTusHandlers(e *echo.Echo, uploadEndpoints map[string][]echo.MiddlewareFunc) error {
 	uploadsPath := storage.GetUploadsPath()
 	store := filestore.New(uploadsPath)
 	locker := filelocker.New(uploadsPath)
@@ -268,12 +786,16 @@ func addTusHandlers(e *echo.Echo, uploadEndpoints map[string]echo.MiddlewareFunc
 	stripMiddleware := echo.WrapMiddleware(func(h http.Handler) http.Handler {
 		return http.StripPrefix("/files/", h)
 	})
-	for prefix, authMiddleware := range uploadEndpoints {
+	for prefix, authMiddlewares := range uploadEndpoints {
 		// middlewares run in order, make sure auth goes first!
 		e.POST(prefix, func(c echo.Context) error {
+			if job, ok := storage.Jobs.GetById(c.Param("id")); ok {
+				auditJob(c, job)
+			}
 			handler.PostFile(c.Response().Writer, c.Request())
+			getAuditEntry(c).Target = path.Base(c.Response().Header().Get("Location"))
 			return nil
-		}, authMiddleware, tusMiddleware)
+		}, append(authMiddlewares, tusMiddleware)...)
 	}
 	e.HEAD("/files/:file_id", func(c echo.Context) error {
 		handler.HeadFile(c.Response().Writer, c.Request())
@@ -334,7 +856,7 @@ func renderRenameApp(c echo.Context, app storage.App) error {
 	if err != nil {
 		return err
 	}
-	data := assets.RenameData{AppName: appName}
+	data := assets.RenameData{AppName: appName, CsrfToken: getCsrfToken(c)}
 	t, err := htmlTemplate.New("").Parse(assets.RenameHtml)
 	if err != nil {
 		return err
@@ -353,6 +875,189 @@ func renameApp(c echo.Context, app storage.App) error {
 	return c.Redirect(302, "/")
 }
 
+func renderEntitlements(c echo.Context, app storage.App) error {
+	diff, isSigned, err := diffAppEntitlements(app)
+	if err != nil {
+		return err
+	}
+	appName, err := app.GetString(storage.AppName)
+	if err != nil {
+		return err
+	}
+	data := assets.EntitlementsData{AppName: appName, IsSigned: isSigned}
+	for _, binary := range diff {
+		binaryData := assets.BinaryEntitlements{Path: binary.Binary}
+		for _, change := range binary.Changes {
+			binaryData.Entitlements = append(binaryData.Entitlements, assets.Entitlement{
+				Key:      change.Key,
+				Unsigned: formatEntitlement(change.Unsigned),
+				Signed:   formatEntitlement(change.Signed),
+				Status:   change.Status,
+			})
+		}
+		data.Binaries = append(data.Binaries, binaryData)
+	}
+	t, err := htmlTemplate.New("").Parse(assets.EntitlementsHtml)
+	if err != nil {
+		return err
+	}
+	var result bytes.Buffer
+	if err := t.Execute(&result, data); err != nil {
+		return err
+	}
+	return c.HTMLBlob(200, result.Bytes())
+}
+
+func getEntitlements(c echo.Context, app storage.App) error {
+	diff, isSigned, err := diffAppEntitlements(app)
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, map[string]any{
+		"signed":   isSigned,
+		"binaries": diff,
+	})
+}
+
+func formatEntitlement(value any) string {
+	if value == nil {
+		return ""
+	}
+	if s, ok := value.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(b)
+}
+
+// Compares the entitlements of the unsigned and signed app. If the app isn't signed yet, only the unsigned
+// entitlements are returned.
+func diffAppEntitlements(app storage.App) ([]ipa.BinaryEntitlementsDiff, bool, error) {
+	unsigned, err := readAppEntitlements(app, storage.AppUnsignedFile)
+	if err != nil {
+		return nil, false, errors.WithMessage(err, "read unsigned entitlements")
+	}
+	var signed map[string]map[string]any
+	isSigned, err := app.IsSigned()
+	if err != nil {
+		return nil, false, err
+	}
+	if isSigned {
+		if signed, err = readAppEntitlements(app, storage.AppSignedFile); err != nil {
+			return nil, false, errors.WithMessage(err, "read signed entitlements")
+		}
+	}
+	return ipa.DiffEntitlements(unsigned, signed), isSigned, nil
+}
+
+func readAppEntitlements(app storage.App, name storage.FSName) (map[string]map[string]any, error) {
+	file, err := app.GetFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	archive, err := ipa.Open(file, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	return archive.Entitlements()
+}
+
+func renderAppDetails(c echo.Context, app storage.App) error {
+	info := app.GetInfo()
+	folders, err := getAppFolders(c)
+	if err != nil {
+		return err
+	}
+	data := assets.DetailsData{
+		AppName:   info.Name,
+		Folder:    info.Folder,
+		Tags:      strings.Join(info.Tags, ", "),
+		Notes:     info.Notes,
+		Folders:   folders,
+		CsrfToken: getCsrfToken(c),
+	}
+	t, err := htmlTemplate.New("").Parse(assets.DetailsHtml)
+	if err != nil {
+		return err
+	}
+	var result bytes.Buffer
+	if err := t.Execute(&result, data); err != nil {
+		return err
+	}
+	return c.HTMLBlob(200, result.Bytes())
+}
+
+// Sets the folder, tags and notes of the app. Fields that are not submitted are left unchanged.
+func setAppDetails(c echo.Context, app storage.App) error {
+	params, err := c.FormParams()
+	if err != nil {
+		return err
+	}
+	var folder, tags, notes *string
+	if value, ok := params["folder"]; ok {
+		folder = &value[0]
+	}
+	if value, ok := params["tags"]; ok {
+		tags = &value[0]
+	}
+	if value, ok := params["notes"]; ok {
+		notes = &value[0]
+	}
+	if err := saveAppDetails(app, folder, tags, notes); err != nil {
+		return err
+	}
+	return c.Redirect(302, "/")
+}
+
+// Saves the given details of the app, skipping the nil ones.
+func saveAppDetails(app storage.App, folder *string, tags *string, notes *string) error {
+	values := map[storage.FSName]string{}
+	if folder != nil {
+		values[storage.AppFolder] = strings.TrimSpace(*folder)
+	}
+	if tags != nil {
+		values[storage.AppTags] = strings.Join(storage.ParseTags(*tags), "\n")
+	}
+	if notes != nil {
+		values[storage.AppNotes] = strings.TrimSpace(*notes)
+	}
+	for name, value := range values {
+		if err := app.SetString(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the folders of the apps that the request can see.
+func getAppFolders(c echo.Context) ([]string, error) {
+	apps, err := storage.Apps.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var folders []string
+	for _, app := range apps {
+		if !canAccessApp(c, app) {
+			continue
+		}
+		if folder := app.GetInfo().Folder; folder != "" && !seen[folder] {
+			seen[folder] = true
+			folders = append(folders, folder)
+		}
+	}
+	sort.Strings(folders)
+	return folders, nil
+}
+
 func failJob(c echo.Context, job *storage.ReturnJob) error {
 	if !storage.Jobs.DeleteById(job.Id) {
 		return errors.New("unable to delete return job " + job.Id)
@@ -388,10 +1093,21 @@ func uploadSignedApp(c echo.Context, job *storage.ReturnJob) error {
 		return err
 	}
 	defer file.Close()
+	bundleId := c.FormValue("bundle_id")
+	if err := verifySignedApp(app, file, bundleId); err != nil {
+		logErrApp(err, app).Msg("verify signed app")
+		if err := app.SetString(storage.AppFailReason, err.Error()); err != nil {
+			return err
+		}
+		if !storage.Jobs.DeleteById(job.Id) {
+			return errors.New("unable to delete return job " + job.Id)
+		}
+		return c.String(400, "Invalid signed app: "+err.Error())
+	}
 	if err := app.SetFile(storage.AppSignedFile, file); err != nil {
 		return err
 	}
-	if err := app.SetString(storage.AppBundleId, c.FormValue("bundle_id")); err != nil {
+	if err := app.SetString(storage.AppBundleId, bundleId); err != nil {
 		return err
 	}
 	if !storage.Jobs.DeleteById(job.Id) {
@@ -400,6 +1116,48 @@ func uploadSignedApp(c echo.Context, job *storage.ReturnJob) error {
 	return c.NoContent(200)
 }
 
+// Checks that the builder signed the app with the app's profile and the expected bundle id.
+func verifySignedApp(app storage.App, file storage.ReadonlyFile, bundleId string) error {
+	profileId, err := app.GetString(storage.AppProfileId)
+	if err != nil {
+		return err
+	}
+	profile, ok := storage.Profiles.GetById(profileId)
+	if !ok {
+		return errors.New("no profile with id " + profileId)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := ipa.Validate(file, info.Size()); err != nil {
+		return err
+	}
+	archive, err := ipa.Open(file, info.Size())
+	if err != nil {
+		return err
+	}
+	provBytes, err := archive.VerifySignature(profile.GetCertificates(), bundleId)
+	if err != nil {
+		return err
+	}
+	isAccount, err := profile.IsAccount()
+	if err != nil {
+		return err
+	}
+	// Account profiles have their provisioning profiles generated by the builder
+	if !isAccount {
+		profileProvBytes, err := profile.GetProv()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(provBytes, profileProvBytes) {
+			return errors.New("embedded provisioning profile does not match the profile's")
+		}
+	}
+	return nil
+}
+
 func get2FA(c echo.Context, job *storage.ReturnJob) error {
 	code := job.TwoFactorCode.Load()
 	if code == "" {
@@ -413,13 +1171,31 @@ func appResolver(handler func(echo.Context, storage.App) error) func(c echo.Cont
 	return func(c echo.Context) error {
 		id := c.Param("id")
 		app, ok := storage.Apps.Get(id)
-		if !ok {
+		if !ok || !canAccessApp(c, app) {
 			return c.NoContent(404)
 		}
+		auditApp(c, app)
 		return handler(c, app)
 	}
 }
 
+func profileResolver(handler func(echo.Context, storage.Profile) error) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		id := c.Param("id")
+		profile, ok := storage.Profiles.GetById(id)
+		if !ok {
+			return c.NoContent(404)
+		}
+		if allowed, err := storage.IsProfileAllowed(profile, getUser(c)); err != nil {
+			return err
+		} else if !allowed {
+			return c.NoContent(404)
+		}
+		getAuditEntry(c).ProfileId = profile.GetId()
+		return handler(c, profile)
+	}
+}
+
 func jobResolver(handler func(echo.Context, *storage.ReturnJob) error) func(c echo.Context) error {
 	return func(c echo.Context) error {
 		id := c.Param("id")
@@ -427,21 +1203,32 @@ func jobResolver(handler func(echo.Context, *storage.ReturnJob) error) func(c ec
 		if !ok {
 			return c.NoContent(404)
 		}
+		auditJob(c, job)
 		return handler(c, job)
 	}
 }
 
 func getLastJob(c echo.Context) error {
-	if err := storage.Jobs.TakeLastJob(c.Response()); errors.Is(err, storage.ErrNotFound) {
+	job, err := storage.Jobs.TakeLastJob(c.Response())
+	if errors.Is(err, storage.ErrNotFound) {
 		return c.NoContent(404)
 	} else if err != nil {
 		return err
 	}
+	auditJob(c, job)
 	return c.NoContent(200)
 }
 
 func render2FAPage(c echo.Context, _ storage.App) error {
-	return c.HTML(200, assets.TwoFactorHtml)
+	t, err := htmlTemplate.New("").Parse(assets.TwoFactorHtml)
+	if err != nil {
+		return err
+	}
+	var result bytes.Buffer
+	if err := t.Execute(&result, assets.TwoFactorData{CsrfToken: getCsrfToken(c)}); err != nil {
+		return err
+	}
+	return c.HTMLBlob(200, result.Bytes())
 }
 
 func set2FA(c echo.Context, app storage.App) error {
@@ -453,6 +1240,49 @@ func set2FA(c echo.Context, app storage.App) error {
 	return c.Redirect(302, "/")
 }
 
+func importProfile(c echo.Context) error {
+	fileHeader, err := c.FormFile("bundle")
+	if err != nil {
+		return c.String(400, "Missing profile bundle file")
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	profile, err := storage.Profiles.Import(file, c.FormValue("password"))
+	if err != nil {
+		return c.String(400, "Failed to import profile: "+err.Error())
+	}
+	getAuditEntry(c).ProfileId = profile.GetId()
+	checkImportedProfile(profile)
+	return c.String(200, profile.GetId())
+}
+
+// Checks a newly imported profile right away, so that a revoked certificate can't be used until the next refresh.
+func checkImportedProfile(profile storage.Profile) {
+	if config.Current.RevocationCheck.Enable {
+		storage.Revocations.RefreshProfile(profile, config.Current.RevocationCheck.ResponderUrl)
+	}
+}
+
+// Bundles hold the signing keys, so they can only be exported with a password, and not at all while
+// authentication is off, since everyone would be an admin.
+func exportProfile(c echo.Context, profile storage.Profile) error {
+	if !isAuthRequired() {
+		return c.String(403, "Profiles can't be exported while authentication is off, create a user first")
+	}
+	var result bytes.Buffer
+	err := storage.ExportProfile(profile, &result, c.FormValue("password"))
+	if errors.Is(err, storage.ErrBundlePasswordRequired) || errors.Is(err, storage.ErrProfileNotExportable) {
+		return c.String(400, "Failed to export profile: "+err.Error())
+	} else if err != nil {
+		return err
+	}
+	c.Response().Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.bundle"`, profile.GetId()))
+	return c.Blob(200, "application/octet-stream", result.Bytes())
+}
+
 func deleteApp(c echo.Context, app storage.App) error {
 	if err := storage.Apps.Delete(app.GetId()); err != nil {
 		return err
@@ -461,7 +1291,11 @@ func deleteApp(c echo.Context, app storage.App) error {
 }
 
 func getManifest(c echo.Context, app storage.App) error {
-	manifestBytes, err := makeManifest(getBaseUrl(c), app)
+	shareToken, err := getInstallShareToken(c, app)
+	if err != nil {
+		return err
+	}
+	manifestBytes, err := makeManifest(getBaseUrl(c), app, shareToken)
 	if err != nil {
 		return err
 	}
@@ -482,7 +1316,7 @@ func getBaseUrl(c echo.Context) string {
 	return serverUrl.String()
 }
 
-func makeManifest(baseUrl string, app storage.App) ([]byte, error) {
+func makeManifest(baseUrl string, app storage.App, shareToken string) ([]byte, error) {
 	t, err := textTemplate.New("").Funcs(
 		textTemplate.FuncMap{"escape": func(text string) (string, error) {
 			return escapeXML(text)
@@ -503,10 +1337,24 @@ func makeManifest(baseUrl string, app storage.App) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	downloadUrl = withShareToken(downloadUrl, shareToken)
+	// only used for display during installation
+	bundleVersion := "2.0"
+	if metadata, err := app.GetMetadata(); err == nil && metadata.Version != "" {
+		bundleVersion = metadata.Version
+	}
+	iconUrl := ""
+	if hasIcon(app) {
+		if iconUrl, err = util.JoinUrls(baseUrl, "/apps", app.GetId(), "icon"); err != nil {
+			return nil, err
+		}
+	}
 	data := assets.ManifestData{
-		DownloadUrl: downloadUrl,
-		BundleId:    bundleId,
-		Title:       appName,
+		DownloadUrl:   downloadUrl,
+		IconUrl:       iconUrl,
+		BundleId:      bundleId,
+		BundleVersion: bundleVersion,
+		Title:         appName,
 	}
 	var result bytes.Buffer
 	if err := t.Execute(&result, data); err != nil {
@@ -529,12 +1377,43 @@ func getSignedApp(c echo.Context, app storage.App) error {
 		return err
 	}
 	defer file.Close()
+	// installers may download in several ranges, only count the first one
+	rangeHeader := c.Request().Header.Get("Range")
+	if link, ok := c.Get(shareContextKey).(storage.ShareLink); ok && c.Request().Method == http.MethodGet &&
+		(rangeHeader == "" || strings.HasPrefix(rangeHeader, "bytes=0-")) {
+		if err := storage.ShareLinks.AddDownload(link); errors.Is(err, storage.ErrShareLinkUsedUp) {
+			return c.String(403, "This link has no downloads left")
+		} else if err != nil {
+			return err
+		}
+	}
 	if err := writeFileResponse(c, file, app); err != nil {
 		return err
 	}
 	return nil
 }
 
+func getIcon(c echo.Context, app storage.App) error {
+	file, err := app.GetFile(storage.AppIcon)
+	if os.IsNotExist(err) {
+		return c.NoContent(404)
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set("Content-Type", "image/png")
+	http.ServeContent(c.Response(), c.Request(), string(storage.AppIcon), stat.ModTime(), file)
+	return nil
+}
+
+func hasIcon(app storage.App) bool {
+	return app.GetInfo().HasIcon
+}
+
 func getEmpty200(c echo.Context) error {
 	return c.NoContent(200)
 }
@@ -587,146 +1466,287 @@ func writeFileResponse(c echo.Context, file io.ReadSeeker, app storage.App) erro
 }
 
 func uploadUnsignedApp(c echo.Context) error {
-	profileId := c.FormValue(formNames.FormProfileId)
-	profile, ok := storage.Profiles.GetById(profileId)
+	if _, err := newSignedApp(c, parseSignForm(c)); err != nil {
+		return stringError(c, err)
+	}
+	return c.Redirect(302, "/")
+}
+
+// The parameters of a new signing request, submitted either as a form or as JSON.
+type signParams struct {
+	// The id of a tus upload or an existing app.
+	FileId          string   `json:"file_id"`
+	FileUrl         string   `json:"file_url"`
+	TweakIds        []string `json:"tweak_ids"`
+	ProfileId       string   `json:"profile_id"`
+	BuilderId       string   `json:"builder_id"`
+	AllDevices      bool     `json:"all_devices"`
+	Mac             bool     `json:"mac"`
+	AppDebug        bool     `json:"app_debug"`
+	FileShare       bool     `json:"file_share"`
+	IdType          string   `json:"id"`
+	IdCustomText    string   `json:"id_custom_text"`
+	IdEncode        bool     `json:"id_encode"`
+	IdForceOriginal bool     `json:"id_force_original"`
+	IdPatch         bool     `json:"id_patch"`
+	BundleName      string   `json:"bundle_name"`
+	// A file uploaded with the request itself, used instead of FileId and FileUrl.
+	file     storage.ReadonlyFile
+	fileName string
+}
+
+func parseSignForm(c echo.Context) *signParams {
+	params := signParams{
+		FileId:          c.FormValue(formNames.FormFileId),
+		FileUrl:         c.FormValue(formNames.FormFileUrl),
+		ProfileId:       c.FormValue(formNames.FormProfileId),
+		BuilderId:       c.FormValue(formNames.FormBuilderId),
+		AllDevices:      c.FormValue(formNames.FormAllDevices) != "",
+		Mac:             c.FormValue(formNames.FormMac) != "",
+		AppDebug:        c.FormValue(formNames.FormAppDebug) != "",
+		FileShare:       c.FormValue(formNames.FormFileShare) != "",
+		IdType:          c.FormValue(formNames.FormId),
+		IdCustomText:    c.FormValue(formNames.FormIdCustomText),
+		IdEncode:        c.FormValue(formNames.FormIdEncode) != "",
+		IdForceOriginal: c.FormValue(formNames.FormIdForceOriginal) != "",
+		IdPatch:         c.FormValue(formNames.FormIdPatch) != "",
+		BundleName:      c.FormValue(formNames.FormBundleName),
+	}
+	if tweakIds := c.FormValue(formNames.FormTweakIds); tweakIds != "" {
+		params.TweakIds = strings.Split(tweakIds, ",")
+	}
+	return &params
+}
+
+// Creates an app from the request and starts signing it. Errors caused by the request are
+// returned as *echo.HTTPError.
+func newSignedApp(c echo.Context, params *signParams) (storage.App, error) {
+	user := getUser(c)
+	profile, ok := storage.Profiles.GetById(params.ProfileId)
 	if !ok {
-		return errors.New("no profile with id " + profileId)
+		return nil, echo.NewHTTPError(400, "No profile with id "+params.ProfileId)
 	}
-	builderId := c.FormValue(formNames.FormBuilderId)
-	builder, ok := config.Current.Builder[builderId]
+	if allowed, err := storage.IsProfileAllowed(profile, user); err != nil {
+		return nil, err
+	} else if !allowed {
+		return nil, echo.NewHTTPError(403, "Not allowed to use profile "+params.ProfileId)
+	}
+	if storage.Revocations.IsRevoked(params.ProfileId) {
+		return nil, echo.NewHTTPError(400, "The certificate of profile "+params.ProfileId+" is revoked")
+	}
+	builder, ok := config.Current.Builder[params.BuilderId]
 	if !ok {
-		return errors.New("no builder with id " + builderId)
+		return nil, echo.NewHTTPError(400, "No builder with id "+params.BuilderId)
 	}
 
-	var file io.ReadCloser
-	var fileName string
-	fileId := c.FormValue(formNames.FormFileId)
-	fileUrl := c.FormValue(formNames.FormFileUrl)
-	if fileUrl != "" {
-		resp, err := http.Get(fileUrl)
-		if err != nil || resp.StatusCode < 200 || resp.StatusCode > 299 {
-			return c.String(400, "Failed to download app from url: "+err.Error())
+	file := params.file
+	fileName := params.fileName
+	if file != nil {
+		// uploaded with the request, owned by the caller
+	} else if params.FileUrl != "" {
+		tempFile, err := downloadToTempFile(params.FileUrl)
+		if err != nil {
+			return nil, echo.NewHTTPError(400, "Failed to download app from url: "+err.Error())
 		}
-		file = resp.Body
+		defer os.Remove(tempFile.Name())
+		file = tempFile
 		defer file.Close()
-		fileName = filepath.Base(fileUrl)
-	} else if app, ok := storage.Apps.Get(fileId); ok {
+		fileName = filepath.Base(params.FileUrl)
+	} else if app, ok := storage.Apps.Get(params.FileId); ok && canAccessApp(c, app) {
 		readonlyFile, err := app.GetFile(storage.AppUnsignedFile)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		file = readonlyFile
 		defer file.Close()
 		fileName, err = app.GetString(storage.AppName)
 		if err != nil {
-			return err
+			return nil, err
 		}
-	} else if upload, ok := storage.Uploads.Get(fileId); ok {
-		defer storage.Uploads.Delete(fileId)
+	} else if upload, ok := storage.Uploads.Get(params.FileId); ok {
+		defer storage.Uploads.Delete(params.FileId)
 		readonlyFile, err := upload.GetData()
 		if err != nil {
-			return err
+			return nil, err
 		}
 		file = readonlyFile
 		defer file.Close()
 		info, err := upload.GetInfo()
 		if err != nil {
-			return err
+			return nil, err
 		}
 		fileName = info.MetaData["filename"]
 	} else {
-		return errors.New("no app upload file with id " + fileId)
+		return nil, echo.NewHTTPError(400, "No app upload file with id "+params.FileId)
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := ipa.Validate(file, fileInfo.Size()); err != nil {
+		return nil, echo.NewHTTPError(400, "Invalid app file: "+err.Error())
+	}
+	if archive, err := ipa.Open(file, fileInfo.Size()); err != nil {
+		return nil, err
+	} else if encrypted, err := archive.EncryptedBinaries(); err != nil {
+		log.Warn().Err(err).Str("file", fileName).Msg("check app encryption")
+	} else if len(encrypted) > 0 {
+		return nil, echo.NewHTTPError(400, "The app is encrypted and will crash after signing, decrypt it first. "+
+			"Encrypted binaries: "+strings.Join(encrypted, ", "))
 	}
 
 	signArgs := ""
-	if c.FormValue(formNames.FormAllDevices) != "" {
+	if params.AllDevices {
 		signArgs += " -a"
 	}
-	if c.FormValue(formNames.FormMac) != "" {
+	if params.Mac {
 		signArgs += " -m"
 	}
-	if c.FormValue(formNames.FormAppDebug) != "" {
+	if params.AppDebug {
 		signArgs += " -d"
 	}
-	if c.FormValue(formNames.FormFileShare) != "" {
+	if params.FileShare {
 		signArgs += " -s"
 	}
-	if c.FormValue(formNames.FormIdEncode) != "" {
+	if params.IdEncode {
 		signArgs += " -e"
 	}
-	if c.FormValue(formNames.FormIdForceOriginal) != "" {
+	if params.IdForceOriginal {
 		signArgs += " -o"
 	}
-	if c.FormValue(formNames.FormIdPatch) != "" {
+	if params.IdPatch {
 		signArgs += " -p"
 	}
-	idType := c.FormValue(formNames.FormId)
-	userBundleId := c.FormValue(formNames.FormIdCustomText)
-	if idType == formNames.FormIdProv {
+	userBundleId := params.IdCustomText
+	if params.IdType == formNames.FormIdProv {
 		signArgs += " -n"
-	} else if idType == formNames.FormIdCustom {
+	} else if params.IdType == formNames.FormIdCustom {
 		signArgs += " -b " + userBundleId
 	}
-	bundleName := c.FormValue(formNames.FormBundleName)
+	bundleName := params.BundleName
 	if bundleName != "" {
 		fileName = fmt.Sprintf("%s (%s)%s",
 			strings.TrimSuffix(fileName, filepath.Ext(fileName)), bundleName, filepath.Ext(fileName))
 	}
 	tweakMap := map[string]io.Reader{}
-	tweakIds := c.FormValue(formNames.FormTweakIds)
-	if tweakIds != "" {
-		for _, tweakId := range strings.Split(tweakIds, ",") {
-			tweak, ok := storage.Uploads.Get(tweakId)
-			if !ok {
-				return errors.New("no tweak upload file with id " + fileId)
-			}
-			defer storage.Uploads.Delete(tweakId)
-			readonlyFile, err := tweak.GetData()
-			if err != nil {
-				return err
-			}
-			defer readonlyFile.Close()
-			info, err := tweak.GetInfo()
-			if err != nil {
-				return err
-			}
-			tweakMap[info.MetaData["filename"]] = readonlyFile
+	for _, tweakId := range params.TweakIds {
+		tweak, ok := storage.Uploads.Get(tweakId)
+		if !ok {
+			return nil, echo.NewHTTPError(400, "No tweak upload file with id "+tweakId)
+		}
+		defer storage.Uploads.Delete(tweakId)
+		readonlyFile, err := tweak.GetData()
+		if err != nil {
+			return nil, err
+		}
+		defer readonlyFile.Close()
+		info, err := tweak.GetInfo()
+		if err != nil {
+			return nil, err
 		}
+		tweakMap[info.MetaData["filename"]] = readonlyFile
 	}
-	app, err := storage.Apps.New(file, fileName, profile, signArgs, userBundleId, builderId, tweakMap)
+	app, err := storage.Apps.New(file, fileName, user, profile, signArgs, userBundleId, params.BuilderId, tweakMap)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	auditApp(c, app)
 	if bundleName != "" {
 		if err := app.SetString(storage.AppBundleName, bundleName); err != nil {
-			return err
+			return nil, err
 		}
 	}
 	if err := startSign(app, builder); err != nil {
-		return err
+		return nil, err
 	}
-	return c.Redirect(302, "/")
+	return app, nil
+}
+
+// Responds with the message of an *echo.HTTPError as plain text, and passes any other error on.
+func stringError(c echo.Context, err error) error {
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		getAuditEntry(c).Error = fmt.Sprint(httpErr.Message)
+		return c.String(httpErr.Code, fmt.Sprint(httpErr.Message))
+	}
+	return err
+}
+
+func downloadToTempFile(url string) (*os.File, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := util.Check2xxCode(resp.StatusCode); err != nil {
+		return nil, err
+	}
+	file, err := copyToTempFile(resp.Body)
+	if err != nil {
+		return nil, errors.WithMessage(err, "download")
+	}
+	return file, nil
+}
+
+// Copies the reader to a new temporary file, which is left open at the start.
+func copyToTempFile(reader io.Reader) (*os.File, error) {
+	file, err := os.CreateTemp("", "upload-*.ipa")
+	if err != nil {
+		return nil, errors.WithMessage(err, "create temp file")
+	}
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
 }
 
 func resignApp(c echo.Context, app storage.App) error {
+	if err := resign(app, getUser(c)); err != nil {
+		return stringError(c, err)
+	}
+	return c.Redirect(302, "/")
+}
+
+// Signs the app again with its original settings. Errors caused by the request are returned as *echo.HTTPError.
+func resign(app storage.App, user string) error {
 	builderId, err := app.GetString(storage.AppBuilderId)
 	if err != nil {
 		return err
 	}
 	builder, ok := config.Current.Builder[builderId]
 	if !ok {
-		return errors.New("no builder with id " + builderId)
+		return echo.NewHTTPError(400, "No builder with id "+builderId)
 	}
-	if err := app.RemoveFile(storage.AppSignedFile); err != nil && !os.IsNotExist(err) {
+	profileId, err := app.GetString(storage.AppProfileId)
+	if err != nil {
 		return err
 	}
-	if err := app.ResetModTime(); err != nil {
+	profile, ok := storage.Profiles.GetById(profileId)
+	if !ok {
+		return echo.NewHTTPError(400, "No profile with id "+profileId)
+	}
+	if allowed, err := storage.IsProfileAllowed(profile, user); err != nil {
 		return err
+	} else if !allowed {
+		return echo.NewHTTPError(403, "Not allowed to use profile "+profileId)
 	}
-	if err := startSign(app, builder); err != nil {
+	if storage.Revocations.IsRevoked(profileId) {
+		return echo.NewHTTPError(400, "The certificate of profile "+profileId+" is revoked")
+	}
+	if err := app.RemoveFile(storage.AppSignedFile); err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	return c.Redirect(302, "/")
+	if err := app.ResetModTime(); err != nil {
+		return err
+	}
+	return startSign(app, builder)
 }
 
 func startSign(app storage.App, builder builders.Builder) error {
@@ -734,6 +1754,9 @@ func startSign(app storage.App, builder builders.Builder) error {
 	if err != nil {
 		return err
 	}
+	if err := app.RemoveFile(storage.AppFailReason); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	storage.Jobs.MakeSignJob(app.GetId(), profileId)
 	if err := setBuilderSecrets(builder); err != nil {
 		return err
@@ -755,115 +1778,541 @@ func logErrApp(err error, app storage.App) *zerolog.Event {
 	return log.Err(err).Str("app_id", app.GetId())
 }
 
-func renderIndex(c echo.Context) error {
+// An app in the app list, with the fields needed for filtering and sorting.
+type appListEntry struct {
+	assets.App
+	modTime time.Time
+}
+
+// Returns the entries of the apps that the request can see.
+func getAppListEntries(c echo.Context) ([]appListEntry, error) {
 	apps, err := storage.Apps.GetAll()
 	if err != nil {
-		return err
-	}
-	data := assets.IndexData{
-		FormNames: formNames,
+		return nil, err
 	}
+	var entries []appListEntry
+	profileNames := map[string]string{}
 	for _, app := range apps {
-		isSigned, err := app.IsSigned()
-		if err != nil {
-			return errors.WithMessage(err, "get is signed")
-		}
-		modTime, err := app.GetModTime()
-		if err != nil {
-			return errors.WithMessage(err, "get mod time")
-		}
-		name, err := app.GetString(storage.AppName)
-		if err != nil {
-			logErrApp(err, app).Msg("get name")
-		}
-		workflowUrl, err := app.GetString(storage.AppWorkflowUrl)
-		if err != nil {
-			logErrApp(err, app).Msg("get workflow url")
-		}
-		bundleId, _ := app.GetString(storage.AppBundleId)
-		profileId, err := app.GetString(storage.AppProfileId)
-		if err != nil {
-			logErrApp(err, app).Msg("get profile id")
+		if !canAccessApp(c, app) {
+			continue
 		}
-		var profileName string
-		if profile, ok := storage.Profiles.GetById(profileId); ok {
+		entries = append(entries, makeAppListEntry(app, profileNames))
+	}
+	return entries, nil
+}
+
+// Makes the list entry of the app. The profile names are cached in profileNames, by profile id.
+func makeAppListEntry(app storage.App, profileNames map[string]string) appListEntry {
+	info := app.GetInfo()
+	profileName, ok := profileNames[info.ProfileId]
+	if !ok {
+		if profile, ok := storage.Profiles.GetById(info.ProfileId); ok {
+			var err error
 			profileName, err = profile.GetString(storage.ProfileName)
 			if err != nil {
 				logErrApp(err, app).Msg("get profile name")
 			}
 		} else {
-			logErrApp(err, app).Msg("get profile")
+			logErrApp(nil, app).Str("profile_id", info.ProfileId).Msg("get profile")
 			profileName = "unknown"
 		}
-		jobPending, jobExists := storage.Jobs.GetStatusByAppId(app.GetId())
-		var status int
-		if isSigned {
-			status = assets.AppStatusSigned
-		} else if jobPending {
-			status = assets.AppStatusWaiting
-		} else if jobExists {
-			status = assets.AppStatusProcessing
-		} else {
-			status = assets.AppStatusFailed
+		profileNames[info.ProfileId] = profileName
+	}
+	jobPending, jobExists := storage.Jobs.GetStatusByAppId(app.GetId())
+	var status int
+	if info.IsSigned {
+		status = assets.AppStatusSigned
+	} else if jobPending {
+		status = assets.AppStatusWaiting
+	} else if jobExists {
+		status = assets.AppStatusProcessing
+	} else {
+		status = assets.AppStatusFailed
+	}
+
+	iconUrl := ""
+	if info.HasIcon {
+		iconUrl = path.Join("/apps", app.GetId(), "icon")
+	}
+
+	return appListEntry{modTime: info.ModTime, App: assets.App{
+		Id:                  app.GetId(),
+		Status:              status,
+		FailReason:          info.FailReason,
+		Name:                info.Name,
+		ModTime:             info.ModTime.Format(time.RFC822),
+		WorkflowUrl:         info.WorkflowUrl,
+		ProfileName:         profileName,
+		BundleId:            info.BundleId,
+		OriginalBundleId:    info.Metadata.BundleId,
+		DisplayName:         info.Metadata.DisplayName,
+		Version:             info.Metadata.Version,
+		BuildNumber:         info.Metadata.BuildNumber,
+		MinimumOSVersion:    info.Metadata.MinimumOSVersion,
+		DeviceFamilies:      strings.Join(info.Metadata.DeviceFamilyNames(), ", "),
+		IconUrl:             iconUrl,
+		InstallUrl:          path.Join("/apps", app.GetId(), "install"),
+		ShareUrl:            path.Join("/apps", app.GetId(), "share"),
+		DownloadSignedUrl:   path.Join("/apps", app.GetId(), "signed"),
+		DownloadUnsignedUrl: path.Join("/apps", app.GetId(), "unsigned"),
+		DownloadTweaksUrl:   path.Join("/apps", app.GetId(), "tweaks"),
+		TwoFactorUrl:        path.Join("/apps", app.GetId(), "2fa"),
+		ResignUrl:           path.Join("/apps", app.GetId(), "resign"),
+		DeleteUrl:           path.Join("/apps", app.GetId(), "delete"),
+		RenameUrl:           path.Join("/apps", app.GetId(), "rename"),
+		EntitlementsUrl:     path.Join("/apps", app.GetId(), "entitlements"),
+		DetailsUrl:          path.Join("/apps", app.GetId(), "details"),
+		Folder:              info.Folder,
+		Tags:                info.Tags,
+		Notes:               info.Notes,
+		Owner:               info.Owner,
+		TweakCount:          info.TweakCount,
+	}}
+}
+
+var appStatusNames = map[int]string{
+	assets.AppStatusProcessing: "processing",
+	assets.AppStatusSigned:     "signed",
+	assets.AppStatusFailed:     "failed",
+	assets.AppStatusWaiting:    "waiting",
+}
+
+const (
+	appSortNewest   = "newest"
+	appSortOldest   = "oldest"
+	appSortName     = "name"
+	appSortNameDesc = "name_desc"
+)
+
+const defaultAppsPerPage = 48
+const maxAppsPerPage = 500
+
+func parseAppListQuery(c echo.Context) assets.AppListQuery {
+	query := assets.AppListQuery{
+		Search:  strings.TrimSpace(c.QueryParam("q")),
+		Status:  c.QueryParam("status"),
+		Folder:  c.QueryParam("folder"),
+		Tag:     c.QueryParam("tag"),
+		Sort:    c.QueryParam("sort"),
+		Page:    1,
+		PerPage: defaultAppsPerPage,
+	}
+	if page, err := strconv.Atoi(c.QueryParam("page")); err == nil && page > 0 {
+		query.Page = page
+	}
+	if perPage, err := strconv.Atoi(c.QueryParam("per_page")); err == nil && perPage > 0 {
+		query.PerPage = min(perPage, maxAppsPerPage)
+	}
+	switch query.Sort {
+	case appSortOldest, appSortName, appSortNameDesc:
+	default:
+		query.Sort = appSortNewest
+	}
+	return query
+}
+
+// Filters, sorts and paginates the entries. Returns the entries on the requested page and the total count
+// of entries that matched. The page is clamped to the last one.
+func queryAppList(entries []appListEntry, query *assets.AppListQuery) ([]appListEntry, int) {
+	search := strings.ToLower(query.Search)
+	var matched []appListEntry
+	for _, entry := range entries {
+		if query.Status != "" && appStatusNames[entry.Status] != query.Status {
+			continue
+		}
+		if query.Folder != "" && entry.Folder != query.Folder {
+			continue
 		}
+		if query.Tag != "" && !slices.ContainsFunc(entry.Tags, func(tag string) bool {
+			return strings.EqualFold(tag, query.Tag)
+		}) {
+			continue
+		}
+		if search != "" {
+			haystack := strings.ToLower(strings.Join(append([]string{entry.Name, entry.DisplayName, entry.BundleId,
+				entry.OriginalBundleId, entry.ProfileName, entry.Folder, entry.Notes}, entry.Tags...), "\n"))
+			if !strings.Contains(haystack, search) {
+				continue
+			}
+		}
+		matched = append(matched, entry)
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		switch query.Sort {
+		case appSortOldest:
+			return matched[i].modTime.Before(matched[j].modTime)
+		case appSortName:
+			return strings.ToLower(matched[i].Name) < strings.ToLower(matched[j].Name)
+		case appSortNameDesc:
+			return strings.ToLower(matched[i].Name) > strings.ToLower(matched[j].Name)
+		default:
+			return matched[i].modTime.After(matched[j].modTime)
+		}
+	})
+	pageCount := max(1, (len(matched)+query.PerPage-1)/query.PerPage)
+	query.Page = min(query.Page, pageCount)
+	start := (query.Page - 1) * query.PerPage
+	end := min(start+query.PerPage, len(matched))
+	return matched[start:end], len(matched)
+}
 
-		tweakCount := 0
-		if tweaks, err := app.ReadDir(storage.TweaksDir); err == nil {
-			tweakCount = len(tweaks)
-		} else if !os.IsNotExist(err) {
-			return err
+func makePagination(query assets.AppListQuery, total int) assets.Pagination {
+	pagination := assets.Pagination{
+		Page:      query.Page,
+		PageCount: max(1, (total+query.PerPage-1)/query.PerPage),
+		Total:     total,
+	}
+	pageUrl := func(page int) string {
+		values := url.Values{}
+		if query.Search != "" {
+			values.Set("q", query.Search)
+		}
+		if query.Status != "" {
+			values.Set("status", query.Status)
+		}
+		if query.Folder != "" {
+			values.Set("folder", query.Folder)
+		}
+		if query.Tag != "" {
+			values.Set("tag", query.Tag)
 		}
+		if query.Sort != appSortNewest {
+			values.Set("sort", query.Sort)
+		}
+		if query.PerPage != defaultAppsPerPage {
+			values.Set("per_page", strconv.Itoa(query.PerPage))
+		}
+		values.Set("page", strconv.Itoa(page))
+		return "/?" + values.Encode()
+	}
+	if pagination.Page > 1 {
+		pagination.PrevUrl = pageUrl(pagination.Page - 1)
+	}
+	if pagination.Page < pagination.PageCount {
+		pagination.NextUrl = pageUrl(pagination.Page + 1)
+	}
+	return pagination
+}
 
-		data.Apps = append(data.Apps, assets.App{
-			Id:                  app.GetId(),
-			Status:              status,
-			Name:                name,
-			ModTime:             modTime.Format(time.RFC822),
-			WorkflowUrl:         workflowUrl,
-			ProfileName:         profileName,
-			BundleId:            bundleId,
-			InstallUrl:          path.Join("/apps", app.GetId(), "install"),
-			DownloadSignedUrl:   path.Join("/apps", app.GetId(), "signed"),
-			DownloadUnsignedUrl: path.Join("/apps", app.GetId(), "unsigned"),
-			DownloadTweaksUrl:   path.Join("/apps", app.GetId(), "tweaks"),
-			TwoFactorUrl:        path.Join("/apps", app.GetId(), "2fa"),
-			ResignUrl:           path.Join("/apps", app.GetId(), "resign"),
-			DeleteUrl:           path.Join("/apps", app.GetId(), "delete"),
-			RenameUrl:           path.Join("/apps", app.GetId(), "rename"),
-			TweakCount:          tweakCount,
-		})
+type appListJson struct {
+	Apps    []appJson `json:"apps"`
+	Page    int       `json:"page"`
+	PerPage int       `json:"per_page"`
+	Total   int       `json:"total"`
+}
+
+type appJson struct {
+	Id               string    `json:"id"`
+	Name             string    `json:"name"`
+	Status           string    `json:"status"`
+	FailReason       string    `json:"fail_reason,omitempty"`
+	Folder           string    `json:"folder"`
+	Tags             []string  `json:"tags"`
+	Notes            string    `json:"notes"`
+	Owner            string    `json:"owner"`
+	ModTime          time.Time `json:"mod_time"`
+	ProfileName      string    `json:"profile_name"`
+	BundleId         string    `json:"bundle_id,omitempty"`
+	OriginalBundleId string    `json:"original_bundle_id,omitempty"`
+	DisplayName      string    `json:"display_name,omitempty"`
+	Version          string    `json:"version,omitempty"`
+	BuildNumber      string    `json:"build_number,omitempty"`
+	TweakCount       int       `json:"tweak_count"`
+}
+
+func getAppList(c echo.Context) error {
+	entries, err := getAppListEntries(c)
+	if err != nil {
+		return err
 	}
-	profiles, err := storage.Profiles.GetAll()
+	query := parseAppListQuery(c)
+	page, total := queryAppList(entries, &query)
+	result := appListJson{Apps: []appJson{}, Page: query.Page, PerPage: query.PerPage, Total: total}
+	for _, entry := range page {
+		result.Apps = append(result.Apps, makeAppJson(entry))
+	}
+	return c.JSON(200, result)
+}
+
+func makeAppJson(entry appListEntry) appJson {
+	return appJson{
+		Id:               entry.Id,
+		Name:             entry.Name,
+		Status:           appStatusNames[entry.Status],
+		FailReason:       entry.FailReason,
+		Folder:           entry.Folder,
+		Tags:             append([]string{}, entry.Tags...),
+		Notes:            entry.Notes,
+		Owner:            entry.Owner,
+		ModTime:          entry.modTime,
+		ProfileName:      entry.ProfileName,
+		BundleId:         entry.BundleId,
+		OriginalBundleId: entry.OriginalBundleId,
+		DisplayName:      entry.DisplayName,
+		Version:          entry.Version,
+		BuildNumber:      entry.BuildNumber,
+		TweakCount:       entry.TweakCount,
+	}
+}
+
+func renderIndex(c echo.Context) error {
+	entries, err := getAppListEntries(c)
 	if err != nil {
 		return err
 	}
+	query := parseAppListQuery(c)
+	page, total := queryAppList(entries, &query)
+	scope, _ := c.Get(scopeContextKey).(storage.Scope)
+	data := assets.IndexData{
+		FormNames:  formNames,
+		Query:      query,
+		Pagination: makePagination(query, total),
+		User:       getUser(c),
+		CanSign:    scope.Allows(storage.ScopeSign),
+		IsAdmin:    isAdmin(c),
+		CsrfToken:  getCsrfToken(c),
+		ShareLinks: config.Current.ShareLinks.Enable,
+	}
+	for _, entry := range page {
+		data.Apps = append(data.Apps, entry.App)
+	}
+	if data.Folders, err = getAppFolders(c); err != nil {
+		return err
+	}
+	if data.Profiles, err = getAllowedProfiles(getUser(c)); err != nil {
+		return err
+	}
+	data.Builders = getBuilders()
+	t, err := htmlTemplate.New("").Parse(assets.IndexHtml)
+	if err != nil {
+		return err
+	}
+	var result bytes.Buffer
+	if err := t.Execute(&result, data); err != nil {
+		return err
+	}
+	return c.HTMLBlob(200, result.Bytes())
+}
+
+// Returns the profiles that the user is allowed to use.
+func getAllowedProfiles(user string) ([]assets.Profile, error) {
+	profiles, err := storage.Profiles.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var result []assets.Profile
 	for _, profile := range profiles {
-		name, err := profile.GetString(storage.ProfileName)
-		if err != nil {
-			return err
+		if allowed, err := storage.IsProfileAllowed(profile, user); err != nil {
+			return nil, err
+		} else if !allowed {
+			continue
 		}
-		isAccount, err := profile.IsAccount()
+		entry, err := makeProfileEntry(profile)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		data.Profiles = append(data.Profiles, assets.Profile{
-			Id:        profile.GetId(),
-			Name:      name,
-			IsAccount: isAccount,
-		})
+		result = append(result, entry)
+	}
+	return result, nil
+}
+
+func makeProfileEntry(profile storage.Profile) (assets.Profile, error) {
+	name, err := profile.GetString(storage.ProfileName)
+	if err != nil {
+		return assets.Profile{}, err
 	}
+	isAccount, err := profile.IsAccount()
+	if err != nil {
+		return assets.Profile{}, err
+	}
+	return assets.Profile{
+		Id:        profile.GetId(),
+		Name:      name,
+		IsAccount: isAccount,
+		IsRevoked: storage.Revocations.IsRevoked(profile.GetId()),
+	}, nil
+}
+
+func getBuilders() []assets.Builder {
+	var result []assets.Builder
 	for builderId := range config.Current.Builder {
-		data.Builders = append(data.Builders, assets.Builder{
+		result = append(result, assets.Builder{
 			Id:   builderId,
 			Name: builderId,
 		})
 	}
-	sort.Slice(data.Builders, func(i, j int) bool {
-		name1 := data.Builders[i].Name
-		name2 := data.Builders[j].Name
+	sort.Slice(result, func(i, j int) bool {
+		name1 := result[i].Name
+		name2 := result[j].Name
 		return name1 < name2
 	})
-	t, err := htmlTemplate.New("").Parse(assets.IndexHtml)
+	return result
+}
+
+func renderTokens(c echo.Context) error {
+	return renderTokensPage(c, storage.Token{}, "")
+}
+
+// Renders the token list. If a token was just created, its secret is shown once.
+func renderTokensPage(c echo.Context, newToken storage.Token, secret string) error {
+	data := assets.TokensData{NewToken: secret, NewTokenName: newToken.Name, CsrfToken: getCsrfToken(c)}
+	for _, scope := range storage.Scopes {
+		data.Scopes = append(data.Scopes, string(scope))
+	}
+	for _, token := range storage.Tokens.GetAll() {
+		data.Tokens = append(data.Tokens, assets.Token{
+			Name:      token.Name,
+			Scope:     string(token.Scope),
+			User:      token.User,
+			Created:   token.Created.Format(time.RFC822),
+			RevokeUrl: path.Join("/tokens", token.Id, "revoke"),
+		})
+	}
+	t, err := htmlTemplate.New("").Parse(assets.TokensHtml)
+	if err != nil {
+		return err
+	}
+	var result bytes.Buffer
+	if err := t.Execute(&result, data); err != nil {
+		return err
+	}
+	return c.HTMLBlob(200, result.Bytes())
+}
+
+func createToken(c echo.Context) error {
+	token, secret, err := newToken(c.FormValue("name"), c.FormValue("scope"), getUser(c))
+	if err != nil {
+		return stringError(c, err)
+	}
+	getAuditEntry(c).Target = token.Id
+	return renderTokensPage(c, token, secret)
+}
+
+// Creates a token acting as the user. Errors caused by the request are returned as *echo.HTTPError.
+func newToken(name string, scopeName string, user string) (storage.Token, string, error) {
+	if strings.TrimSpace(name) == "" {
+		return storage.Token{}, "", echo.NewHTTPError(400, "The token name is empty")
+	}
+	if _, ok := storage.Users.GetByName(user); isAuthRequired() && !ok {
+		return storage.Token{}, "", echo.NewHTTPError(400, "No user named "+user)
+	}
+	scope, err := storage.ParseScope(scopeName)
+	if err != nil {
+		return storage.Token{}, "", echo.NewHTTPError(400, "Invalid token scope: "+err.Error())
+	}
+	token, secret, err := storage.Tokens.New(name, scope, user)
+	if err != nil {
+		return storage.Token{}, "", err
+	}
+	log.Info().Str("id", token.Id).Str("name", token.Name).Str("scope", string(scope)).Str("user", user).Msg("created api token")
+	return token, secret, nil
+}
+
+func revokeToken(c echo.Context) error {
+	getAuditEntry(c).Target = c.Param("id")
+	if ok, err := storage.Tokens.Delete(c.Param("id")); err != nil {
+		return err
+	} else if !ok {
+		return c.NoContent(404)
+	}
+	return c.Redirect(302, "/tokens")
+}
+
+// Only allows redirects to paths of this server after logging in.
+func getLoginNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func renderLogin(c echo.Context) error {
+	return renderLoginPage(c, 200, assets.LoginData{Next: getLoginNext(c.QueryParam("next"))})
+}
+
+func renderLoginPage(c echo.Context, code int, data assets.LoginData) error {
+	data.Oidc = config.Current.OIDC.Enable
+	data.CsrfToken = getCsrfToken(c)
+	t, err := htmlTemplate.New("").Parse(assets.LoginHtml)
+	if err != nil {
+		return err
+	}
+	var result bytes.Buffer
+	if err := t.Execute(&result, data); err != nil {
+		return err
+	}
+	return c.HTMLBlob(code, result.Bytes())
+}
+
+func login(c echo.Context) error {
+	next := getLoginNext(c.FormValue("next"))
+	username := c.FormValue("username")
+	getAuditEntry(c).Actor = username
+	if err := checkAuthLockout(c); err != nil {
+		return renderLoginPage(c, 429, assets.LoginData{Username: username, Next: next, Error: "Too many failed attempts, try again later"})
+	}
+	user, ok := storage.Users.Authenticate(username, c.FormValue("password"))
+	if !ok {
+		addAuthFailure(c)
+		log.Warn().Str("user", username).Str("ip", c.RealIP()).Msg("failed login")
+		return renderLoginPage(c, 401, assets.LoginData{Username: username, Next: next, Error: "Invalid username or password"})
+	}
+	if err := startSession(c, user.Name); err != nil {
+		return err
+	}
+	return c.Redirect(302, next)
+}
+
+// Cookies are marked secure based on the server URL rather than the request, since behind a TLS-terminating
+// proxy every request seems to be plain HTTP.
+func isSecureServerUrl() bool {
+	return strings.HasPrefix(config.Current.ServerUrl, "https")
+}
+
+func startSession(c echo.Context, user string) error {
+	secret, err := storage.Sessions.New(user)
+	if err != nil {
+		return err
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     sessionCookieName,
+		Value:    secret,
+		Path:     "/",
+		MaxAge:   int(storage.SessionLifetime.Seconds()),
+		Secure:   isSecureServerUrl(),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func logout(c echo.Context) error {
+	if cookie, err := c.Cookie(sessionCookieName); err == nil {
+		if user, ok := storage.Sessions.Get(cookie.Value); ok {
+			getAuditEntry(c).Actor = user
+		}
+		storage.Sessions.Delete(cookie.Value)
+	}
+	c.SetCookie(&http.Cookie{Name: sessionCookieName, Path: "/", MaxAge: -1, HttpOnly: true})
+	return c.Redirect(302, "/login")
+}
+
+func renderUsers(c echo.Context) error {
+	data := assets.UsersData{CurrentUser: getUser(c), CsrfToken: getCsrfToken(c)}
+	for _, role := range storage.Roles {
+		data.Roles = append(data.Roles, string(role))
+	}
+	for _, user := range storage.Users.GetAll() {
+		data.Users = append(data.Users, assets.User{
+			Id:        user.Id,
+			Name:      user.Name,
+			Role:      string(user.Role),
+			External:  user.IsExternal(),
+			UpdateUrl: path.Join("/users", user.Id),
+			DeleteUrl: path.Join("/users", user.Id, "delete"),
+		})
+	}
+	t, err := htmlTemplate.New("").Parse(assets.UsersHtml)
 	if err != nil {
 		return err
 	}
@@ -873,3 +2322,407 @@ func renderIndex(c echo.Context) error {
 	}
 	return c.HTMLBlob(200, result.Bytes())
 }
+
+func createUser(c echo.Context) error {
+	getAuditEntry(c).Target = c.FormValue("username")
+	if _, err := newUser(c.FormValue("username"), c.FormValue("password"), c.FormValue("role")); err != nil {
+		return stringError(c, err)
+	}
+	return c.Redirect(302, "/users")
+}
+
+// Creates a user. Errors caused by the request are returned as *echo.HTTPError.
+func newUser(name string, password string, roleName string) (storage.User, error) {
+	role, err := storage.ParseRole(roleName)
+	if err != nil {
+		return storage.User{}, echo.NewHTTPError(400, "Invalid role: "+err.Error())
+	}
+	// otherwise nobody could manage users once logging in is required
+	if !storage.Users.Any() && role != storage.RoleAdmin {
+		return storage.User{}, echo.NewHTTPError(400, "The first user must be an admin")
+	}
+	if err := storage.ValidateUserName(name); err != nil {
+		return storage.User{}, echo.NewHTTPError(400, "Invalid username: "+err.Error())
+	}
+	if password == "" {
+		return storage.User{}, echo.NewHTTPError(400, "The password is empty")
+	}
+	user, err := storage.Users.New(name, password, role)
+	if errors.Is(err, storage.ErrUserExists) {
+		return storage.User{}, echo.NewHTTPError(409, "A user named "+name+" already exists")
+	} else if err != nil {
+		return storage.User{}, err
+	}
+	log.Info().Str("user", name).Str("role", string(role)).Msg("created user")
+	return user, nil
+}
+
+// Whether the user is the only admin, who can't be demoted or deleted.
+func isLastAdmin(user storage.User) bool {
+	if user.Role != storage.RoleAdmin {
+		return false
+	}
+	for _, other := range storage.Users.GetAll() {
+		if other.Role == storage.RoleAdmin && other.Id != user.Id {
+			return false
+		}
+	}
+	return true
+}
+
+func updateUser(c echo.Context) error {
+	user, ok := storage.Users.Get(c.Param("id"))
+	if !ok {
+		return c.NoContent(404)
+	}
+	getAuditEntry(c).Target = user.Name
+	role, err := storage.ParseRole(c.FormValue("role"))
+	if err != nil {
+		return c.String(400, "Invalid role: "+err.Error())
+	}
+	if role != storage.RoleAdmin && isLastAdmin(user) {
+		return c.String(400, "Can't demote the last admin")
+	}
+	if _, err := storage.Users.Update(user.Id, role, c.FormValue("password")); err != nil {
+		return err
+	}
+	log.Info().Str("user", user.Name).Str("role", string(role)).Msg("updated user")
+	return c.Redirect(302, "/users")
+}
+
+func deleteUser(c echo.Context) error {
+	user, ok := storage.Users.Get(c.Param("id"))
+	if !ok {
+		return c.NoContent(404)
+	}
+	getAuditEntry(c).Target = user.Name
+	// Deleting the last user would silently turn authentication off, so that's only allowed from the command line.
+	if isLastAdmin(user) {
+		return c.String(400, "Can't delete the last admin")
+	}
+	if _, err := storage.Users.Delete(user.Id); err != nil {
+		return err
+	}
+	log.Info().Str("user", user.Name).Msg("deleted user")
+	return c.Redirect(302, "/users")
+}
+
+func renderShareApp(c echo.Context, app storage.App) error {
+	return renderShareAppPage(c, app, "", storage.ShareLink{})
+}
+
+// Renders the share form. If a link was just created, it's shown too.
+func renderShareAppPage(c echo.Context, app storage.App, shareUrl string, link storage.ShareLink) error {
+	appName, err := app.GetString(storage.AppName)
+	if err != nil {
+		return err
+	}
+	data := assets.ShareData{
+		AppName:      appName,
+		Enabled:      config.Current.ShareLinks.Enable,
+		ExpiryHours:  config.Current.ShareLinks.DefaultExpiryHours,
+		Url:          shareUrl,
+		MaxDownloads: link.MaxDownloads,
+		CsrfToken:    getCsrfToken(c),
+	}
+	if shareUrl != "" {
+		data.Expires = link.Expires.Local().Format(time.RFC822)
+	}
+	t, err := htmlTemplate.New("").Parse(assets.ShareHtml)
+	if err != nil {
+		return err
+	}
+	var result bytes.Buffer
+	if err := t.Execute(&result, data); err != nil {
+		return err
+	}
+	return c.HTMLBlob(200, result.Bytes())
+}
+
+func shareApp(c echo.Context, app storage.App) error {
+	expiryHours, err := strconv.ParseUint(c.FormValue("expiry_hours"), 10, 64)
+	if err != nil {
+		return c.String(400, "Invalid expiry: "+err.Error())
+	}
+	maxDownloads := 0
+	if value := c.FormValue("max_downloads"); value != "" {
+		if maxDownloads, err = strconv.Atoi(value); err != nil {
+			return c.String(400, "Invalid maximum downloads: "+err.Error())
+		}
+	}
+	link, shareUrl, err := newShareLink(c, app, expiryHours, maxDownloads)
+	if err != nil {
+		return stringError(c, err)
+	}
+	return renderShareAppPage(c, app, shareUrl, link)
+}
+
+// Creates a share link to the install page of the app. If expiryHours is zero, the default is used. Errors caused
+// by the request are returned as *echo.HTTPError.
+func newShareLink(c echo.Context, app storage.App, expiryHours uint64, maxDownloads int) (storage.ShareLink, string, error) {
+	if !config.Current.ShareLinks.Enable {
+		return storage.ShareLink{}, "", echo.NewHTTPError(400, "Share links are disabled in the configuration")
+	}
+	if expiryHours == 0 {
+		expiryHours = config.Current.ShareLinks.DefaultExpiryHours
+	}
+	if maxDownloads < 0 {
+		return storage.ShareLink{}, "", echo.NewHTTPError(400, "The maximum downloads can't be negative")
+	}
+	link, token, err := storage.ShareLinks.New(app.GetId(), time.Duration(expiryHours)*time.Hour, maxDownloads)
+	if err != nil {
+		return storage.ShareLink{}, "", err
+	}
+	installUrl, err := util.JoinUrls(getBaseUrl(c), "/apps", app.GetId(), "install")
+	if err != nil {
+		return storage.ShareLink{}, "", err
+	}
+	getAuditEntry(c).Target = link.Id
+	log.Info().Str("app", app.GetId()).Str("id", link.Id).Time("expires", link.Expires).Msg("created share link")
+	return link, withShareToken(installUrl, token), nil
+}
+
+const auditEntriesPerPage = 100
+
+func getAuditFilter(c echo.Context) storage.AuditFilter {
+	return storage.AuditFilter{
+		Actor:  c.QueryParam("actor"),
+		Action: c.QueryParam("action"),
+		Id:     strings.TrimSpace(c.QueryParam("id")),
+		Result: c.QueryParam("result"),
+	}
+}
+
+// Returns the query string that selects the filter, with the parameters of getAuditFilter.
+func makeAuditQuery(filter storage.AuditFilter) url.Values {
+	values := url.Values{}
+	for key, value := range map[string]string{
+		"actor":  filter.Actor,
+		"action": filter.Action,
+		"id":     filter.Id,
+		"result": filter.Result,
+	} {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	return values
+}
+
+// Renders the audit log, newest first.
+func renderAudit(c echo.Context) error {
+	filter := getAuditFilter(c)
+	all, err := storage.Audit.Query(storage.AuditFilter{})
+	if err != nil {
+		return err
+	}
+	actions := map[string]bool{}
+	actors := map[string]bool{}
+	var matched []storage.AuditEntry
+	for _, entry := range all {
+		actions[entry.Action] = true
+		actors[entry.Actor] = true
+		if filter.Matches(entry) {
+			matched = append(matched, entry)
+		}
+	}
+	slices.Reverse(matched)
+	page, _ := strconv.Atoi(c.QueryParam("page"))
+	pageCount := max(1, (len(matched)+auditEntriesPerPage-1)/auditEntriesPerPage)
+	page = min(max(page, 1), pageCount)
+	pageUrl := func(page int) string {
+		values := makeAuditQuery(filter)
+		values.Set("page", strconv.Itoa(page))
+		return "/audit?" + values.Encode()
+	}
+	data := assets.AuditData{
+		Actions: slices.Sorted(maps.Keys(actions)),
+		Actors:  slices.Sorted(maps.Keys(actors)),
+		Filter: assets.AuditFilter{
+			Actor:  filter.Actor,
+			Action: filter.Action,
+			Id:     filter.Id,
+			Result: filter.Result,
+		},
+		Pagination: assets.Pagination{Page: page, PageCount: pageCount, Total: len(matched)},
+		ExportUrl:  "/audit.jsonl?" + makeAuditQuery(filter).Encode(),
+	}
+	if page > 1 {
+		data.Pagination.PrevUrl = pageUrl(page - 1)
+	}
+	if page < pageCount {
+		data.Pagination.NextUrl = pageUrl(page + 1)
+	}
+	start := (page - 1) * auditEntriesPerPage
+	for _, entry := range matched[start:min(start+auditEntriesPerPage, len(matched))] {
+		data.Entries = append(data.Entries, assets.AuditEntry{
+			Time:      entry.Time.Local().Format(time.RFC822),
+			Actor:     entry.Actor,
+			Action:    entry.Action,
+			AppId:     entry.AppId,
+			ProfileId: entry.ProfileId,
+			JobId:     entry.JobId,
+			Target:    entry.Target,
+			Ip:        entry.Ip,
+			Status:    entry.Status,
+			Failed:    entry.Failed(),
+			Error:     entry.Error,
+		})
+	}
+	t, err := htmlTemplate.New("").Parse(assets.AuditHtml)
+	if err != nil {
+		return err
+	}
+	var result bytes.Buffer
+	if err := t.Execute(&result, data); err != nil {
+		return err
+	}
+	return c.HTMLBlob(200, result.Bytes())
+}
+
+// Returns the matching audit entries as JSON Lines, oldest first.
+func exportAudit(c echo.Context) error {
+	entries, err := storage.Audit.Query(getAuditFilter(c))
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderContentType, "application/jsonl")
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="audit.jsonl"`)
+	c.Response().WriteHeader(200)
+	encoder := json.NewEncoder(c.Response())
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	oidcMutex    sync.Mutex
+	oidcProvider *oidc.Provider
+)
+
+// Returns the OIDC provider. It's discovered on first use, so that the server starts even if the identity
+// provider is unreachable.
+func getOidcProvider() (*oidc.Provider, error) {
+	oidcMutex.Lock()
+	defer oidcMutex.Unlock()
+	if oidcProvider != nil {
+		return oidcProvider, nil
+	}
+	cfg := config.Current.OIDC
+	redirectUrl, err := util.JoinUrls(config.Current.ServerUrl, "/login/oidc/callback")
+	if err != nil {
+		return nil, err
+	}
+	provider, err := oidc.New(cfg.IssuerUrl, cfg.ClientId, cfg.ClientSecret, redirectUrl, cfg.Scopes)
+	if err != nil {
+		return nil, errors.WithMessage(err, "discover oidc provider")
+	}
+	oidcProvider = provider
+	return provider, nil
+}
+
+const oidcStateCookieName = "oidc_state"
+
+func startOidcLogin(c echo.Context) error {
+	if !config.Current.OIDC.Enable {
+		return c.NoContent(404)
+	}
+	provider, err := getOidcProvider()
+	if err != nil {
+		return err
+	}
+	authUrl, state, err := provider.AuthCodeUrl(getLoginNext(c.QueryParam("next")))
+	if err != nil {
+		return err
+	}
+	// binds the login to this browser, otherwise an attacker could make the user log in as the attacker
+	c.SetCookie(&http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     "/login/oidc",
+		MaxAge:   int(oidc.LoginTimeout.Seconds()),
+		Secure:   isSecureServerUrl(),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return c.Redirect(302, authUrl)
+}
+
+func finishOidcLogin(c echo.Context) error {
+	if !config.Current.OIDC.Enable {
+		return c.NoContent(404)
+	}
+	c.SetCookie(&http.Cookie{Name: oidcStateCookieName, Path: "/login/oidc", MaxAge: -1, HttpOnly: true})
+	failLogin := func(code int, message string) error {
+		return renderLoginPage(c, code, assets.LoginData{Next: "/", Error: message})
+	}
+	if errorCode := c.QueryParam("error"); errorCode != "" {
+		return failLogin(401, "The identity provider refused the login: "+errorCode+" "+c.QueryParam("error_description"))
+	}
+	state := c.QueryParam("state")
+	if cookie, err := c.Cookie(oidcStateCookieName); err != nil || cookie.Value != state {
+		return failLogin(400, "The login was started in another browser or has expired, please try again")
+	}
+	provider, err := getOidcProvider()
+	if err != nil {
+		return err
+	}
+	claims, next, err := provider.Exchange(c.Request().Context(), state, c.QueryParam("code"))
+	if err != nil {
+		log.Warn().Err(err).Str("ip", c.RealIP()).Msg("failed oidc login")
+		return failLogin(401, "Failed to log in, please try again")
+	}
+	name, _ := claims[config.Current.OIDC.UsernameClaim].(string)
+	getAuditEntry(c).Actor = name
+	if name == "" {
+		return failLogin(403, "The identity provider didn't return the "+config.Current.OIDC.UsernameClaim+" claim")
+	}
+	role, ok, err := getOidcRole(oidc.GetStrings(claims, config.Current.OIDC.GroupsClaim))
+	if err != nil {
+		return err
+	} else if !ok {
+		log.Warn().Str("user", name).Msg("oidc user has no role")
+		return failLogin(403, "Your account isn't allowed to use SignTools")
+	}
+	user, err := storage.Users.Provision(name, role)
+	if errors.Is(err, storage.ErrUserExists) {
+		return failLogin(409, "A local user named "+name+" already exists, log in with its password instead")
+	} else if err != nil {
+		return err
+	}
+	if err := startSession(c, user.Name); err != nil {
+		return err
+	}
+	log.Info().Str("user", user.Name).Str("role", string(user.Role)).Msg("oidc login")
+	return c.Redirect(302, next)
+}
+
+// Returns the highest role given by the groups of an OIDC user, or the default role if none is.
+func getOidcRole(groups []string) (storage.Role, bool, error) {
+	cfg := config.Current.OIDC
+	for _, mapping := range []struct {
+		groups []string
+		role   storage.Role
+	}{
+		{cfg.AdminGroups, storage.RoleAdmin},
+		{cfg.SignerGroups, storage.RoleSigner},
+		{cfg.ViewerGroups, storage.RoleViewer},
+	} {
+		for _, group := range groups {
+			if slices.Contains(mapping.groups, group) {
+				return mapping.role, true, nil
+			}
+		}
+	}
+	if cfg.DefaultRole == "" {
+		return "", false, nil
+	}
+	role, err := storage.ParseRole(cfg.DefaultRole)
+	if err != nil {
+		return "", false, errors.WithMessage(err, "parse oidc default_role")
+	}
+	return role, true, nil
+}
@@ -1,11 +1,28 @@
 package main
 
 import (
+	"SignTools/src/assets"
 	"SignTools/src/builders"
 	"SignTools/src/config"
+	"SignTools/src/ipa"
+	"SignTools/src/oidc"
 	"SignTools/src/storage"
 	"SignTools/src/util"
 	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"github.com/eventials/go-tus"
@@ -13,16 +30,32 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"github.com/smallstep/pkcs7"
 	"github.com/stretchr/testify/assert"
 	"github.com/ziflex/lecho/v2"
+	"golang.org/x/crypto/ocsp"
+	"hash/crc32"
+	"howett.net/plist"
+	"image/color"
+	"image/png"
 	"io"
 	"io/ioutil"
+	"maps"
+	"math/big"
+	"mime/multipart"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"software.sslmate.com/src/go-pkcs12"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -33,12 +66,14 @@ var (
 	builderKey      = uuid.NewString()
 	saveDir         = ""
 	profileId       = uuid.NewString()
+	envProfileId    = uuid.NewString()
 	profileCert     []byte
 	profileName     = uuid.NewString()
 	profileCertPass = "1234"
-	profileProv     = uuid.NewString()
+	profileProv     []byte
+	profileLeaf     *x509.Certificate
+	profileKey      crypto.PrivateKey
 	unsignedData    = uuid.NewString()
-	signedData      = uuid.NewString()
 )
 
 var listenHost = "localhost"
@@ -67,11 +102,19 @@ func TestMain(m *testing.M) {
 	if err != nil {
 		log.Fatal().Err(err).Send()
 	}
+	profileLeaf, profileKey, err = loadTestIdentity(profileCert, profileCertPass)
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+	profileProv, err = makeTestMobileProvision(profileLeaf, profileKey, "TEST_TEAM_ID.*")
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
 	contentMap := map[string][]byte{
 		"cert.p12":             profileCert,
 		"cert_pass.txt":        []byte(profileCertPass),
 		"name.txt":             []byte(profileName),
-		"prov.mobileprovision": []byte(profileProv),
+		"prov.mobileprovision": profileProv,
 	}
 	for key, val := range contentMap {
 		if err := ioutil.WriteFile(filepath.Join(profileDir, key), val, os.ModePerm); err != nil {
@@ -93,7 +136,13 @@ func TestMain(m *testing.M) {
 			CleanupIntervalMins: 0,
 		},
 		BuilderKey: builderKey,
-		EnvProfile: &config.EnvProfile{},
+		EnvProfiles: []config.EnvProfile{{
+			Id:         envProfileId,
+			Name:       "Env Profile",
+			CertBase64: base64.StdEncoding.EncodeToString(profileCert),
+			CertPass:   profileCertPass,
+			ProvBase64: base64.StdEncoding.EncodeToString(profileProv),
+		}},
 	}
 	storage.Load()
 
@@ -157,25 +206,184 @@ func startWorkflowServer(host string, port uint64) {
 }
 
 func TestIntegration(t *testing.T) {
-	uploadUnsigned(t)
+	unsignedIpa := makeTestIpa(t, testInfo, plist.XMLFormat)
+	resp := uploadUnsigned(t, unsignedIpa)
+	assert.NoError(t, util.Check2xxCode(resp.StatusCode))
 	assert.True(t, triggerHit)
 	assert.True(t, secretsHit)
-	validateFile(t, unsignedData, func(app storage.App) (storage.ReadonlyFile, error) {
+	validateFile(t, string(unsignedIpa), func(app storage.App) (storage.ReadonlyFile, error) {
 		return app.GetFile(storage.AppUnsignedFile)
 	})
 	returnId := takeJob(t)
-	uploadSignedFile(t, returnId)
-	validateFile(t, signedData, func(app storage.App) (storage.ReadonlyFile, error) {
+	signedIpa := makeTestSignedIpa(t, profileLeaf, profileKey, profileProv)
+	resp = uploadSignedFile(t, returnId, signedIpa)
+	assert.NoError(t, util.Check2xxCode(resp.StatusCode))
+	validateFile(t, string(signedIpa), func(app storage.App) (storage.ReadonlyFile, error) {
 		return app.GetFile(storage.AppSignedFile)
 	})
 	validateManifest(t)
+	validateAppList(t)
+	validateApi(t)
+}
+
+func apiRequest(t *testing.T, method string, path string, body any, result any) int {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		assert.NoError(t, err)
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, config.Current.ServerUrl+apiPrefix+path, reader)
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	if result != nil {
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(result))
+	}
+	return resp.StatusCode
+}
+
+func validateApi(t *testing.T) {
+	var list appListJson
+	assert.Equal(t, 200, apiRequest(t, "GET", "/apps", nil, &list))
+	assert.Len(t, list.Apps, 1)
+	appId := list.Apps[0].Id
+
+	var app appJson
+	assert.Equal(t, 200, apiRequest(t, "GET", "/apps/"+appId, nil, &app))
+	assert.Equal(t, "signed", app.Status)
+	newName := uuid.NewString()
+	assert.Equal(t, 200, apiRequest(t, "PATCH", "/apps/"+appId, map[string]any{"name": newName, "tags": []string{"api"}}, &app))
+	assert.Equal(t, newName, app.Name)
+	assert.Equal(t, []string{"api"}, app.Tags)
+	assert.Equal(t, "Team A", app.Folder)
+
+	var apiErr apiErrorJson
+	assert.Equal(t, 404, apiRequest(t, "GET", "/apps/missing", nil, &apiErr))
+	assert.Equal(t, 404, apiErr.Error.Code)
+	assert.Equal(t, 400, apiRequest(t, "PATCH", "/apps/"+appId, map[string]any{"nmae": "typo"}, &apiErr))
+	assert.Equal(t, 400, apiErr.Error.Code)
+	assert.Equal(t, 404, apiRequest(t, "GET", "/missing", nil, &apiErr))
+
+	var profiles []profileJson
+	assert.Equal(t, 200, apiRequest(t, "GET", "/profiles", nil, &profiles))
+	assert.Contains(t, profiles, profileJson{Id: profileId, Name: profileName})
+	var builders []builderJson
+	assert.Equal(t, 200, apiRequest(t, "GET", "/builders", nil, &builders))
+	assert.Equal(t, []builderJson{{Id: "selfhosted"}}, builders)
+
+	// sign a copy of the existing app
+	var copied appJson
+	assert.Equal(t, 201, apiRequest(t, "POST", "/apps", signParams{
+		FileId:    appId,
+		ProfileId: profileId,
+		BuilderId: "selfhosted",
+	}, &copied))
+	assert.Equal(t, "waiting", copied.Status)
+	var jobs []jobJson
+	assert.Equal(t, 200, apiRequest(t, "GET", "/jobs", nil, &jobs))
+	assert.Equal(t, []jobJson{{AppId: copied.Id, Status: "waiting", Created: jobs[0].Created}}, jobs)
+	failTestJob(t, takeJob(t))
+	assert.Equal(t, 400, apiRequest(t, "POST", "/apps", signParams{FileId: appId, ProfileId: "missing"}, &apiErr))
+	assert.Equal(t, "No profile with id missing", apiErr.Error.Message)
+	assert.Equal(t, 204, apiRequest(t, "DELETE", "/apps/"+copied.Id, nil, nil))
+	assert.Equal(t, 404, apiRequest(t, "GET", "/apps/"+copied.Id, nil, nil))
+}
+
+func validateAppList(t *testing.T) {
+	for query, count := range map[string]int{"": 1, "?status=signed": 1, "?status=failed": 0, "?q=com.example": 1, "?q=missing": 0} {
+		resp, err := http.Get(config.Current.ServerUrl + "/apps" + query)
+		assert.NoError(t, err)
+		assert.NoError(t, util.Check2xxCode(resp.StatusCode))
+		var list appListJson
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+		resp.Body.Close()
+		assert.Len(t, list.Apps, count, query)
+		assert.Equal(t, count, list.Total, query)
+	}
+	resp, err := http.Get(config.Current.ServerUrl + "/?status=signed&sort=name")
+	assert.NoError(t, err)
+	assert.NoError(t, util.Check2xxCode(resp.StatusCode))
+
+	// the in-memory info must follow writes
+	apps, err := storage.Apps.GetAll()
+	assert.NoError(t, err)
+	assert.True(t, apps[0].GetInfo().IsSigned)
+	assert.Equal(t, "com.example.test", apps[0].GetInfo().Metadata.BundleId)
+	newName := uuid.NewString()
+	assert.NoError(t, apps[0].SetString(storage.AppName, newName))
+	assert.Equal(t, newName, apps[0].GetInfo().Name)
+
+	form := url.Values{"folder": {" Team A "}, "tags": {"beta, ios17\nbeta"}, "notes": {"Some notes"}}
+	client := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err = client.PostForm(config.Current.ServerUrl+"/apps/"+apps[0].GetId()+"/details", form)
+	assert.NoError(t, err)
+	assert.Equal(t, 302, resp.StatusCode)
+	info := apps[0].GetInfo()
+	assert.Equal(t, "Team A", info.Folder)
+	assert.Equal(t, []string{"beta", "ios17"}, info.Tags)
+	assert.Equal(t, "Some notes", info.Notes)
+	for query, count := range map[string]int{"?tag=BETA": 1, "?tag=alpha": 0, "?folder=Team+A": 1, "?folder=Team": 0, "?q=some+notes": 1} {
+		resp, err := http.Get(config.Current.ServerUrl + "/apps" + query)
+		assert.NoError(t, err)
+		var list appListJson
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+		resp.Body.Close()
+		assert.Len(t, list.Apps, count, query)
+	}
+	for _, page := range []string{"/apps/" + apps[0].GetId() + "/details", "/?folder=Team+A"} {
+		resp, err := http.Get(config.Current.ServerUrl + page)
+		assert.NoError(t, err)
+		assert.NoError(t, util.Check2xxCode(resp.StatusCode))
+	}
+}
+
+func TestQueryAppList(t *testing.T) {
+	now := time.Now()
+	var entries []appListEntry
+	for i, name := range []string{"b", "a", "c", "d", "e"} {
+		entries = append(entries, appListEntry{
+			App:     assets.App{Name: name, Status: i % 2, ProfileName: "profile " + name},
+			modTime: now.Add(time.Duration(i) * time.Minute),
+		})
+	}
+	names := func(entries []appListEntry) []string {
+		var result []string
+		for _, entry := range entries {
+			result = append(result, entry.Name)
+		}
+		return result
+	}
+	query := assets.AppListQuery{Sort: appSortNewest, Page: 1, PerPage: 2}
+	page, total := queryAppList(entries, &query)
+	assert.Equal(t, 5, total)
+	assert.Equal(t, []string{"e", "d"}, names(page))
+	query = assets.AppListQuery{Sort: appSortName, Page: 10, PerPage: 2}
+	page, _ = queryAppList(entries, &query)
+	assert.Equal(t, 3, query.Page)
+	assert.Equal(t, []string{"e"}, names(page))
+	query = assets.AppListQuery{Sort: appSortOldest, Status: "signed", Page: 1, PerPage: 10}
+	page, _ = queryAppList(entries, &query)
+	assert.Equal(t, []string{"a", "d"}, names(page))
+	query = assets.AppListQuery{Sort: appSortNameDesc, Search: "PROFILE C", Page: 1, PerPage: 10}
+	page, _ = queryAppList(entries, &query)
+	assert.Equal(t, []string{"c"}, names(page))
+	pagination := makePagination(assets.AppListQuery{Search: "x", Sort: appSortNewest, Page: 2, PerPage: 2}, 5)
+	assert.Equal(t, "/?page=1&per_page=2&q=x", pagination.PrevUrl)
+	assert.Equal(t, "/?page=3&per_page=2&q=x", pagination.NextUrl)
+	pagination = makePagination(assets.AppListQuery{Sort: appSortName, Page: 1, PerPage: defaultAppsPerPage}, 5)
+	assert.Equal(t, 1, pagination.PageCount)
+	assert.Empty(t, pagination.PrevUrl)
+	assert.Empty(t, pagination.NextUrl)
 }
 
 func validateManifest(t *testing.T) {
 	apps, err := storage.Apps.GetAll()
 	assert.NoError(t, err)
 	assert.Len(t, apps, 1)
-	manifestBytes, err := makeManifest(serveAddress, apps[0])
+	manifestBytes, err := makeManifest(serveAddress, apps[0], "")
 	assert.NoError(t, err)
 	assert.NoError(t, validateXML(string(manifestBytes)))
 }
@@ -208,10 +416,12 @@ func tusUpload(t *testing.T, data []byte) string {
 	return path.Base(tusUpload.Url())
 }
 
-func uploadSignedFile(t *testing.T, returnId string) {
-	fileId := tusUpload(t, []byte(signedData))
+func uploadSignedFile(t *testing.T, returnId string, data []byte) *http.Response {
+	fileId := tusUpload(t, data)
 	form := url.Values{
-		"file_id": {fileId}}
+		"file_id":   {fileId},
+		"bundle_id": {testInfo["CFBundleIdentifier"].(string)},
+	}
 	req, err := http.NewRequest("POST",
 		fmt.Sprintf("%s/jobs/%s/signed", config.Current.ServerUrl, returnId), strings.NewReader(form.Encode()))
 	assert.NoError(t, err)
@@ -219,7 +429,7 @@ func uploadSignedFile(t *testing.T, returnId string) {
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	resp, err := http.DefaultClient.Do(req)
 	assert.NoError(t, err)
-	assert.NoError(t, util.Check2xxCode(resp.StatusCode))
+	return resp
 }
 
 func takeJob(t *testing.T) string {
@@ -263,8 +473,116 @@ func TestAuthenticationWrong(t *testing.T) {
 	assert.Equal(t, resp.StatusCode, 401)
 }
 
-func uploadUnsigned(t *testing.T) {
-	fileId := tusUpload(t, []byte(unsignedData))
+func TestProfileBundle(t *testing.T) {
+	post := func(path string, form map[string]string, bundle []byte) (int, []byte) {
+		var body bytes.Buffer
+		w := multipart.NewWriter(&body)
+		for key, value := range form {
+			assert.NoError(t, w.WriteField(key, value))
+		}
+		if bundle != nil {
+			part, err := w.CreateFormFile("bundle", "profile.bundle")
+			assert.NoError(t, err)
+			_, err = part.Write(bundle)
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, w.Close())
+		req, err := http.NewRequest("POST", config.Current.ServerUrl+path, &body)
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		req.SetBasicAuth("admin", "admin-pass")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp.StatusCode, data
+	}
+	exportPath := "/profiles/" + profileId + "/export"
+
+	// without users, everyone is an admin and could take the signing keys
+	code, _ := post(exportPath, map[string]string{"password": "bundle-pass"}, nil)
+	assert.Equal(t, 403, code)
+	_, err := newUser("admin", "admin-pass", "admin")
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		for _, user := range storage.Users.GetAll() {
+			storage.Users.Delete(user.Id)
+		}
+	})
+	code, _ = post(exportPath, nil, nil)
+	assert.Equal(t, 400, code)
+	code, body := post("/profiles/"+envProfileId+"/export", map[string]string{"password": "bundle-pass"}, nil)
+	assert.Equal(t, 400, code)
+	assert.Contains(t, string(body), "environment variables")
+
+	code, bundle := post(exportPath, map[string]string{"password": "bundle-pass"}, nil)
+	assert.Equal(t, 200, code)
+	assert.True(t, bytes.HasPrefix(bundle, []byte("STBUNDL1")))
+	assert.NotContains(t, string(bundle), profileName)
+
+	code, body = post("/profiles", nil, bundle)
+	assert.Equal(t, 400, code)
+	assert.Contains(t, string(body), "password protected")
+	code, body = post("/profiles", map[string]string{"password": "wrong"}, bundle)
+	assert.Equal(t, 400, code)
+	assert.Contains(t, string(body), "wrong password")
+	code, _ = post("/profiles", map[string]string{"password": "bundle-pass"}, bundle[:len(bundle)/2])
+	assert.Equal(t, 400, code)
+	// a plain archive behind the header of an encrypted bundle
+	plainBundle := append([]byte("STBUNDL1"), make([]byte, 16)...)
+	plainBundle = append(plainBundle, makeTestTar(t, map[string][]byte{
+		string(storage.ProfileName):     []byte(profileName),
+		string(storage.ProfileCert):     profileCert,
+		string(storage.ProfileCertPass): []byte(profileCertPass),
+		string(storage.ProfileProv):     profileProv,
+	})...)
+	code, body = post("/profiles", map[string]string{"password": "anything"}, plainBundle)
+	assert.Equal(t, 400, code)
+	assert.Contains(t, string(body), "not encrypted")
+	code, body = post("/profiles", map[string]string{"password": "bundle-pass"}, bundle)
+	assert.Equal(t, 200, code)
+	imported, ok := storage.Profiles.GetById(string(body))
+	assert.True(t, ok)
+	name, err := imported.GetString(storage.ProfileName)
+	assert.NoError(t, err)
+	assert.Equal(t, profileName, name)
+	pass, err := imported.GetString(storage.ProfileCertPass)
+	assert.NoError(t, err)
+	assert.Equal(t, profileCertPass, pass)
+
+	// malformed bundles
+	code, _ = post("/profiles", nil, []byte("not a bundle"))
+	assert.Equal(t, 400, code)
+	code, body = post("/profiles", nil, makeTestTar(t, map[string][]byte{"../escape.txt": []byte("x")}))
+	assert.Equal(t, 400, code)
+	assert.Contains(t, string(body), "unknown file")
+	code, body = post("/profiles", nil, makeTestTar(t, map[string][]byte{string(storage.ProfileName): []byte("x")}))
+	assert.Equal(t, 400, code)
+	assert.Contains(t, string(body), "missing")
+	code, _ = post("/profiles", nil, makeTestTar(t, map[string][]byte{
+		string(storage.ProfileName):     []byte("x"),
+		string(storage.ProfileCert):     []byte("not a p12"),
+		string(storage.ProfileCertPass): []byte("x"),
+		string(storage.ProfileProv):     profileProv,
+	}))
+	assert.Equal(t, 400, code)
+}
+
+func makeTestTar(t *testing.T, files map[string][]byte) []byte {
+	var buffer bytes.Buffer
+	w := tar.NewWriter(&buffer)
+	for name, data := range files {
+		assert.NoError(t, w.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data))}))
+		_, err := w.Write(data)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.Close())
+	return buffer.Bytes()
+}
+
+func uploadUnsigned(t *testing.T, data []byte) *http.Response {
+	fileId := tusUpload(t, data)
 	form := url.Values{
 		formNames.FormFileId:     {fileId},
 		formNames.FormProfileId:  {profileId},
@@ -278,15 +596,1093 @@ func uploadUnsigned(t *testing.T) {
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	resp, err := http.DefaultClient.Do(req)
 	assert.NoError(t, err)
+	return resp
+}
+
+func TestUploadInvalid(t *testing.T) {
+	resp := uploadUnsigned(t, []byte(unsignedData))
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestUnsignedBlobDedup(t *testing.T) {
+	profile, ok := storage.Profiles.GetById(profileId)
+	assert.True(t, ok)
+	// must not share a blob with the other tests' apps
+	info := map[string]any{"CFBundleDisplayName": uuid.NewString()}
+	for key, val := range testInfo {
+		info[key] = val
+	}
+	data := makeTestIpa(t, info, plist.XMLFormat)
+	var apps []storage.App
+	for i := 0; i < 2; i++ {
+		app, err := storage.Apps.New(bytes.NewReader(data), "dedup", "", profile, "", "", "selfhosted", nil)
+		assert.NoError(t, err)
+		apps = append(apps, app)
+	}
+	hash, err := apps[0].GetString(storage.AppUnsignedHash)
+	assert.NoError(t, err)
+	otherHash, err := apps[1].GetString(storage.AppUnsignedHash)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, otherHash)
+	assert.Equal(t, 2, storage.Blobs.GetRefs(hash))
+
+	assert.NoError(t, storage.Apps.Delete(apps[0].GetId()))
+	assert.Equal(t, 1, storage.Blobs.GetRefs(hash))
+	file, err := apps[1].GetFile(storage.AppUnsignedFile)
+	assert.NoError(t, err)
+	fileData, err := io.ReadAll(file)
+	assert.NoError(t, err)
+	file.Close()
+	assert.Equal(t, data, fileData)
+
+	assert.NoError(t, storage.Apps.Delete(apps[1].GetId()))
+	assert.Equal(t, 0, storage.Blobs.GetRefs(hash))
+	_, err = os.Stat(filepath.Join(saveDir, "blobs", hash))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// The OpenAPI document must describe exactly the JSON API, tus and builder routes registered by newServer,
+// and its schemas must match the JSON types.
+func TestOpenApi(t *testing.T) {
+	var doc struct {
+		OpenApi    string                                `json:"openapi"`
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]json.RawMessage `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	assert.NoError(t, json.Unmarshal(assets.OpenApiJson, &doc))
+	assert.True(t, strings.HasPrefix(doc.OpenApi, "3."))
+
+	var documented []string
+	for docPath, item := range doc.Paths {
+		for method := range item {
+			if method != "parameters" {
+				documented = append(documented, strings.ToUpper(method)+" "+docPath)
+			}
+		}
+	}
+	e, err := newServer()
+	assert.NoError(t, err)
+	paramRegex := regexp.MustCompile(`:(\w+)`)
+	var registered []string
+	for _, route := range e.Routes() {
+		if route.Method == echo.RouteNotFound {
+			continue
+		}
+		for _, prefix := range []string{apiPrefix + "/", "/jobs", "/tus/", "/files/"} {
+			if strings.HasPrefix(route.Path, prefix) {
+				registered = append(registered, route.Method+" "+paramRegex.ReplaceAllString(route.Path, "{$1}"))
+				break
+			}
+		}
+	}
+	assert.ElementsMatch(t, registered, documented)
+
+	for _, ref := range regexp.MustCompile(`"\$ref": "#/components/schemas/(\w+)"`).FindAllSubmatch(assets.OpenApiJson, -1) {
+		assert.Contains(t, doc.Components.Schemas, string(ref[1]))
+	}
+	for name, value := range map[string]any{
+		"App":           appJson{},
+		"AppList":       appListJson{},
+		"AppUpdate":     appUpdateJson{},
+		"SignRequest":   signParams{},
+		"TwoFactorCode": twoFactorJson{},
+		"ShareCreate":   shareCreateJson{},
+		"Share":         shareJson{},
+		"Profile":       profileJson{},
+		"Builder":       builderJson{},
+		"Job":           jobJson{},
+		"Token":         tokenJson{},
+		"TokenCreate":   tokenCreateJson{},
+	} {
+		var fields []string
+		valueType := reflect.TypeOf(value)
+		for i := 0; i < valueType.NumField(); i++ {
+			if tag := valueType.Field(i).Tag.Get("json"); tag != "" {
+				fields = append(fields, strings.Split(tag, ",")[0])
+			}
+		}
+		var properties []string
+		for property := range doc.Components.Schemas[name].Properties {
+			properties = append(properties, property)
+		}
+		assert.ElementsMatch(t, fields, properties, name)
+	}
+
+	resp, err := http.Get(config.Current.ServerUrl + apiPrefix + "/openapi.json")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, assets.OpenApiJson, body)
+}
+
+func failTestJob(t *testing.T, returnId string) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/jobs/%s/fail", config.Current.ServerUrl, returnId), nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+builderKey)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
 	assert.NoError(t, util.Check2xxCode(resp.StatusCode))
 }
 
+func TestCli(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	dir := t.TempDir()
+	info := map[string]any{"CFBundleDisplayName": uuid.NewString()}
+	for key, val := range testInfo {
+		info[key] = val
+	}
+	unsignedFile := filepath.Join(dir, "Cli.ipa")
+	assert.NoError(t, os.WriteFile(unsignedFile, makeTestIpa(t, info, plist.XMLFormat), 0600))
+	signedIpa := makeTestSignedIpa(t, profileLeaf, profileKey, profileProv)
+	serverArgs := []string{"-server", config.Current.ServerUrl}
+
+	var out bytes.Buffer
+	assert.NoError(t, runSignCommand(append(serverArgs, "-profile", profileName, "-debug", "-wait=false", unsignedFile), &out))
+	appId := strings.TrimSpace(out.String())
+	app, ok := storage.Apps.Get(appId)
+	assert.True(t, ok)
+	signArgs, err := app.GetString(storage.AppSignArgs)
+	assert.NoError(t, err)
+	assert.Equal(t, "-d", signArgs)
+	assert.NoError(t, util.Check2xxCode(uploadSignedFile(t, takeJob(t), signedIpa).StatusCode))
+
+	out.Reset()
+	assert.NoError(t, runListCommand(append(serverArgs, "-q", info["CFBundleDisplayName"].(string)), &out))
+	assert.Contains(t, out.String(), appId+"  signed  Cli.ipa")
+	out.Reset()
+	assert.NoError(t, runListCommand(append(serverArgs, "-q", info["CFBundleDisplayName"].(string), "-status", "failed"), &out))
+	assert.NotContains(t, out.String(), appId)
+	out.Reset()
+	assert.NoError(t, runProfilesCommand(serverArgs, &out))
+	assert.Contains(t, out.String(), profileId)
+
+	signedFile := filepath.Join(dir, "signed.ipa")
+	assert.NoError(t, runDownloadCommand(append(serverArgs, "-out", signedFile, appId), io.Discard))
+	data, err := os.ReadFile(signedFile)
+	assert.NoError(t, err)
+	assert.Equal(t, signedIpa, data)
+
+	// wait for the builder while resigning
+	done := make(chan error)
+	go func() {
+		done <- runResignCommand(append(serverArgs, "-poll-interval", "10ms", "-out", signedFile, appId), io.Discard)
+	}()
+	for {
+		var jobs []jobJson
+		assert.Equal(t, 200, apiRequest(t, "GET", "/jobs", nil, &jobs))
+		if len(jobs) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, os.Remove(signedFile))
+	assert.NoError(t, util.Check2xxCode(uploadSignedFile(t, takeJob(t), signedIpa).StatusCode))
+	assert.NoError(t, <-done)
+	data, err = os.ReadFile(signedFile)
+	assert.NoError(t, err)
+	assert.Equal(t, signedIpa, data)
+
+	assert.NoError(t, runDeleteCommand(append(serverArgs, appId), io.Discard))
+	_, ok = storage.Apps.Get(appId)
+	assert.False(t, ok)
+	assert.ErrorContains(t, runDeleteCommand(append(serverArgs, appId), io.Discard), "No app with id "+appId)
+}
+
+func tokenRequest(t *testing.T, secret string, method string, path string) int {
+	req, err := http.NewRequest(method, config.Current.ServerUrl+path, nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	client := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestApiTokens(t *testing.T) {
+	var admin tokenJson
+	assert.Equal(t, 201, apiRequest(t, "POST", "/tokens", tokenCreateJson{Name: "admin", Scope: "admin"}, &admin))
+	assert.True(t, strings.HasPrefix(admin.Token, "st_"))
+	assert.Equal(t, 400, apiRequest(t, "POST", "/tokens", tokenCreateJson{Name: "bad", Scope: "root"}, nil))
+	assert.Equal(t, 400, apiRequest(t, "POST", "/tokens", tokenCreateJson{Name: " ", Scope: "read"}, nil))
+	read, readSecret, err := newToken("read", "read", "")
+	assert.NoError(t, err)
+
+	assert.Equal(t, 200, tokenRequest(t, readSecret, "GET", apiPrefix+"/apps"))
+	assert.Equal(t, 200, tokenRequest(t, readSecret, "GET", "/"))
+	assert.Equal(t, 403, tokenRequest(t, readSecret, "POST", apiPrefix+"/apps"))
+	assert.Equal(t, 403, tokenRequest(t, readSecret, "DELETE", apiPrefix+"/apps/missing"))
+	assert.Equal(t, 403, tokenRequest(t, readSecret, "GET", apiPrefix+"/tokens"))
+	assert.Equal(t, 403, tokenRequest(t, readSecret, "GET", "/tokens"))
+	assert.Equal(t, 401, tokenRequest(t, readSecret+"x", "GET", apiPrefix+"/apps"))
+	assert.Equal(t, 404, tokenRequest(t, admin.Token, "DELETE", apiPrefix+"/apps/missing"))
+	assert.Equal(t, 200, tokenRequest(t, admin.Token, "GET", "/tokens"))
+
+	var out bytes.Buffer
+	assert.NoError(t, runProfilesCommand([]string{"-server", config.Current.ServerUrl, "-token", readSecret}, &out))
+	assert.Contains(t, out.String(), profileId)
+
+	var tokens []tokenJson
+	assert.Equal(t, 200, apiRequest(t, "GET", "/tokens", nil, &tokens))
+	var ids []string
+	for _, token := range tokens {
+		assert.Empty(t, token.Token)
+		ids = append(ids, token.Id)
+	}
+	assert.Subset(t, ids, []string{admin.Id, read.Id})
+
+	assert.Equal(t, 204, tokenRequest(t, admin.Token, "DELETE", apiPrefix+"/tokens/"+read.Id))
+	assert.Equal(t, 401, tokenRequest(t, readSecret, "GET", apiPrefix+"/apps"))
+	assert.Equal(t, 404, tokenRequest(t, admin.Token, "DELETE", apiPrefix+"/tokens/"+read.Id))
+	assert.Equal(t, 302, tokenRequest(t, admin.Token, "POST", "/tokens/"+admin.Id+"/revoke"))
+	assert.Equal(t, 401, tokenRequest(t, admin.Token, "GET", apiPrefix+"/apps"))
+}
+
+// Sends a request without following redirects, authenticated by the given function.
+func userRequest(t *testing.T, method string, path string, form url.Values, auth func(*http.Request)) *http.Response {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, config.Current.ServerUrl+path, body)
+	assert.NoError(t, err)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if auth != nil {
+		auth(req)
+	}
+	client := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	return resp
+}
+
+func basicAuth(username string, password string) func(*http.Request) {
+	return func(req *http.Request) {
+		req.SetBasicAuth(username, password)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	t.Cleanup(func() {
+		for _, user := range storage.Users.GetAll() {
+			_, err := storage.Users.Delete(user.Id)
+			assert.NoError(t, err)
+		}
+	})
+	assert.NoError(t, storage.Users.MigrateBasicAuth(config.BasicAuth{
+		Enable:   true,
+		Username: "admin",
+		Password: "admin-pass",
+		Users:    map[string]string{"alice": "alice-pass"},
+	}))
+	admin, ok := storage.Users.GetByName("admin")
+	assert.True(t, ok)
+	assert.Equal(t, storage.RoleAdmin, admin.Role)
+	alice, ok := storage.Users.GetByName("alice")
+	assert.True(t, ok)
+	assert.Equal(t, storage.RoleSigner, alice.Role)
+	_, err := newUser("bob", "bob-pass", "viewer")
+	assert.NoError(t, err)
+	_, err = newUser("bob", "other-pass", "viewer")
+	assert.Equal(t, 409, err.(*echo.HTTPError).Code)
+
+	profile, ok := storage.Profiles.GetById(profileId)
+	assert.True(t, ok)
+	data := makeTestIpa(t, testInfo, plist.XMLFormat)
+	adminApp, err := storage.Apps.New(bytes.NewReader(data), "admin.ipa", "admin", profile, "", "", "selfhosted", nil)
+	assert.NoError(t, err)
+	defer storage.Apps.Delete(adminApp.GetId())
+	aliceApp, err := storage.Apps.New(bytes.NewReader(data), "alice.ipa", "alice", profile, "", "", "selfhosted", nil)
+	assert.NoError(t, err)
+	defer storage.Apps.Delete(aliceApp.GetId())
+
+	resp := userRequest(t, "GET", "/", nil, nil)
+	assert.Equal(t, 302, resp.StatusCode)
+	assert.Equal(t, "/login?next=%2F", resp.Header.Get("Location"))
+	assert.Equal(t, 401, userRequest(t, "GET", apiPrefix+"/apps", nil, nil).StatusCode)
+	assert.Equal(t, 401, userRequest(t, "GET", apiPrefix+"/apps", nil, basicAuth("alice", "wrong")).StatusCode)
+
+	// signers only see their own apps
+	getAppIds := func(auth func(*http.Request)) []string {
+		req, err := http.NewRequest("GET", config.Current.ServerUrl+apiPrefix+"/apps", nil)
+		assert.NoError(t, err)
+		auth(req)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		var list appListJson
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+		var ids []string
+		for _, app := range list.Apps {
+			ids = append(ids, app.Id)
+		}
+		return ids
+	}
+	assert.Equal(t, []string{aliceApp.GetId()}, getAppIds(basicAuth("alice", "alice-pass")))
+	assert.Subset(t, getAppIds(basicAuth("admin", "admin-pass")), []string{aliceApp.GetId(), adminApp.GetId()})
+	assert.Empty(t, getAppIds(basicAuth("bob", "bob-pass")))
+	assert.Equal(t, 404, userRequest(t, "GET", apiPrefix+"/apps/"+adminApp.GetId(), nil, basicAuth("alice", "alice-pass")).StatusCode)
+	assert.Equal(t, 403, userRequest(t, "DELETE", apiPrefix+"/apps/"+aliceApp.GetId(), nil, basicAuth("alice", "alice-pass")).StatusCode)
+	assert.Equal(t, 403, userRequest(t, "POST", apiPrefix+"/apps/"+aliceApp.GetId()+"/resign", nil, basicAuth("bob", "bob-pass")).StatusCode)
+	assert.Equal(t, 403, userRequest(t, "GET", "/users", nil, basicAuth("alice", "alice-pass")).StatusCode)
+
+	// tokens are limited to the role of their user
+	aliceToken, secret, err := newToken("alice", "admin", "alice")
+	assert.NoError(t, err)
+	bearer := func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+	assert.Equal(t, []string{aliceApp.GetId()}, getAppIds(bearer))
+	assert.Equal(t, 403, userRequest(t, "DELETE", apiPrefix+"/apps/"+aliceApp.GetId(), nil, bearer).StatusCode)
+	_, _, err = newToken("nobody", "read", "nobody")
+	assert.Error(t, err)
+
+	resp = userRequest(t, "POST", "/login", url.Values{"username": {"alice"}, "password": {"wrong"}}, nil)
+	assert.Equal(t, 401, resp.StatusCode)
+	resp = userRequest(t, "POST", "/login", url.Values{"username": {"alice"}, "password": {"alice-pass"}, "next": {"//evil.com"}}, nil)
+	assert.Equal(t, 302, resp.StatusCode)
+	assert.Equal(t, "/", resp.Header.Get("Location"))
+	var session *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == sessionCookieName {
+			session = cookie
+		}
+	}
+	assert.NotNil(t, session)
+	withSession := func(req *http.Request) {
+		req.AddCookie(session)
+	}
+	resp = userRequest(t, "GET", "/", nil, withSession)
+	assert.Equal(t, 200, resp.StatusCode)
+	var csrf *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == csrfFormName {
+			csrf = cookie
+		}
+	}
+	assert.NotNil(t, csrf)
+	assert.Equal(t, 200, userRequest(t, "GET", "/apps/"+aliceApp.GetId()+"/rename", nil, withSession).StatusCode)
+	assert.Equal(t, 404, userRequest(t, "GET", "/apps/"+adminApp.GetId()+"/rename", nil, withSession).StatusCode)
+	assert.Equal(t, 405, userRequest(t, "GET", "/apps/"+aliceApp.GetId()+"/resign", nil, withSession).StatusCode)
+	crossSite := func(req *http.Request) {
+		withSession(req)
+		req.Header.Set("Sec-Fetch-Site", "cross-site")
+	}
+	assert.Equal(t, 403, userRequest(t, "POST", "/apps/"+aliceApp.GetId()+"/rename", url.Values{"name": {"evil"}}, crossSite).StatusCode)
+	assert.Equal(t, 400, userRequest(t, "POST", "/logout", nil, withSession).StatusCode)
+	withCsrf := func(req *http.Request) {
+		withSession(req)
+		req.AddCookie(csrf)
+	}
+	assert.Equal(t, 403, userRequest(t, "POST", "/logout", url.Values{csrfFormName: {"wrong"}}, withCsrf).StatusCode)
+	assert.Equal(t, 302, userRequest(t, "POST", "/logout", url.Values{csrfFormName: {csrf.Value}}, withCsrf).StatusCode)
+	assert.Equal(t, 302, userRequest(t, "GET", "/", nil, withSession).StatusCode)
+
+	adminAuth := basicAuth("admin", "admin-pass")
+	resp = userRequest(t, "POST", "/users/"+admin.Id, url.Values{"role": {"signer"}}, adminAuth)
+	assert.Equal(t, 400, resp.StatusCode)
+	resp = userRequest(t, "POST", "/users/"+alice.Id, url.Values{"role": {"viewer"}, "password": {"new-pass"}}, adminAuth)
+	assert.Equal(t, 302, resp.StatusCode)
+	assert.Equal(t, 401, userRequest(t, "GET", apiPrefix+"/apps", nil, basicAuth("alice", "alice-pass")).StatusCode)
+	assert.Equal(t, 403, userRequest(t, "POST", apiPrefix+"/apps/"+aliceApp.GetId()+"/resign", nil, basicAuth("alice", "new-pass")).StatusCode)
+	assert.Equal(t, 400, userRequest(t, "POST", "/users/"+admin.Id+"/delete", nil, adminAuth).StatusCode)
+	assert.Equal(t, 302, userRequest(t, "POST", "/users/"+alice.Id+"/delete", nil, adminAuth).StatusCode)
+	assert.Equal(t, 400, userRequest(t, "POST", "/users/"+admin.Id+"/delete", nil, adminAuth).StatusCode)
+	assert.Equal(t, 401, userRequest(t, "GET", apiPrefix+"/apps", nil, bearer).StatusCode)
+	// the tokens of deleted users are revoked, so they aren't revived by a new user with the same name
+	_, ok = storage.Tokens.Get(aliceToken.Id)
+	assert.False(t, ok)
+	_, err = newUser("alice", "other-pass", "signer")
+	assert.NoError(t, err)
+	assert.Equal(t, 401, userRequest(t, "GET", apiPrefix+"/apps", nil, bearer).StatusCode)
+}
+
+func TestSessionCookieSecure(t *testing.T) {
+	serverUrl := config.Current.ServerUrl
+	t.Cleanup(func() { config.Current.ServerUrl = serverUrl })
+	// a TLS-terminating proxy forwards plain HTTP requests
+	for testUrl, secure := range map[string]bool{"https://example.com": true, "http://example.com": false} {
+		config.Current.ServerUrl = testUrl
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest("POST", "/login", nil), rec)
+		assert.NoError(t, startSession(c, "alice"))
+		cookies := rec.Result().Cookies()
+		if assert.Len(t, cookies, 1) {
+			assert.Equal(t, secure, cookies[0].Secure)
+			storage.Sessions.Delete(cookies[0].Value)
+		}
+	}
+}
+
+// A minimal OpenID Connect provider. Every authorization request is approved immediately, as the user with
+// the claims of nextClaims.
+type mockOidcProvider struct {
+	*httptest.Server
+	key        *ecdsa.PrivateKey
+	nextClaims map[string]any
+	// code -> challenge and claims of the authorization request
+	codes map[string][2]any
+}
+
+func startMockOidcProvider(t *testing.T, clientId string) *mockOidcProvider {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	p := &mockOidcProvider{key: key, codes: map[string][2]any{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kid": "test",
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		assert.Equal(t, clientId, query.Get("client_id"))
+		assert.Equal(t, "S256", query.Get("code_challenge_method"))
+		claims := map[string]any{
+			"iss":   p.URL,
+			"aud":   clientId,
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": query.Get("nonce"),
+		}
+		for key, value := range p.nextClaims {
+			claims[key] = value
+		}
+		code := uuid.NewString()
+		p.codes[code] = [2]any{query.Get("code_challenge"), claims}
+		http.Redirect(w, r, query.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {query.Get("state")}}.Encode(), 302)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		request, ok := p.codes[r.FormValue("code")]
+		delete(p.codes, r.FormValue("code"))
+		verifierHash := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(verifierHash[:]) != request[0] {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     p.sign(t, request[1].(map[string]any)),
+		})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *mockOidcProvider) sign(t *testing.T, claims map[string]any) string {
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": "test"})
+	assert.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	assert.NoError(t, err)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	r, sig, err := ecdsa.Sign(rand.Reader, p.key, hash[:])
+	assert.NoError(t, err)
+	signature := append(r.FillBytes(make([]byte, 32)), sig.FillBytes(make([]byte, 32))...)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOidcLogin(t *testing.T) {
+	provider := startMockOidcProvider(t, "signtools")
+	oldConfig := config.Current.OIDC
+	config.Current.OIDC = config.OIDC{
+		Enable:        true,
+		IssuerUrl:     provider.URL,
+		ClientId:      "signtools",
+		ClientSecret:  "secret",
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+		AdminGroups:   []string{"admins"},
+		SignerGroups:  []string{"developers"},
+	}
+	t.Cleanup(func() {
+		config.Current.OIDC = oldConfig
+		oidcProvider = nil
+		for _, user := range storage.Users.GetAll() {
+			_, err := storage.Users.Delete(user.Id)
+			assert.NoError(t, err)
+		}
+	})
+
+	// OIDC alone requires logging in
+	assert.Equal(t, 401, userRequest(t, "GET", apiPrefix+"/apps", nil, nil).StatusCode)
+
+	login := func(claims map[string]any) (*http.Response, *cookiejar.Jar) {
+		provider.nextClaims = claims
+		jar, err := cookiejar.New(nil)
+		assert.NoError(t, err)
+		client := http.Client{Jar: jar}
+		resp, err := client.Get(config.Current.ServerUrl + "/login/oidc?next=" + url.QueryEscape("/?tag=x"))
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp, jar
+	}
+	resp, jar := login(map[string]any{"preferred_username": "carol", "groups": []string{"staff", "developers"}})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "/?tag=x", resp.Request.URL.RequestURI())
+	carol, ok := storage.Users.GetByName("carol")
+	assert.True(t, ok)
+	assert.Equal(t, storage.RoleSigner, carol.Role)
+	assert.True(t, carol.IsExternal())
+	_, ok = storage.Users.Authenticate("carol", "")
+	assert.False(t, ok)
+	serverUrl, err := url.Parse(config.Current.ServerUrl)
+	assert.NoError(t, err)
+	withSession := func(req *http.Request) {
+		for _, cookie := range jar.Cookies(serverUrl) {
+			req.AddCookie(cookie)
+		}
+	}
+	assert.Equal(t, 200, userRequest(t, "GET", "/", nil, withSession).StatusCode)
+	assert.Equal(t, 403, userRequest(t, "GET", "/users", nil, withSession).StatusCode)
+
+	// the role follows the groups
+	resp, _ = login(map[string]any{"preferred_username": "carol", "groups": "admins"})
+	assert.Equal(t, 200, resp.StatusCode)
+	carol, _ = storage.Users.GetByName("carol")
+	assert.Equal(t, storage.RoleAdmin, carol.Role)
+
+	resp, _ = login(map[string]any{"preferred_username": "dave", "groups": []string{"staff"}})
+	assert.Equal(t, 403, resp.StatusCode)
+	_, ok = storage.Users.GetByName("dave")
+	assert.False(t, ok)
+
+	_, err = newUser("erin", "erin-pass", "signer")
+	assert.NoError(t, err)
+	resp, _ = login(map[string]any{"preferred_username": "erin", "groups": []string{"admins"}})
+	assert.Equal(t, 409, resp.StatusCode)
+
+	// a login can't be finished in another browser
+	provider.nextClaims = map[string]any{"preferred_username": "carol", "groups": "admins"}
+	resp = userRequest(t, "GET", "/login/oidc", nil, nil)
+	assert.Equal(t, 302, resp.StatusCode)
+	client := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err = client.Get(resp.Header.Get("Location"))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 400, userRequest(t, "GET", strings.TrimPrefix(resp.Header.Get("Location"), config.Current.ServerUrl), nil, nil).StatusCode)
+
+	// too many pending logins drop the oldest
+	_, oldestState, err := oidcProvider.AuthCodeUrl("/")
+	assert.NoError(t, err)
+	var newestState string
+	for i := 0; i < oidc.MaxPendingLogins; i++ {
+		_, newestState, err = oidcProvider.AuthCodeUrl("/")
+		assert.NoError(t, err)
+	}
+	_, _, err = oidcProvider.Exchange(context.Background(), oldestState, "code")
+	assert.ErrorContains(t, err, "unknown or expired login state")
+	_, _, err = oidcProvider.Exchange(context.Background(), newestState, "code")
+	assert.ErrorContains(t, err, "exchange code")
+}
+
 func TestEscapeXML(t *testing.T) {
 	escapedText, err := escapeXML("This & That")
 	assert.NoError(t, err)
 	assert.Equal(t, "This &amp; That", escapedText)
 }
 
+var testInfo = map[string]any{
+	"CFBundleIdentifier":         "com.example.test",
+	"CFBundleName":               "Test",
+	"CFBundleShortVersionString": "1.2.3",
+	"CFBundleVersion":            "45",
+	"CFBundleExecutable":         "Test",
+	"MinimumOSVersion":           "14.0",
+	"UIDeviceFamily":             []int{1, 2},
+}
+
+func makeTestIpa(t *testing.T, info map[string]any, format int) []byte {
+	plistBytes, err := plist.Marshal(info, format)
+	assert.NoError(t, err)
+	return makeTestZip(t, map[string][]byte{
+		"Payload/Test.app/Info.plist": plistBytes,
+		"Payload/Test.app/Test":       []byte(unsignedData),
+	})
+}
+
+func makeTestZip(t *testing.T, files map[string][]byte) []byte {
+	var buffer bytes.Buffer
+	w := zip.NewWriter(&buffer)
+	for name, data := range files {
+		f, err := w.Create(name)
+		assert.NoError(t, err)
+		_, err = f.Write(data)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.Close())
+	return buffer.Bytes()
+}
+
+// Like makeTestZip, but the large file is stored uncompressed and claims to be much larger than it is.
+func makeTestZipWithLargeFile(t *testing.T, files map[string][]byte, largeName string, largeData []byte) []byte {
+	var buffer bytes.Buffer
+	w := zip.NewWriter(&buffer)
+	for name, data := range files {
+		f, err := w.Create(name)
+		assert.NoError(t, err)
+		_, err = f.Write(data)
+		assert.NoError(t, err)
+	}
+	f, err := w.CreateRaw(&zip.FileHeader{
+		Name:               largeName,
+		Method:             zip.Store,
+		CompressedSize64:   uint64(len(largeData)),
+		UncompressedSize64: 1 << 40,
+	})
+	assert.NoError(t, err)
+	_, err = f.Write(largeData)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return buffer.Bytes()
+}
+
+func TestIpaMetadata(t *testing.T) {
+	for _, format := range []int{plist.XMLFormat, plist.BinaryFormat} {
+		data := makeTestIpa(t, testInfo, format)
+		metadata, err := ipa.ReadMetadata(bytes.NewReader(data), int64(len(data)))
+		assert.NoError(t, err)
+		assert.Equal(t, &ipa.Metadata{
+			BundleId:         "com.example.test",
+			DisplayName:      "Test",
+			Version:          "1.2.3",
+			BuildNumber:      "45",
+			MinimumOSVersion: "14.0",
+			DeviceFamilies:   []int{1, 2},
+		}, metadata)
+		assert.Equal(t, []string{"iPhone", "iPad"}, metadata.DeviceFamilyNames())
+	}
+}
+
+func TestValidateIpa(t *testing.T) {
+	plistBytes, err := plist.Marshal(testInfo, plist.XMLFormat)
+	assert.NoError(t, err)
+	valid := makeTestIpa(t, testInfo, plist.XMLFormat)
+	assert.NoError(t, ipa.Validate(bytes.NewReader(valid), int64(len(valid))))
+	invalid := map[string][]byte{
+		"not a zip": []byte(unsignedData),
+		"no app": makeTestZip(t, map[string][]byte{
+			"Payload/Info.plist": plistBytes,
+		}),
+		"two apps": makeTestZip(t, map[string][]byte{
+			"Payload/Test.app/Info.plist":  plistBytes,
+			"Payload/Test.app/Test":        []byte(unsignedData),
+			"Payload/Other.app/Info.plist": plistBytes,
+		}),
+		"no Info.plist": makeTestZip(t, map[string][]byte{
+			"Payload/Test.app/Test": []byte(unsignedData),
+		}),
+		"no executable": makeTestZip(t, map[string][]byte{
+			"Payload/Test.app/Info.plist": plistBytes,
+		}),
+		"path traversal": makeTestZip(t, map[string][]byte{
+			"Payload/Test.app/Info.plist":    plistBytes,
+			"Payload/Test.app/Test":          []byte(unsignedData),
+			"Payload/Test.app/../../evil.sh": []byte(unsignedData),
+		}),
+	}
+	for name, data := range invalid {
+		assert.Error(t, ipa.Validate(bytes.NewReader(data), int64(len(data))), name)
+	}
+}
+
+// A minimal arm64 executable with a single LC_ENCRYPTION_INFO_64 load command.
+func makeTestMachO(cryptId uint32) []byte {
+	var buffer bytes.Buffer
+	for _, value := range []uint32{0xfeedfacf, 0x0100000c, 0, 2, 1, 24, 0, 0, 0x2c, 24, 0, 0, cryptId, 0} {
+		binary.Write(&buffer, binary.LittleEndian, value)
+	}
+	return buffer.Bytes()
+}
+
+func makeTestFatMachO(thin []byte) []byte {
+	const offset = 4096
+	var buffer bytes.Buffer
+	for _, value := range []uint32{0xcafebabe, 1, 0x0100000c, 0, offset, uint32(len(thin)), 12} {
+		binary.Write(&buffer, binary.BigEndian, value)
+	}
+	buffer.Write(make([]byte, offset-buffer.Len()))
+	buffer.Write(thin)
+	return buffer.Bytes()
+}
+
+func TestEncryptedBinaries(t *testing.T) {
+	plistBytes, err := plist.Marshal(testInfo, plist.XMLFormat)
+	assert.NoError(t, err)
+	cases := []struct {
+		files     map[string][]byte
+		encrypted []string
+	}{
+		{map[string][]byte{"Payload/Test.app/Test": makeTestMachO(0)}, nil},
+		{map[string][]byte{"Payload/Test.app/Test": makeTestMachO(1)}, []string{"Payload/Test.app/Test"}},
+		{map[string][]byte{"Payload/Test.app/Test": makeTestFatMachO(makeTestMachO(1))}, []string{"Payload/Test.app/Test"}},
+		{map[string][]byte{
+			"Payload/Test.app/Test":                         makeTestFatMachO(makeTestMachO(0)),
+			"Payload/Test.app/PlugIns/Ext.appex/Info.plist": plistBytes,
+			"Payload/Test.app/PlugIns/Ext.appex/Test":       makeTestMachO(1),
+		}, []string{"Payload/Test.app/PlugIns/Ext.appex/Test"}},
+	}
+	for _, c := range cases {
+		c.files["Payload/Test.app/Info.plist"] = plistBytes
+		data := makeTestZip(t, c.files)
+		archive, err := ipa.Open(bytes.NewReader(data), int64(len(data)))
+		assert.NoError(t, err)
+		encrypted, err := archive.EncryptedBinaries()
+		assert.NoError(t, err)
+		assert.Equal(t, c.encrypted, encrypted)
+	}
+
+	// only the load commands are read, however large the executable claims to be
+	data := makeTestZipWithLargeFile(t, map[string][]byte{"Payload/Test.app/Info.plist": plistBytes}, "Payload/Test.app/Test", makeTestMachO(1))
+	archive, err := ipa.Open(bytes.NewReader(data), int64(len(data)))
+	assert.NoError(t, err)
+	encrypted, err := archive.EncryptedBinaries()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Payload/Test.app/Test"}, encrypted)
+}
+
+func makeTestBlob(magic uint32, content []byte) []byte {
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.BigEndian, magic)
+	binary.Write(&buffer, binary.BigEndian, uint32(8+len(content)))
+	buffer.Write(content)
+	return buffer.Bytes()
+}
+
+// A minimal arm64 executable with a code signature made of the blobs, keyed by slot.
+func makeTestSignedMachO(blobs map[uint32][]byte) []byte {
+	var slots []uint32
+	for slot := range blobs {
+		slots = append(slots, slot)
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i] < slots[j] })
+	var index, content bytes.Buffer
+	for _, slot := range slots {
+		binary.Write(&index, binary.BigEndian, []uint32{slot, uint32(12 + 8*len(slots) + content.Len())})
+		content.Write(blobs[slot])
+	}
+	var superBlob bytes.Buffer
+	binary.Write(&superBlob, binary.BigEndian, []uint32{0xfade0cc0, uint32(12 + index.Len() + content.Len()), uint32(len(slots))})
+	superBlob.Write(index.Bytes())
+	superBlob.Write(content.Bytes())
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.LittleEndian, []uint32{0xfeedfacf, 0x0100000c, 0, 2, 1, 16, 0, 0, 0x1d, 16, 48, uint32(superBlob.Len())})
+	buffer.Write(superBlob.Bytes())
+	return buffer.Bytes()
+}
+
+func makeTestEntitlementsMachO(t *testing.T, entitlements map[string]any) []byte {
+	entitlementsBytes, err := plist.Marshal(entitlements, plist.XMLFormat)
+	assert.NoError(t, err)
+	return makeTestSignedMachO(map[uint32][]byte{5: makeTestBlob(0xfade7171, entitlementsBytes)})
+}
+
+func TestFatMachOBounds(t *testing.T) {
+	plistBytes, err := plist.Marshal(testInfo, plist.XMLFormat)
+	assert.NoError(t, err)
+	readEntitlements := func(executable []byte) (map[string]map[string]any, error) {
+		data := makeTestZip(t, map[string][]byte{
+			"Payload/Test.app/Info.plist": plistBytes,
+			"Payload/Test.app/Test":       executable,
+		})
+		archive, err := ipa.Open(bytes.NewReader(data), int64(len(data)))
+		assert.NoError(t, err)
+		return archive.Entitlements()
+	}
+	thin := makeTestEntitlementsMachO(t, map[string]any{"get-task-allow": true})
+	entitlements, err := readEntitlements(makeTestFatMachO(thin))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]any{"get-task-allow": true}, entitlements["Test"])
+	// a truncated binary, and a size that overflows when added to the offset
+	for _, size := range []uint32{uint32(len(thin)) + 1, 0xffffffff} {
+		fat := makeTestFatMachO(thin)
+		binary.BigEndian.PutUint32(fat[20:24], size)
+		_, err = readEntitlements(fat)
+		assert.Error(t, err)
+	}
+
+	// only the load commands and the signature are read, however large the executable claims to be
+	readLargeEntitlements := func(executable []byte) (map[string]map[string]any, error) {
+		data := makeTestZipWithLargeFile(t, map[string][]byte{"Payload/Test.app/Info.plist": plistBytes}, "Payload/Test.app/Test", executable)
+		archive, err := ipa.Open(bytes.NewReader(data), int64(len(data)))
+		assert.NoError(t, err)
+		return archive.Entitlements()
+	}
+	entitlements, err = readLargeEntitlements(thin)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]any{"get-task-allow": true}, entitlements["Test"])
+	// but the signature's size is limited, since it's read whole
+	huge := bytes.Clone(thin)
+	binary.LittleEndian.PutUint32(huge[44:48], 1<<30)
+	_, err = readLargeEntitlements(huge)
+	assert.ErrorContains(t, err, "too large")
+}
+
+func TestEntitlementsDiff(t *testing.T) {
+	plistBytes, err := plist.Marshal(testInfo, plist.XMLFormat)
+	assert.NoError(t, err)
+	readEntitlements := func(executable []byte) map[string]map[string]any {
+		data := makeTestZip(t, map[string][]byte{
+			"Payload/Test.app/Info.plist": plistBytes,
+			"Payload/Test.app/Test":       executable,
+		})
+		archive, err := ipa.Open(bytes.NewReader(data), int64(len(data)))
+		assert.NoError(t, err)
+		entitlements, err := archive.Entitlements()
+		assert.NoError(t, err)
+		return entitlements
+	}
+	unsigned := readEntitlements(makeTestFatMachO(makeTestEntitlementsMachO(t, map[string]any{
+		"application-identifier": "ABCDE.com.example.test",
+		"get-task-allow":         false,
+		"aps-environment":        "production",
+	})))
+	signed := readEntitlements(makeTestEntitlementsMachO(t, map[string]any{
+		"application-identifier":              "FGHIJ.com.example.test",
+		"get-task-allow":                      false,
+		"com.apple.developer.team-identifier": "FGHIJ",
+	}))
+	assert.Equal(t, []ipa.BinaryEntitlementsDiff{{Binary: "Test", Changes: []ipa.EntitlementDiff{
+		{Key: "application-identifier", Unsigned: "ABCDE.com.example.test", Signed: "FGHIJ.com.example.test", Status: ipa.EntitlementChanged},
+		{Key: "aps-environment", Unsigned: "production", Status: ipa.EntitlementRemoved},
+		{Key: "com.apple.developer.team-identifier", Signed: "FGHIJ", Status: ipa.EntitlementAdded},
+		{Key: "get-task-allow", Unsigned: false, Signed: false, Status: ipa.EntitlementUnchanged},
+	}}}, ipa.DiffEntitlements(unsigned, signed))
+	assert.Equal(t, map[string]map[string]any{"Test": nil}, readEntitlements(makeTestMachO(0)))
+}
+
+func loadTestIdentity(p12 []byte, pass string) (*x509.Certificate, crypto.PrivateKey, error) {
+	blocks, err := pkcs12.ToPEM(p12, pass)
+	if err != nil {
+		return nil, nil, err
+	}
+	var cert *x509.Certificate
+	var key crypto.PrivateKey
+	for _, block := range blocks {
+		switch block.Type {
+		case "CERTIFICATE":
+			if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+				return nil, nil, err
+			}
+		case "PRIVATE KEY":
+			if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+	if cert == nil || key == nil {
+		return nil, nil, errors.New("no certificate or key")
+	}
+	return cert, key, nil
+}
+
+func makeTestMobileProvision(cert *x509.Certificate, key crypto.PrivateKey, appId string) ([]byte, error) {
+	content, err := plist.Marshal(map[string]any{
+		"UUID":                  uuid.NewString(),
+		"Name":                  "Test",
+		"TeamIdentifier":        []string{"TEST_TEAM_ID"},
+		"DeveloperCertificates": [][]byte{cert.Raw},
+		"Entitlements":          map[string]any{"application-identifier": appId},
+	}, plist.XMLFormat)
+	if err != nil {
+		return nil, err
+	}
+	signedData, err := pkcs7.NewSignedData(content)
+	if err != nil {
+		return nil, err
+	}
+	if err := signedData.AddSigner(cert, key, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, err
+	}
+	return signedData.Finish()
+}
+
+func makeTestSignedIpa(t *testing.T, cert *x509.Certificate, key crypto.PrivateKey, prov []byte) []byte {
+	plistBytes, err := plist.Marshal(testInfo, plist.XMLFormat)
+	assert.NoError(t, err)
+	codeDirectory := makeTestBlob(0xfade0c02, []byte(unsignedData))
+	signedData, err := pkcs7.NewSignedData(codeDirectory)
+	assert.NoError(t, err)
+	assert.NoError(t, signedData.AddSigner(cert, key, pkcs7.SignerInfoConfig{}))
+	signedData.Detach()
+	signature, err := signedData.Finish()
+	assert.NoError(t, err)
+	return makeTestZip(t, map[string][]byte{
+		"Payload/Test.app/Info.plist": plistBytes,
+		"Payload/Test.app/Test": makeTestSignedMachO(map[uint32][]byte{
+			0:       codeDirectory,
+			0x10000: makeTestBlob(0xfade0b01, signature),
+		}),
+		"Payload/Test.app/embedded.mobileprovision": prov,
+	})
+}
+
+func TestVerifySignedIpa(t *testing.T) {
+	verify := func(data []byte, bundleId string) error {
+		archive, err := ipa.Open(bytes.NewReader(data), int64(len(data)))
+		assert.NoError(t, err)
+		_, err = archive.VerifySignature([]*x509.Certificate{profileLeaf}, bundleId)
+		return err
+	}
+	bundleId := testInfo["CFBundleIdentifier"].(string)
+	assert.NoError(t, verify(makeTestSignedIpa(t, profileLeaf, profileKey, profileProv), bundleId))
+	assert.Error(t, verify(makeTestSignedIpa(t, profileLeaf, profileKey, profileProv), "com.example.other"))
+	assert.Error(t, verify(makeTestIpa(t, testInfo, plist.XMLFormat), bundleId))
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	otherCertBytes, err := x509.CreateCertificate(rand.Reader, template, template, otherKey.Public(), otherKey)
+	assert.NoError(t, err)
+	otherCert, err := x509.ParseCertificate(otherCertBytes)
+	assert.NoError(t, err)
+	otherProv, err := makeTestMobileProvision(otherCert, otherKey, "TEST_TEAM_ID.*")
+	assert.NoError(t, err)
+	assert.Error(t, verify(makeTestSignedIpa(t, otherCert, otherKey, otherProv), bundleId))
+	assert.Error(t, verify(makeTestSignedIpa(t, profileLeaf, profileKey, otherProv), bundleId))
+	wrongIdProv, err := makeTestMobileProvision(profileLeaf, profileKey, "TEST_TEAM_ID.com.example.other")
+	assert.NoError(t, err)
+	assert.Error(t, verify(makeTestSignedIpa(t, profileLeaf, profileKey, wrongIdProv), bundleId))
+}
+
+func TestVerifySignedApp(t *testing.T) {
+	bundleId := testInfo["CFBundleIdentifier"].(string)
+	otherProv, err := makeTestMobileProvision(profileLeaf, profileKey, "TEST_TEAM_ID.*")
+	assert.NoError(t, err)
+	// profiles from files and from environment variables are verified the same way
+	for _, id := range []string{profileId, envProfileId} {
+		profile, ok := storage.Profiles.GetById(id)
+		assert.True(t, ok)
+		app, err := storage.Apps.New(bytes.NewReader(makeTestIpa(t, testInfo, plist.XMLFormat)), "test.ipa", "", profile, "", "", "selfhosted", nil)
+		assert.NoError(t, err)
+		defer storage.Apps.Delete(app.GetId())
+		verify := func(prov []byte) error {
+			signedPath := filepath.Join(t.TempDir(), "signed.ipa")
+			assert.NoError(t, os.WriteFile(signedPath, makeTestSignedIpa(t, profileLeaf, profileKey, prov), 0600))
+			file, err := os.Open(signedPath)
+			assert.NoError(t, err)
+			defer file.Close()
+			return verifySignedApp(app, file, bundleId)
+		}
+		assert.NoError(t, verify(profileProv))
+		assert.ErrorContains(t, verify(otherProv), "does not match")
+	}
+}
+
+func writePNGChunk(buffer *bytes.Buffer, kind string, data []byte) {
+	binary.Write(buffer, binary.BigEndian, uint32(len(data)))
+	chunk := append([]byte(kind), data...)
+	buffer.Write(chunk)
+	binary.Write(buffer, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+}
+
+func TestUncrushPNG(t *testing.T) {
+	// straight RGBA
+	pixels := [][][4]byte{
+		{{255, 0, 0, 255}, {0, 255, 0, 128}},
+		{{0, 0, 255, 255}, {0, 0, 0, 0}},
+	}
+	var raw []byte
+	for _, row := range pixels {
+		// no filter
+		raw = append(raw, 0)
+		for _, p := range row {
+			// premultiplied BGRA
+			raw = append(raw, byte(int(p[2])*int(p[3])/255), byte(int(p[1])*int(p[3])/255), byte(int(p[0])*int(p[3])/255), p[3])
+		}
+	}
+	var compressed bytes.Buffer
+	w, err := flate.NewWriter(&compressed, flate.BestCompression)
+	assert.NoError(t, err)
+	_, err = w.Write(raw)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	var crushed bytes.Buffer
+	crushed.WriteString("\x89PNG\r\n\x1a\n")
+	writePNGChunk(&crushed, "CgBI", []byte{0x50, 0x00, 0x20, 0x06})
+	writePNGChunk(&crushed, "IHDR", []byte{0, 0, 0, 2, 0, 0, 0, 2, 8, 6, 0, 0, 0})
+	writePNGChunk(&crushed, "IDAT", compressed.Bytes())
+	writePNGChunk(&crushed, "IEND", nil)
+
+	result, err := ipa.UncrushPNG(crushed.Bytes())
+	assert.NoError(t, err)
+	img, err := png.Decode(bytes.NewReader(result))
+	assert.NoError(t, err)
+	for y, row := range pixels {
+		for x, p := range row {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if p[3] == 0 {
+				assert.EqualValues(t, 0, c.A)
+				continue
+			}
+			assert.InDelta(t, p[0], c.R, 2)
+			assert.InDelta(t, p[1], c.G, 2)
+			assert.InDelta(t, p[2], c.B, 2)
+			assert.Equal(t, p[3], c.A)
+		}
+	}
+
+	// the size comes from the upload, so it must be limited before allocating the image
+	var huge bytes.Buffer
+	huge.WriteString("\x89PNG\r\n\x1a\n")
+	writePNGChunk(&huge, "CgBI", []byte{0x50, 0x00, 0x20, 0x06})
+	writePNGChunk(&huge, "IHDR", []byte{0x7f, 0xff, 0xff, 0xff, 0x7f, 0xff, 0xff, 0xff, 8, 6, 0, 0, 0})
+	writePNGChunk(&huge, "IDAT", compressed.Bytes())
+	writePNGChunk(&huge, "IEND", nil)
+	_, err = ipa.UncrushPNG(huge.Bytes())
+	assert.ErrorContains(t, err, "too large")
+}
+
+func TestReadFileSizeLimit(t *testing.T) {
+	// the Info.plist and icons are read whole, so their size is limited
+	data := makeTestZipWithLargeFile(t, nil, "Payload/Test.app/Info.plist", []byte("data"))
+	_, err := ipa.Open(bytes.NewReader(data), int64(len(data)))
+	assert.ErrorContains(t, err, "too large")
+
+	info := maps.Clone(testInfo)
+	info["CFBundleIconFile"] = "Icon"
+	plistBytes, err := plist.Marshal(info, plist.XMLFormat)
+	assert.NoError(t, err)
+	data = makeTestZipWithLargeFile(t, map[string][]byte{"Payload/Test.app/Info.plist": plistBytes}, "Payload/Test.app/Icon.png", []byte("data"))
+	archive, err := ipa.Open(bytes.NewReader(data), int64(len(data)))
+	assert.NoError(t, err)
+	_, err = archive.Icon()
+	assert.ErrorContains(t, err, "too large")
+}
+
 func validateXML(input string) error {
 	decoder := xml.NewDecoder(strings.NewReader(input))
 	for {
@@ -298,3 +1694,539 @@ func validateXML(input string) error {
 		}
 	}
 }
+
+func getAuditEntries(t *testing.T, query url.Values) []storage.AuditEntry {
+	resp, err := http.Get(config.Current.ServerUrl + "/audit.jsonl?" + query.Encode())
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	var entries []storage.AuditEntry
+	decoder := json.NewDecoder(resp.Body)
+	for decoder.More() {
+		var entry storage.AuditEntry
+		assert.NoError(t, decoder.Decode(&entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditLog(t *testing.T) {
+	var token tokenJson
+	assert.Equal(t, 201, apiRequest(t, "POST", "/tokens", tokenCreateJson{Name: "audited", Scope: "read"}, &token))
+	t.Cleanup(func() { storage.Tokens.Delete(token.Id) })
+	assert.Equal(t, 404, apiRequest(t, "DELETE", "/tokens/missing", nil, nil))
+	assert.Equal(t, 403, tokenRequest(t, token.Token, "DELETE", apiPrefix+"/tokens/"+token.Id))
+
+	entries := getAuditEntries(t, url.Values{"action": {"token.create"}, "id": {token.Id}})
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, 201, entries[0].Status)
+		assert.Equal(t, token.Id, entries[0].Target)
+		assert.NotEmpty(t, entries[0].Ip)
+	}
+	entries = getAuditEntries(t, url.Values{"action": {"token.revoke"}, "result": {"failed"}})
+	var statuses []int
+	for _, entry := range entries {
+		statuses = append(statuses, entry.Status)
+		if entry.Target == "missing" {
+			assert.Equal(t, "No token with id missing", entry.Error)
+		}
+	}
+	assert.Subset(t, statuses, []int{403, 404})
+	assert.Empty(t, getAuditEntries(t, url.Values{"action": {"token.revoke"}, "result": {"ok"}, "id": {"missing"}}))
+
+	// taken by the earlier tests
+	entries = getAuditEntries(t, url.Values{"action": {"job.take"}, "result": {"ok"}})
+	if assert.NotEmpty(t, entries) {
+		assert.True(t, strings.HasPrefix(entries[0].Actor, "builder:"))
+		assert.NotEmpty(t, entries[0].JobId)
+		assert.NotEmpty(t, entries[0].AppId)
+		assert.NotEmpty(t, entries[0].ProfileId)
+	}
+
+	resp, err := http.Get(config.Current.ServerUrl + "/audit?action=token.create")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, string(body), token.Id)
+}
+
+func TestShareLinks(t *testing.T) {
+	profile, ok := storage.Profiles.GetById(profileId)
+	assert.True(t, ok)
+	data := makeTestIpa(t, testInfo, plist.XMLFormat)
+	app, err := storage.Apps.New(bytes.NewReader(data), "shared.ipa", "", profile, "", "", "selfhosted", nil)
+	assert.NoError(t, err)
+	defer storage.Apps.Delete(app.GetId())
+	assert.NoError(t, app.SetFile(storage.AppSignedFile, bytes.NewReader(data)))
+	assert.NoError(t, app.SetString(storage.AppBundleId, "com.example.shared"))
+	appPath := "/apps/" + app.GetId()
+
+	assert.Equal(t, 400, apiRequest(t, "POST", appPath+"/share", shareCreateJson{}, nil))
+	config.Current.ShareLinks = config.ShareLinks{Enable: true, DefaultExpiryHours: 7 * 24}
+	t.Cleanup(func() { config.Current.ShareLinks = config.ShareLinks{} })
+	assert.Equal(t, 400, apiRequest(t, "POST", appPath+"/share", shareCreateJson{MaxDownloads: -1}, nil))
+	var share shareJson
+	assert.Equal(t, 201, apiRequest(t, "POST", appPath+"/share", shareCreateJson{MaxDownloads: 1}, &share))
+	assert.Equal(t, 1, share.MaxDownloads)
+	assert.WithinDuration(t, time.Now().Add(7*24*time.Hour), share.Expires, time.Minute)
+	shareUrl, err := url.Parse(share.Url)
+	assert.NoError(t, err)
+	assert.Equal(t, appPath+"/install", shareUrl.Path)
+	token := shareUrl.Query().Get(shareQueryName)
+	assert.NotEmpty(t, token)
+
+	// once a user exists, logging in is required without a share link
+	_, err = newUser("admin", "admin-pass", "admin")
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		for _, user := range storage.Users.GetAll() {
+			storage.Users.Delete(user.Id)
+		}
+	})
+	get := func(path string, auth func(*http.Request)) (int, string) {
+		req, err := http.NewRequest("GET", config.Current.ServerUrl+path, nil)
+		assert.NoError(t, err)
+		if auth != nil {
+			auth(req)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+	code, _ := get(appPath+"/install", nil)
+	assert.Equal(t, 302, code)
+	code, _ = get(appPath+"/signed", nil)
+	assert.Equal(t, 302, code)
+	code, body := get(appPath+"/install", basicAuth("admin", "admin-pass"))
+	assert.Equal(t, 200, code)
+	assert.Contains(t, body, shareQueryName)
+
+	code, body = get(appPath+"/install?share="+token, nil)
+	assert.Equal(t, 200, code)
+	assert.Contains(t, body, token)
+	code, body = get(appPath+"/manifest?share="+token, nil)
+	assert.Equal(t, 200, code)
+	assert.Contains(t, body, "signed?share="+token)
+	code, body = get(appPath+"/signed?share="+token, nil)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, string(data), body)
+	code, _ = get(appPath+"/signed?share="+token, nil)
+	assert.Equal(t, 403, code)
+	code, _ = get(appPath+"/install?share="+token, nil)
+	assert.Equal(t, 403, code)
+
+	code, _ = get(appPath+"/install?share="+token+"x", nil)
+	assert.Equal(t, 403, code)
+	_, otherToken, err := storage.ShareLinks.New("other", time.Hour, 0)
+	assert.NoError(t, err)
+	code, _ = get(appPath+"/install?share="+otherToken, nil)
+	assert.Equal(t, 403, code)
+	_, expiredToken, err := storage.ShareLinks.New(app.GetId(), -time.Minute, 0)
+	assert.NoError(t, err)
+	code, _ = get(appPath+"/signed?share="+expiredToken, nil)
+	assert.Equal(t, 403, code)
+
+	// share links only give access to the signed app
+	_, unlimitedToken, err := storage.ShareLinks.New(app.GetId(), time.Hour, 0)
+	assert.NoError(t, err)
+	// the app has no tweaks
+	for path, userCode := range map[string]int{appPath + "/unsigned": 200, appPath + "/tweaks": 404} {
+		code, _ = get(path, nil)
+		assert.Equal(t, 302, code)
+		code, _ = get(path+"?share="+unlimitedToken, nil)
+		assert.Equal(t, 302, code)
+		code, _ = get(path, basicAuth("admin", "admin-pass"))
+		assert.Equal(t, userCode, code)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	config.Current.RateLimit = config.RateLimit{Enable: true, RequestsPerMinute: 60, Burst: 2, MaxAuthFailures: 3, LockoutMins: 1}
+	config.Current.TrustedProxies = []string{"127.0.0.1"}
+	t.Cleanup(func() {
+		config.Current.RateLimit = config.RateLimit{}
+		config.Current.TrustedProxies = nil
+		authLimits.mu.Lock()
+		defer authLimits.mu.Unlock()
+		authLimits.clients = map[string]*authFailures{}
+	})
+
+	trustedProxies, err := parseTrustedProxies(config.Current.TrustedProxies)
+	assert.NoError(t, err)
+	e := echo.New()
+	e.IPExtractor = makeIpExtractor(trustedProxies)
+	e.Use(makeRateLimit())
+	e.GET("/", getEmpty200)
+	get := func(remoteAddr string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	assert.Equal(t, 200, get("192.0.2.1:1234"))
+	assert.Equal(t, 200, get("192.0.2.1:1234"))
+	assert.Equal(t, 429, get("192.0.2.1:1234"))
+	assert.Equal(t, 200, get("192.0.2.2:1234"))
+
+	// the trusted proxies are read once when the server is created. Its rate limit is raised, to only hit the
+	// lockout.
+	newTestServer := func() *httptest.Server {
+		limit := config.Current.RateLimit
+		config.Current.RateLimit.Burst = 100
+		e, err := newServer()
+		config.Current.RateLimit = limit
+		assert.NoError(t, err)
+		server := httptest.NewServer(e)
+		t.Cleanup(server.Close)
+		return server
+	}
+	server := newTestServer()
+	jobs := func(key string, forwardedFor string) *http.Response {
+		req, err := http.NewRequest("HEAD", server.URL+"/jobs", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+key)
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 401, jobs("wrong", "203.0.113.1").StatusCode)
+	}
+	// the right key is refused too while locked out
+	resp := jobs(builderKey, "203.0.113.1")
+	assert.Equal(t, 429, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	assert.Equal(t, 200, jobs(builderKey, "203.0.113.2").StatusCode)
+	// the forwarded IP is ignored if the proxy isn't trusted, which is logged once
+	config.Current.TrustedProxies = nil
+	assert.Equal(t, 429, jobs(builderKey, "203.0.113.1").StatusCode)
+	server = newTestServer()
+	var logs bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&logs)
+	assert.Equal(t, 200, jobs(builderKey, "203.0.113.1").StatusCode)
+	assert.Equal(t, 200, jobs(builderKey, "203.0.113.1").StatusCode)
+	log.Logger = logger
+	assert.Equal(t, 1, strings.Count(logs.String(), "untrusted proxy"))
+	config.Current.TrustedProxies = []string{"not an ip"}
+	_, err = newServer()
+	assert.Error(t, err)
+}
+
+func TestProfileEncryption(t *testing.T) {
+	// restore the plaintext profiles afterwards, since the other tests don't use a master key
+	profilesDir := filepath.Join(saveDir, "profiles")
+	originals := map[string][]byte{}
+	assert.NoError(t, filepath.WalkDir(profilesDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		originals[path], err = os.ReadFile(path)
+		return err
+	}))
+	t.Cleanup(func() {
+		for path, data := range originals {
+			assert.NoError(t, os.WriteFile(path, data, 0600))
+		}
+		assert.NoError(t, storage.SetMasterKey(nil))
+	})
+	newKey := func() []byte {
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		assert.NoError(t, err)
+		return key
+	}
+	oldKey, newerKey := newKey(), newKey()
+	profile, ok := storage.Profiles.GetById(profileId)
+	assert.True(t, ok)
+	passPath := filepath.Join(profilesDir, profileId, string(storage.ProfileCertPass))
+	assertReadable := func() {
+		pass, err := profile.GetString(storage.ProfileCertPass)
+		assert.NoError(t, err)
+		assert.Equal(t, profileCertPass, pass)
+		certFile, err := profile.GetFile(storage.ProfileCert)
+		assert.NoError(t, err)
+		defer certFile.Close()
+		cert, err := io.ReadAll(certFile)
+		assert.NoError(t, err)
+		assert.Equal(t, profileCert, cert)
+	}
+
+	assert.Error(t, storage.SetMasterKey([]byte("short")))
+	// plaintext files are still readable with a master key
+	assert.NoError(t, storage.SetMasterKey(oldKey))
+	assertReadable()
+
+	assert.NoError(t, storage.EncryptProfiles())
+	sealed, err := os.ReadFile(passPath)
+	assert.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(sealed, []byte("STENVLP1")))
+	assert.NotContains(t, string(sealed), profileCertPass)
+	assertReadable()
+	// encrypting again leaves sealed files alone
+	assert.NoError(t, storage.EncryptProfiles())
+	resealed, err := os.ReadFile(passPath)
+	assert.NoError(t, err)
+	assert.Equal(t, sealed, resealed)
+
+	assert.NoError(t, storage.SetMasterKey(newerKey))
+	_, err = profile.GetString(storage.ProfileCertPass)
+	assert.Error(t, err)
+	assert.NoError(t, storage.SetMasterKey(nil))
+	_, err = profile.GetString(storage.ProfileCertPass)
+	assert.ErrorIs(t, err, storage.ErrNoMasterKey)
+
+	assert.NoError(t, storage.SetMasterKey(oldKey))
+	// a file that can't be re-wrapped fails the rotation before any file is replaced. Profiles are rotated in
+	// order of their ids, so this one is last.
+	brokenDir := filepath.Join(profilesDir, "zzz-broken")
+	assert.NoError(t, os.MkdirAll(brokenDir, 0700))
+	t.Cleanup(func() { assert.NoError(t, os.RemoveAll(brokenDir)) })
+	broken := bytes.Clone(sealed)
+	broken[len("STENVLP1")+12] ^= 0xff
+	assert.NoError(t, os.WriteFile(filepath.Join(brokenDir, string(storage.ProfileCertPass)), broken, 0600))
+	assert.Error(t, storage.RotateProfileKey(newerKey))
+	unchanged, err := os.ReadFile(passPath)
+	assert.NoError(t, err)
+	assert.Equal(t, sealed, unchanged)
+	assertReadable()
+	leftovers, err := filepath.Glob(filepath.Join(profilesDir, "*", ".transform-*"))
+	assert.NoError(t, err)
+	assert.Empty(t, leftovers)
+	assert.NoError(t, os.RemoveAll(brokenDir))
+
+	assert.NoError(t, storage.RotateProfileKey(newerKey))
+	rotated, err := os.ReadFile(passPath)
+	assert.NoError(t, err)
+	// only the data key is re-wrapped, the encrypted data stays the same
+	assert.Equal(t, sealed[len(sealed)-len(profileCertPass)-16:], rotated[len(rotated)-len(profileCertPass)-16:])
+	_, err = profile.GetString(storage.ProfileCertPass)
+	assert.Error(t, err)
+	assert.NoError(t, storage.SetMasterKey(newerKey))
+	assertReadable()
+}
+
+func TestProfileAllowedUsers(t *testing.T) {
+	for _, user := range []struct{ name, role string }{{"admin", "admin"}, {"alice", "signer"}, {"bob", "signer"}} {
+		_, err := newUser(user.name, user.name+"-pass", user.role)
+		assert.NoError(t, err)
+	}
+	t.Cleanup(func() {
+		for _, user := range storage.Users.GetAll() {
+			storage.Users.Delete(user.Id)
+		}
+	})
+	profile, ok := storage.Profiles.GetById(profileId)
+	assert.True(t, ok)
+	assert.NoError(t, profile.SetString(storage.ProfileAllowedUsers, "admin, alice"))
+	t.Cleanup(func() { assert.NoError(t, profile.RemoveFile(storage.ProfileAllowedUsers)) })
+	data := makeTestIpa(t, testInfo, plist.XMLFormat)
+	bobApp, err := storage.Apps.New(bytes.NewReader(data), "bob.ipa", "bob", profile, "", "", "selfhosted", nil)
+	assert.NoError(t, err)
+	defer storage.Apps.Delete(bobApp.GetId())
+
+	getIndex := func(user string) string {
+		req, err := http.NewRequest("GET", config.Current.ServerUrl+"/", nil)
+		assert.NoError(t, err)
+		req.SetBasicAuth(user, user+"-pass")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return string(body)
+	}
+	profileOption := fmt.Sprintf(`<option value="%s"`, profileId)
+	assert.Contains(t, getIndex("alice"), profileOption)
+	assert.NotContains(t, getIndex("bob"), profileOption)
+
+	form := url.Values{
+		formNames.FormFileId:    {"whatever"},
+		formNames.FormProfileId: {profileId},
+		formNames.FormBuilderId: {"selfhosted"},
+	}
+	assert.Equal(t, 403, userRequest(t, "POST", "/apps", form, basicAuth("bob", "bob-pass")).StatusCode)
+	assert.Equal(t, 403, userRequest(t, "POST", "/apps/"+bobApp.GetId()+"/resign", url.Values{}, basicAuth("bob", "bob-pass")).StatusCode)
+	// alice gets past the profile check and fails on the missing upload instead
+	assert.Equal(t, 400, userRequest(t, "POST", "/apps", form, basicAuth("alice", "alice-pass")).StatusCode)
+}
+
+func TestEnvProfiles(t *testing.T) {
+	certBase64 := base64.StdEncoding.EncodeToString(profileCert)
+	for key, val := range map[string]string{
+		"PROFILE_NAME":           "Prov",
+		"PROFILE_CERT_BASE64":    certBase64,
+		"PROFILE_CERT_PASS":      profileCertPass,
+		"PROFILE_PROV_BASE64":    base64.StdEncoding.EncodeToString(profileProv),
+		"PROFILE_0_NAME":         "Account",
+		"PROFILE_0_CERT_BASE64":  certBase64,
+		"PROFILE_0_CERT_PASS":    profileCertPass,
+		"PROFILE_0_ACCOUNT_NAME": "user@example.com",
+		"PROFILE_0_ACCOUNT_PASS": "account-pass",
+		"PROFILE_2_ID":           "explicit-id",
+		"PROFILE_2_NAME":         "Explicit",
+		"PROFILE_2_CERT_BASE64":  certBase64,
+		"PROFILE_2_CERT_PASS":    profileCertPass,
+		"PROFILE_2_PROV_BASE64":  base64.StdEncoding.EncodeToString(profileProv),
+	} {
+		t.Setenv(key, val)
+	}
+	cfgs, err := config.GetProfilesFromEnv('.')
+	assert.NoError(t, err)
+	if !assert.Len(t, cfgs, 3) {
+		return
+	}
+	assert.Equal(t, "Prov", cfgs[0].Name)
+	assert.Equal(t, "Account", cfgs[1].Name)
+	assert.Equal(t, "user@example.com", cfgs[1].AccountName)
+	assert.Equal(t, "Explicit", cfgs[2].Name)
+	assert.Equal(t, "explicit-id", cfgs[2].Id)
+
+	getIds := func(cfgs []config.EnvProfile) map[string]string {
+		profiles, err := storage.LoadEnvProfiles(cfgs)
+		assert.NoError(t, err)
+		ids := map[string]string{}
+		for id, profile := range profiles {
+			name, err := profile.GetString(storage.ProfileName)
+			assert.NoError(t, err)
+			ids[name] = id
+		}
+		return ids
+	}
+	// empty profiles are skipped
+	ids := getIds(append(cfgs, config.EnvProfile{}))
+	assert.Len(t, ids, 3)
+	assert.Equal(t, "explicit-id", ids["Explicit"])
+	assert.NotEqual(t, ids["Prov"], ids["Account"])
+	assert.Equal(t, ids, getIds(cfgs))
+
+	// a renewed prov profile keeps the same id, so it can't be imported alongside the original
+	renewedProv, err := makeTestMobileProvision(profileLeaf, profileKey, "TEST_TEAM_ID.*")
+	assert.NoError(t, err)
+	renewed := cfgs[0]
+	renewed.ProvBase64 = base64.StdEncoding.EncodeToString(renewedProv)
+	assert.Equal(t, ids["Prov"], getIds([]config.EnvProfile{renewed})["Prov"])
+	_, err = storage.LoadEnvProfiles([]config.EnvProfile{cfgs[0], renewed})
+	assert.ErrorContains(t, err, "duplicate profile id "+ids["Prov"])
+}
+
+// Makes a profile bundle with a signing certificate issued by a new CA, unlike the self-signed test profile.
+func makeTestCaBundle(t *testing.T) ([]byte, *x509.Certificate, crypto.Signer) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caBytes, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	assert.NoError(t, err)
+	ca, err := x509.ParseCertificate(caBytes)
+	assert.NoError(t, err)
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Test Leaf", OrganizationalUnit: []string{"TEST_TEAM_ID"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	leafBytes, err := x509.CreateCertificate(rand.Reader, leafTemplate, ca, leafKey.Public(), caKey)
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(leafBytes)
+	assert.NoError(t, err)
+	p12, err := pkcs12.LegacyDES.Encode([]any{leafKey}, []*x509.Certificate{leaf}, []*x509.Certificate{ca}, "ca-pass")
+	assert.NoError(t, err)
+	prov, err := makeTestMobileProvision(leaf, leafKey, "TEST_TEAM_ID.*")
+	assert.NoError(t, err)
+	return makeTestTar(t, map[string][]byte{
+		string(storage.ProfileName):     []byte("CA Profile"),
+		string(storage.ProfileCert):     p12,
+		string(storage.ProfileCertPass): []byte("ca-pass"),
+		string(storage.ProfileProv):     prov,
+	}), ca, caKey
+}
+
+func TestRevocationCheck(t *testing.T) {
+	bundle, issuer, issuerKey := makeTestCaBundle(t)
+	profile, err := storage.Profiles.Import(bytes.NewReader(bundle), "")
+	assert.NoError(t, err)
+	caProfileId := profile.GetId()
+	responseStatus := ocsp.Good
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		req, err := ocsp.ParseRequest(body)
+		if responseStatus < 0 || err != nil {
+			w.WriteHeader(500)
+			return
+		}
+		now := time.Now()
+		resp, err := ocsp.CreateResponse(issuer, issuer, ocsp.Response{
+			Status:       responseStatus,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   now,
+			NextUpdate:   now.Add(time.Hour),
+			RevokedAt:    now.Add(-time.Hour).Truncate(time.Second),
+		}, issuerKey)
+		assert.NoError(t, err)
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(resp)
+	}))
+	defer responder.Close()
+
+	storage.Revocations.Refresh(responder.URL)
+	status, ok := storage.Revocations.Get(caProfileId)
+	assert.True(t, ok)
+	assert.False(t, status.Revoked)
+	assert.WithinDuration(t, time.Now(), status.CheckedAt, time.Minute)
+
+	responseStatus = ocsp.Revoked
+	storage.Revocations.Refresh(responder.URL)
+	status, _ = storage.Revocations.Get(caProfileId)
+	assert.True(t, status.Revoked)
+	assert.Equal(t, "2", status.Serial)
+	assert.WithinDuration(t, time.Now().Add(-time.Hour), status.RevokedAt, time.Minute)
+	var apiErr apiErrorJson
+	assert.Equal(t, 400, apiRequest(t, "POST", "/apps", signParams{FileId: "whatever", ProfileId: caProfileId, BuilderId: "selfhosted"}, &apiErr))
+	assert.Contains(t, apiErr.Error.Message, "revoked")
+
+	// a failed check keeps the last known status
+	responseStatus = -1
+	storage.Revocations.Refresh(responder.URL)
+	assert.True(t, storage.Revocations.IsRevoked(caProfileId))
+
+	// imported profiles are checked right away
+	oldRevocationCheck := config.Current.RevocationCheck
+	config.Current.RevocationCheck = config.RevocationCheck{Enable: true, ResponderUrl: responder.URL}
+	t.Cleanup(func() { config.Current.RevocationCheck = oldRevocationCheck })
+	responseStatus = ocsp.Revoked
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile("bundle", "profile.bundle")
+	assert.NoError(t, err)
+	_, err = part.Write(bundle)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	resp, err := http.Post(config.Current.ServerUrl+"/profiles", w.FormDataContentType(), &body)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	newProfileId, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.True(t, storage.Revocations.IsRevoked(string(newProfileId)))
+}
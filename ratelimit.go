@@ -0,0 +1,191 @@
+package main
+
+import (
+	"SignTools/src/config"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Parses the configured trusted proxies, which are either IPs or CIDR ranges.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, errors.Errorf("invalid trusted proxy %q", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipRange, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "invalid trusted proxy %q", proxy)
+		}
+		ranges = append(ranges, ipRange)
+	}
+	return ranges, nil
+}
+
+// Returns an extractor of the client's IP, which is taken from the X-Forwarded-For header only if the request
+// came through the trusted proxies. Otherwise, anyone could avoid the rate limits by setting the header.
+// The first request with the header from an untrusted peer is logged, since it usually means that a reverse proxy
+// is missing from the trusted proxies, and all of its clients share the same rate limits and lockouts.
+func makeIpExtractor(trustedProxies []*net.IPNet) echo.IPExtractor {
+	extractIp := echo.ExtractIPDirect()
+	if len(trustedProxies) > 0 {
+		options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+		for _, ipRange := range trustedProxies {
+			options = append(options, echo.TrustIPRange(ipRange))
+		}
+		extractIp = echo.ExtractIPFromXFFHeader(options...)
+	}
+	var warnOnce sync.Once
+	return func(req *http.Request) string {
+		if req.Header.Get(echo.HeaderXForwardedFor) != "" {
+			peerIp := echo.ExtractIPDirect()(req)
+			if !isTrustedProxy(trustedProxies, net.ParseIP(peerIp)) {
+				warnOnce.Do(func() {
+					log.Warn().Str("ip", peerIp).Msg("ignoring X-Forwarded-For header from untrusted proxy, " +
+						"add the proxy to trusted_proxies if all clients share its rate limits and lockouts")
+				})
+			}
+		}
+		return extractIp(req)
+	}
+}
+
+func isTrustedProxy(trustedProxies []*net.IPNet, ip net.IP) bool {
+	for _, ipRange := range trustedProxies {
+		if ipRange.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a middleware that limits how many requests each client IP can make.
+func makeRateLimit() echo.MiddlewareFunc {
+	limit := config.Current.RateLimit
+	return middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+		Store: middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
+			Rate:      rate.Limit(float64(limit.RequestsPerMinute) / 60),
+			Burst:     int(limit.Burst),
+			ExpiresIn: 3 * time.Minute,
+		}),
+		IdentifierExtractor: func(c echo.Context) (string, error) {
+			return c.RealIP(), nil
+		},
+		DenyHandler: func(c echo.Context, ip string, err error) error {
+			log.Warn().Str("ip", ip).Str("path", c.Path()).Msg("rate limit exceeded")
+			c.Response().Header().Set("Retry-After", "60")
+			return echo.NewHTTPError(429, "Too many requests, try again later")
+		},
+	})
+}
+
+// Counts the failed authentication attempts of each client IP, and locks out the ones that make too many.
+// Only attempts with a password, API token or builder key count, so that the lockout can't be triggered by
+// simply visiting the site.
+type authLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*authFailures
+}
+
+type authFailures struct {
+	count       uint64
+	since       time.Time
+	lockedUntil time.Time
+}
+
+func newAuthLimiter() *authLimiter {
+	return &authLimiter{clients: map[string]*authFailures{}}
+}
+
+var authLimits = newAuthLimiter()
+
+// Returns how long the IP is still locked out for, or zero if it isn't.
+func (l *authLimiter) Locked(ip string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	failures, ok := l.clients[ip]
+	if !ok {
+		return 0
+	}
+	return max(time.Until(failures.lockedUntil), 0)
+}
+
+// Counts a failed attempt of the IP, and returns whether it's now locked out.
+func (l *authLimiter) Fail(ip string, maxFailures uint64, lockout time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	failures, ok := l.clients[ip]
+	if !ok || now.Sub(failures.since) > lockout {
+		failures = &authFailures{since: now}
+		l.clients[ip] = failures
+	}
+	failures.count++
+	if failures.count < maxFailures {
+		return false
+	}
+	failures.count = 0
+	failures.since = now
+	failures.lockedUntil = now.Add(lockout)
+	return true
+}
+
+// Forgets the IPs whose failures and lockout are over.
+func (l *authLimiter) Cleanup(lockout time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for ip, failures := range l.clients {
+		if now.Sub(failures.since) > lockout && now.After(failures.lockedUntil) {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+func getLockoutDuration() time.Duration {
+	return time.Duration(config.Current.RateLimit.LockoutMins) * time.Minute
+}
+
+// Returns a 429 error if the client is locked out after too many failed authentication attempts. Must be
+// called before checking the credentials, so that they can't be guessed while locked out.
+func checkAuthLockout(c echo.Context) error {
+	if !config.Current.RateLimit.Enable {
+		return nil
+	}
+	remaining := authLimits.Locked(c.RealIP())
+	if remaining <= 0 {
+		return nil
+	}
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+	return echo.NewHTTPError(429, fmt.Sprintf("Too many failed attempts, try again in %d minutes", int(remaining.Minutes())+1))
+}
+
+// Counts a failed authentication attempt of the client.
+func addAuthFailure(c echo.Context) {
+	limit := config.Current.RateLimit
+	if !limit.Enable || limit.MaxAuthFailures < 1 {
+		return
+	}
+	if authLimits.Fail(c.RealIP(), limit.MaxAuthFailures, getLockoutDuration()) {
+		log.Warn().Str("ip", c.RealIP()).Uint64("failures", limit.MaxAuthFailures).Msg("locked out after failed authentication")
+	}
+}
@@ -12,12 +12,36 @@ var IndexHtml string
 //go:embed install.gohtml
 var InstallHtml string
 
-//go:embed 2fa.html
+//go:embed 2fa.gohtml
 var TwoFactorHtml string
 
 //go:embed rename.gohtml
 var RenameHtml string
 
+//go:embed details.gohtml
+var DetailsHtml string
+
+//go:embed entitlements.gohtml
+var EntitlementsHtml string
+
+//go:embed tokens.gohtml
+var TokensHtml string
+
+//go:embed login.gohtml
+var LoginHtml string
+
+//go:embed users.gohtml
+var UsersHtml string
+
+//go:embed audit.gohtml
+var AuditHtml string
+
+//go:embed share.gohtml
+var ShareHtml string
+
+//go:embed openapi.json
+var OpenApiJson []byte
+
 //go:embed manifest.xml
 var ManifestPlist string
 
@@ -3,10 +3,13 @@ package assets
 type App struct {
 	Id                  string
 	Status              int
+	FailReason          string
 	Name                string
 	ModTime             string
 	WorkflowUrl         string
+	IconUrl             string
 	InstallUrl          string
+	ShareUrl            string
 	DownloadSignedUrl   string
 	DownloadUnsignedUrl string
 	DownloadTweaksUrl   string
@@ -14,8 +17,20 @@ type App struct {
 	ResignUrl           string
 	DeleteUrl           string
 	RenameUrl           string
+	EntitlementsUrl     string
+	DetailsUrl          string
+	Folder              string
+	Tags                []string
+	Notes               string
+	Owner               string
 	ProfileName         string
 	BundleId            string
+	OriginalBundleId    string
+	DisplayName         string
+	Version             string
+	BuildNumber         string
+	MinimumOSVersion    string
+	DeviceFamilies      string
 	TweakCount          int
 }
 
@@ -30,6 +45,7 @@ type Profile struct {
 	Id        string
 	Name      string
 	IsAccount bool
+	IsRevoked bool
 }
 
 type Builder struct {
@@ -60,23 +76,171 @@ type FormNames struct {
 }
 
 type IndexData struct {
-	Apps     []App
-	Profiles []Profile
-	Builders []Builder
+	Apps       []App
+	Profiles   []Profile
+	Builders   []Builder
+	Query      AppListQuery
+	Pagination Pagination
+	Folders    []string
+	// The logged in user, empty if authentication is disabled.
+	User      string
+	CanSign   bool
+	IsAdmin   bool
+	CsrfToken string
+	// Whether share links are enabled.
+	ShareLinks bool
 	FormNames
 }
 
+type AppListQuery struct {
+	Search  string
+	Status  string
+	Folder  string
+	Tag     string
+	Sort    string
+	Page    int
+	PerPage int
+}
+
+type Pagination struct {
+	Page      int
+	PageCount int
+	Total     int
+	PrevUrl   string
+	NextUrl   string
+}
+
 type ManifestData struct {
-	DownloadUrl string
-	BundleId    string
-	Title       string
+	DownloadUrl   string
+	IconUrl       string
+	BundleId      string
+	BundleVersion string
+	Title         string
 }
 
 type RenameData struct {
-	AppName string
+	AppName   string
+	CsrfToken string
+}
+
+type DetailsData struct {
+	AppName   string
+	Folder    string
+	Tags      string
+	Notes     string
+	Folders   []string
+	CsrfToken string
+}
+
+type ShareData struct {
+	AppName     string
+	Enabled     bool
+	ExpiryHours uint64
+	// The link that was just created.
+	Url          string
+	Expires      string
+	MaxDownloads int
+	CsrfToken    string
+}
+
+type TwoFactorData struct {
+	CsrfToken string
+}
+
+type EntitlementsData struct {
+	AppName  string
+	IsSigned bool
+	Binaries []BinaryEntitlements
+}
+
+type BinaryEntitlements struct {
+	Path         string
+	Entitlements []Entitlement
+}
+
+type Entitlement struct {
+	Key      string
+	Unsigned string
+	Signed   string
+	Status   string
 }
 
 type InstallData struct {
 	ManifestUrl string
 	AppName     string
+	IconUrl     string
+}
+
+type TokensData struct {
+	Tokens []Token
+	Scopes []string
+	// The secret of a token that was just created.
+	NewToken     string
+	NewTokenName string
+	CsrfToken    string
+}
+
+type Token struct {
+	Name      string
+	Scope     string
+	User      string
+	Created   string
+	RevokeUrl string
+}
+
+type LoginData struct {
+	Username string
+	// Where to go after logging in.
+	Next  string
+	Error string
+	// Whether to show the button to log in with OIDC.
+	Oidc      bool
+	CsrfToken string
+}
+
+type UsersData struct {
+	Users       []User
+	Roles       []string
+	CurrentUser string
+	CsrfToken   string
+}
+
+type User struct {
+	Id        string
+	Name      string
+	Role      string
+	External  bool
+	UpdateUrl string
+	DeleteUrl string
+}
+
+type AuditData struct {
+	Entries []AuditEntry
+	// The actions and actors that appear in the log, to filter by.
+	Actions    []string
+	Actors     []string
+	Filter     AuditFilter
+	Pagination Pagination
+	ExportUrl  string
+}
+
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Id     string
+	Result string
+}
+
+type AuditEntry struct {
+	Time      string
+	Actor     string
+	Action    string
+	AppId     string
+	ProfileId string
+	JobId     string
+	Target    string
+	Ip        string
+	Status    int
+	Failed    bool
+	Error     string
 }
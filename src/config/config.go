@@ -3,7 +3,9 @@ package config
 import (
 	"SignTools/src/builders"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
+	"fmt"
 	"github.com/ViRb3/koanf-extra/env"
 	"github.com/knadh/koanf"
 	kyaml "github.com/knadh/koanf/parsers/yaml"
@@ -14,13 +16,64 @@ import (
 	"gopkg.in/yaml.v3"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 )
 
+// Deprecated: only used to create the first users, see storage.Users.
 type BasicAuth struct {
-	Enable   bool   `yaml:"enable"`
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
+	Enable   bool              `yaml:"enable"`
+	Username string            `yaml:"username"`
+	Password string            `yaml:"password"`
+	Users    map[string]string `yaml:"users"`
+}
+
+// Logging in with an OpenID Connect identity provider. Users are created on their first login, and their role
+// is updated from their groups on every login.
+type OIDC struct {
+	Enable       bool     `yaml:"enable"`
+	IssuerUrl    string   `yaml:"issuer_url"`
+	ClientId     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	Scopes       []string `yaml:"scopes"`
+	// The ID token claim used as the username.
+	UsernameClaim string `yaml:"username_claim"`
+	// The ID token claim with the user's groups, either a string or a list of strings.
+	GroupsClaim  string   `yaml:"groups_claim"`
+	AdminGroups  []string `yaml:"admin_groups"`
+	SignerGroups []string `yaml:"signer_groups"`
+	ViewerGroups []string `yaml:"viewer_groups"`
+	// The role of users that are in none of the groups, empty to deny them.
+	DefaultRole string `yaml:"default_role"`
+}
+
+type RevocationCheck struct {
+	Enable              bool   `yaml:"enable"`
+	RefreshIntervalMins uint64 `yaml:"refresh_interval_mins"`
+	// Overrides the OCSP responder specified in the certificates, e.g. for testing.
+	ResponderUrl string `yaml:"responder_url"`
+}
+
+// Signed links that let anyone install an app until they expire.
+type ShareLinks struct {
+	// Requires a share link or a login to install and download apps.
+	Enable bool `yaml:"enable"`
+	// How long links are valid for if no expiry is chosen.
+	DefaultExpiryHours uint64 `yaml:"default_expiry_hours"`
+}
+
+// Limits how often each client IP can make requests and fail to authenticate.
+type RateLimit struct {
+	Enable            bool   `yaml:"enable"`
+	RequestsPerMinute uint64 `yaml:"requests_per_minute"`
+	// How many requests can be made at once before the limit applies.
+	Burst uint64 `yaml:"burst"`
+	// Failed logins, API tokens or builder keys after which the IP is locked out.
+	MaxAuthFailures uint64 `yaml:"max_auth_failures"`
+	// How long failures are counted for, and how long the lockout lasts.
+	LockoutMins uint64 `yaml:"lockout_mins"`
 }
 
 type Builder struct {
@@ -44,13 +97,22 @@ func (b *Builder) MakeEnabled() map[string]builders.Builder {
 }
 
 type File struct {
-	Builder             Builder   `yaml:"builder"`
-	ServerUrl           string    `yaml:"server_url"`
-	RedirectHttps       bool      `yaml:"redirect_https"`
-	SaveDir             string    `yaml:"save_dir"`
-	CleanupIntervalMins uint64    `yaml:"cleanup_interval_mins"`
-	SignTimeoutMins     uint64    `yaml:"sign_timeout_mins"`
-	BasicAuth           BasicAuth `yaml:"basic_auth"`
+	Builder             Builder         `yaml:"builder"`
+	ServerUrl           string          `yaml:"server_url"`
+	RedirectHttps       bool            `yaml:"redirect_https"`
+	SaveDir             string          `yaml:"save_dir"`
+	CleanupIntervalMins uint64          `yaml:"cleanup_interval_mins"`
+	SignTimeoutMins     uint64          `yaml:"sign_timeout_mins"`
+	BasicAuth           BasicAuth       `yaml:"basic_auth"`
+	OIDC                OIDC            `yaml:"oidc"`
+	MasterKeyFile       string          `yaml:"master_key_file"`
+	RevocationCheck     RevocationCheck `yaml:"revocation_check"`
+	ShareLinks          ShareLinks      `yaml:"share_links"`
+	RateLimit           RateLimit       `yaml:"rate_limit"`
+	// IPs or CIDR ranges of the reverse proxies whose X-Forwarded-For header is trusted.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// Also serves the resign and delete actions as GET routes, like older versions did.
+	LegacyGetActions bool `yaml:"legacy_get_actions"`
 }
 
 func createDefaultFile() *File {
@@ -87,17 +149,51 @@ func createDefaultFile() *File {
 			Enable:   false,
 			Username: "admin",
 			Password: "admin",
+			Users:    map[string]string{},
+		},
+		OIDC: OIDC{
+			Enable:        false,
+			IssuerUrl:     "https://accounts.example.com",
+			ClientId:      "signtools",
+			ClientSecret:  "",
+			Scopes:        []string{"openid", "profile", "email"},
+			UsernameClaim: "preferred_username",
+			GroupsClaim:   "groups",
+			AdminGroups:   []string{},
+			SignerGroups:  []string{},
+			ViewerGroups:  []string{},
+			DefaultRole:   "",
+		},
+		RevocationCheck: RevocationCheck{
+			Enable:              false,
+			RefreshIntervalMins: 60,
+			ResponderUrl:        "",
+		},
+		ShareLinks: ShareLinks{
+			Enable:             false,
+			DefaultExpiryHours: 7 * 24,
 		},
+		RateLimit: RateLimit{
+			Enable:            true,
+			RequestsPerMinute: 600,
+			Burst:             200,
+			MaxAuthFailures:   10,
+			LockoutMins:       15,
+		},
+		TrustedProxies: []string{"127.0.0.1", "::1"},
 	}
 }
 
 type EnvProfile struct {
+	Id          string `yaml:"id"`
 	Name        string `yaml:"name"`
 	ProvBase64  string `yaml:"prov_base64"`
 	CertPass    string `yaml:"cert_pass"`
 	CertBase64  string `yaml:"cert_base64"`
 	AccountName string `yaml:"account_name"`
 	AccountPass string `yaml:"account_pass"`
+	// Comma-separated list of basic auth users allowed to use this profile, empty for everyone.
+	AllowedUsers string `yaml:"allowed_users"`
 }
 
 type ProfileBox struct {
@@ -108,7 +204,9 @@ type Config struct {
 	Builder    map[string]builders.Builder
 	BuilderKey string
 	*File
-	EnvProfile *EnvProfile
+	EnvProfiles []EnvProfile
+	// Used to encrypt profile secrets at rest, nil if not configured.
+	MasterKey []byte
 }
 
 var Current Config
@@ -131,28 +229,109 @@ func Load(fileName string) {
 	if _, err := rand.Read(builderKey); err != nil {
 		log.Fatal().Err(err).Msg("init: error generating builder key")
 	}
-	profile, err := getProfileFromEnv(mapDelim)
+	profiles, err := GetProfilesFromEnv(mapDelim)
+	if err != nil {
+		log.Fatal().Err(err).Msg("init: error checking for signing profiles from envvars")
+	}
+	if fileConfig.RevocationCheck.Enable && fileConfig.RevocationCheck.RefreshIntervalMins < 1 {
+		log.Fatal().Msg("init: revocation_check.refresh_interval_mins must be at least 1")
+	}
+	masterKey, err := getMasterKey(fileConfig.MasterKeyFile)
 	if err != nil {
-		log.Fatal().Err(err).Msg("init: error checking for signing profile from envvars")
+		log.Fatal().Err(err).Msg("init: error reading master key")
 	}
 	Current = Config{
-		Builder:    builderMap,
-		BuilderKey: hex.EncodeToString(builderKey),
-		File:       fileConfig,
-		EnvProfile: profile,
+		Builder:     builderMap,
+		BuilderKey:  hex.EncodeToString(builderKey),
+		File:        fileConfig,
+		EnvProfiles: profiles,
+		MasterKey:   masterKey,
 	}
 }
 
-// Loads a single signing profile entirely from environment variables.
+const masterKeyEnv = "MASTER_KEY"
+
+// Reads the base64-encoded master key from the MASTER_KEY envvar, or from the key file if the envvar is not set.
+// Returns nil if neither is set.
+func getMasterKey(keyFile string) ([]byte, error) {
+	if value, ok := os.LookupEnv(masterKeyEnv); ok {
+		key, err := decodeMasterKey(value)
+		if err != nil {
+			return nil, errors.WithMessage(err, "decode "+masterKeyEnv)
+		}
+		return key, nil
+	}
+	if keyFile == "" {
+		return nil, nil
+	}
+	return ReadMasterKeyFile(keyFile)
+}
+
+func ReadMasterKeyFile(keyFile string) ([]byte, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.WithMessage(err, "read key file")
+	}
+	key, err := decodeMasterKey(string(data))
+	if err != nil {
+		return nil, errors.WithMessage(err, "decode key file")
+	}
+	return key, nil
+}
+
+func decodeMasterKey(value string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+}
+
+var envProfileIndexRegex = regexp.MustCompile(`^PROFILE_(\d+)_`)
+
+// Loads signing profiles entirely from environment variables.
 // Intended for use with Heroku without persistent storage.
-func getProfileFromEnv(mapDelim rune) (*EnvProfile, error) {
+// A single profile can be set with PROFILE_*, and any number of additional profiles with PROFILE_0_*, PROFILE_1_*, etc.
+// Profiles with no variables set are returned empty.
+func GetProfilesFromEnv(mapDelim rune) ([]EnvProfile, error) {
+	profile, err := getProfileFromEnv(mapDelim, "", func(s string) string {
+		return strings.ToLower(s)
+	})
+	if err != nil {
+		return nil, errors.WithMessage(err, "unindexed")
+	}
+	profiles := []EnvProfile{*profile}
+	indexMap := map[int]bool{}
+	for _, pair := range os.Environ() {
+		if match := envProfileIndexRegex.FindStringSubmatch(pair); match != nil {
+			index, err := strconv.Atoi(match[1])
+			if err != nil {
+				return nil, errors.WithMessagef(err, "parse index %s", match[1])
+			}
+			indexMap[index] = true
+		}
+	}
+	var indexes []int
+	for index := range indexMap {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		prefix := fmt.Sprintf("PROFILE_%d_", index)
+		profile, err := getProfileFromEnv(mapDelim, prefix, func(s string) string {
+			// PROFILE_0_CERT_PASS -> profile_cert_pass, so it maps onto ProfileBox
+			return "profile_" + strings.ToLower(strings.TrimPrefix(s, prefix))
+		})
+		if err != nil {
+			return nil, errors.WithMessagef(err, "index %d", index)
+		}
+		profiles = append(profiles, *profile)
+	}
+	return profiles, nil
+}
+
+func getProfileFromEnv(mapDelim rune, prefix string, cb func(s string) string) (*EnvProfile, error) {
 	k := koanf.New(string(mapDelim))
 	if err := k.Load(structs.Provider(ProfileBox{}, "yaml"), nil); err != nil {
 		return nil, errors.WithMessage(err, "load default")
 	}
-	if err := k.Load(env.Provider(k, "", "_", func(s string) string {
-		return strings.ToLower(s)
-	}), nil); err != nil {
+	if err := k.Load(env.Provider(k, prefix, "_", cb), nil); err != nil {
 		return nil, errors.WithMessage(err, "load envvars")
 	}
 	profile := EnvProfile{}
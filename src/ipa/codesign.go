@@ -0,0 +1,192 @@
+package ipa
+
+import (
+	"debug/macho"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"howett.net/plist"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const loadCmdCodeSignature macho.LoadCmd = 0x1d
+
+// https://github.com/apple-oss-distributions/Security/blob/main/OSX/libsecurity_codesigning/lib/CSCommon.h
+const (
+	csMagicEmbeddedSignature    = 0xfade0cc0
+	csMagicCodeDirectory        = 0xfade0c02
+	csMagicEmbeddedEntitlements = 0xfade7171
+	csMagicBlobWrapper          = 0xfade0b01
+	csSlotCodeDirectory         = 0
+	csSlotEntitlements          = 5
+	csSlotSignature             = 0x10000
+	// Size of a blob's magic and length.
+	csBlobHeaderSize = 8
+)
+
+var csSlotMagics = map[uint32]uint32{
+	csSlotCodeDirectory: csMagicCodeDirectory,
+	csSlotEntitlements:  csMagicEmbeddedEntitlements,
+	csSlotSignature:     csMagicBlobWrapper,
+}
+
+// Returns the entitlements embedded in the code signature of each executable of the app, keyed by
+// the executable's path relative to the app bundle, e.g. "Example" or "PlugIns/Widget.appex/Widget".
+// Executables without a signature or entitlements have a nil value.
+func (a *Archive) Entitlements() (map[string]map[string]any, error) {
+	executables, err := a.executables()
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]map[string]any{}
+	for _, executablePath := range executables {
+		blobs, err := a.readCodeSignature(executablePath)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "parse %s", executablePath)
+		}
+		var entitlements map[string]any
+		if blob, ok := blobs[csSlotEntitlements]; ok {
+			if _, err := plist.Unmarshal(blob[csBlobHeaderSize:], &entitlements); err != nil {
+				return nil, errors.WithMessagef(err, "parse entitlements of %s", executablePath)
+			}
+		}
+		result[strings.TrimPrefix(executablePath, a.AppDir+"/")] = entitlements
+	}
+	return result, nil
+}
+
+// Code directories hold a hash of each page of the executable, so this allows executables of several GB.
+const maxCodeSignatureSize = 64 * 1024 * 1024
+
+// Returns the blobs in the code signature superblob of the executable, including their headers, keyed by slot.
+// For fat binaries, the signature of the first architecture is used, since they are all signed together.
+// Only the load commands and the signature are read.
+func (a *Archive) readCodeSignature(executablePath string) (map[uint32][]byte, error) {
+	file, err := openFile(a.zipReader, executablePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	slices, err := readMachOSlices(file)
+	if err != nil {
+		return nil, err
+	}
+	return readSuperBlob(file, slices[0])
+}
+
+func readSuperBlob(file *fileReader, slice machOSlice) (map[uint32][]byte, error) {
+	blobs := map[uint32][]byte{}
+	var superBlob []byte
+	for _, raw := range slice.loads {
+		// cmd, cmdsize, dataoff, datasize
+		if len(raw) < 16 || macho.LoadCmd(slice.byteOrder.Uint32(raw[0:4])) != loadCmdCodeSignature {
+			continue
+		}
+		offset, size := uint64(slice.byteOrder.Uint32(raw[8:12])), uint64(slice.byteOrder.Uint32(raw[12:16]))
+		if offset+size > slice.size {
+			return nil, errors.New("code signature out of bounds")
+		} else if size > maxCodeSignatureSize {
+			return nil, errors.New("code signature is too large")
+		}
+		superBlob = make([]byte, size)
+		if _, err := file.ReadAt(superBlob, int64(slice.offset+offset)); err != nil {
+			return nil, errors.WithMessage(err, "read code signature")
+		}
+		break
+	}
+	if superBlob == nil {
+		return blobs, nil
+	}
+	// The code signature is always big endian: magic, length, count, then count * (type, offset)
+	if len(superBlob) < 12 || binary.BigEndian.Uint32(superBlob[0:4]) != csMagicEmbeddedSignature {
+		return nil, errors.New("bad code signature magic")
+	}
+	count := binary.BigEndian.Uint32(superBlob[8:12])
+	if uint64(len(superBlob)) < 12+uint64(count)*8 {
+		return nil, errors.New("code signature is truncated")
+	}
+	for i := uint32(0); i < count; i++ {
+		index := superBlob[12+i*8:]
+		slot, offset := binary.BigEndian.Uint32(index[0:4]), uint64(binary.BigEndian.Uint32(index[4:8]))
+		// magic, length, then the blob's contents
+		if offset+csBlobHeaderSize > uint64(len(superBlob)) {
+			return nil, errors.Errorf("blob %d out of bounds", slot)
+		}
+		length := uint64(binary.BigEndian.Uint32(superBlob[offset+4 : offset+8]))
+		if length < csBlobHeaderSize || offset+length > uint64(len(superBlob)) {
+			return nil, errors.Errorf("blob %d out of bounds", slot)
+		}
+		if magic, ok := csSlotMagics[slot]; ok && binary.BigEndian.Uint32(superBlob[offset:offset+4]) != magic {
+			return nil, errors.Errorf("bad magic for blob %d", slot)
+		}
+		blobs[slot] = superBlob[offset : offset+length]
+	}
+	return blobs, nil
+}
+
+const (
+	EntitlementAdded     = "added"
+	EntitlementRemoved   = "removed"
+	EntitlementChanged   = "changed"
+	EntitlementUnchanged = "unchanged"
+	// The app hasn't been signed yet.
+	EntitlementUnknown = "unknown"
+)
+
+type EntitlementDiff struct {
+	Key      string `json:"key"`
+	Unsigned any    `json:"unsigned,omitempty"`
+	Signed   any    `json:"signed,omitempty"`
+	Status   string `json:"status"`
+}
+
+type BinaryEntitlementsDiff struct {
+	Binary  string            `json:"binary"`
+	Changes []EntitlementDiff `json:"changes"`
+}
+
+// Compares the entitlements of each binary before and after signing, as returned by Archive.Entitlements.
+// Signed may be nil if the app hasn't been signed yet.
+func DiffEntitlements(unsigned map[string]map[string]any, signed map[string]map[string]any) []BinaryEntitlementsDiff {
+	binaries := sortedKeys(unsigned, signed)
+	result := make([]BinaryEntitlementsDiff, 0, len(binaries))
+	for _, binaryPath := range binaries {
+		before, after := unsigned[binaryPath], signed[binaryPath]
+		diff := BinaryEntitlementsDiff{Binary: binaryPath, Changes: []EntitlementDiff{}}
+		for _, key := range sortedKeys(before, after) {
+			beforeValue, inBefore := before[key]
+			afterValue, inAfter := after[key]
+			change := EntitlementDiff{Key: key, Unsigned: beforeValue, Signed: afterValue}
+			if signed == nil {
+				change.Status = EntitlementUnknown
+			} else if !inBefore {
+				change.Status = EntitlementAdded
+			} else if !inAfter {
+				change.Status = EntitlementRemoved
+			} else if !reflect.DeepEqual(beforeValue, afterValue) {
+				change.Status = EntitlementChanged
+			} else {
+				change.Status = EntitlementUnchanged
+			}
+			diff.Changes = append(diff.Changes, change)
+		}
+		result = append(result, diff)
+	}
+	return result
+}
+
+func sortedKeys[T any](maps ...map[string]T) []string {
+	keySet := map[string]bool{}
+	for _, m := range maps {
+		for key := range m {
+			keySet[key] = true
+		}
+	}
+	keys := make([]string, 0, len(keySet))
+	for key := range keySet {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
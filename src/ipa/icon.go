@@ -0,0 +1,252 @@
+package ipa
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"image"
+	"image/png"
+	"io"
+	"path"
+	"strings"
+)
+
+var ErrNoIcon = errors.New("no icon found")
+
+// Larger than any real icon. Limits the memory used to decode crushed PNGs, whose size comes from the upload.
+const maxIconDimension = 4096
+
+// Returns the largest primary icon of the app as a standard PNG.
+func (a *Archive) Icon() ([]byte, error) {
+	var baseNames []string
+	for _, icons := range []bundleIcons{a.info.CFBundleIcons, a.info.CFBundleIconsIpad} {
+		baseNames = append(baseNames, icons.CFBundlePrimaryIcon.CFBundleIconFiles...)
+		if name := icons.CFBundlePrimaryIcon.CFBundleIconName; name != "" {
+			baseNames = append(baseNames, name)
+		}
+	}
+	baseNames = append(baseNames, a.info.CFBundleIconFiles...)
+	if a.info.CFBundleIconFile != "" {
+		baseNames = append(baseNames, a.info.CFBundleIconFile)
+	}
+	var bestData []byte
+	bestSize := 0
+	for _, file := range a.zipReader.File {
+		dir, name := path.Split(file.Name)
+		if path.Clean(dir) != a.AppDir || !isIconFile(name, baseNames) {
+			continue
+		}
+		data, err := ReadFile(a.zipReader, file.Name, maxIconSize)
+		if err != nil {
+			return nil, err
+		}
+		width, height, err := pngSize(data)
+		if err != nil {
+			continue
+		}
+		if width*height > bestSize {
+			bestSize = width * height
+			bestData = data
+		}
+	}
+	if bestData == nil {
+		return nil, ErrNoIcon
+	}
+	return UncrushPNG(bestData)
+}
+
+// Matches the icon's base name with any size and scale suffix, e.g. AppIcon60x60 -> AppIcon60x60@2x~ipad.png.
+func isIconFile(name string, baseNames []string) bool {
+	if !strings.HasSuffix(strings.ToLower(name), ".png") {
+		return false
+	}
+	for _, baseName := range baseNames {
+		baseName = strings.TrimSuffix(baseName, path.Ext(baseName))
+		if baseName != "" && strings.HasPrefix(name, baseName) {
+			return true
+		}
+	}
+	return false
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+type pngChunk struct {
+	kind string
+	data []byte
+}
+
+func readPNGChunks(data []byte) ([]pngChunk, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errors.New("not a png")
+	}
+	var chunks []pngChunk
+	reader := bytes.NewReader(data[len(pngSignature):])
+	for {
+		var length uint32
+		if err := binary.Read(reader, binary.BigEndian, &length); err == io.EOF {
+			return chunks, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if int64(length) > int64(reader.Len()) {
+			return nil, errors.New("bad chunk length")
+		}
+		body := make([]byte, 4+length+4)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, pngChunk{kind: string(body[:4]), data: body[4 : 4+length]})
+		if string(body[:4]) == "IEND" {
+			return chunks, nil
+		}
+	}
+}
+
+func pngSize(data []byte) (int, int, error) {
+	chunks, err := readPNGChunks(data)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, chunk := range chunks {
+		if chunk.kind == "IHDR" && len(chunk.data) >= 8 {
+			return int(binary.BigEndian.Uint32(chunk.data[0:4])), int(binary.BigEndian.Uint32(chunk.data[4:8])), nil
+		}
+	}
+	return 0, 0, errors.New("no IHDR chunk")
+}
+
+// Converts Apple's CgBI "crushed" PNGs into standard PNGs. Standard PNGs are returned unchanged.
+// Crushed PNGs store raw deflate data without a zlib header, and premultiplied BGRA pixels.
+func UncrushPNG(data []byte) ([]byte, error) {
+	chunks, err := readPNGChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) < 1 || chunks[0].kind != "CgBI" {
+		return data, nil
+	}
+	var width, height int
+	var compressed bytes.Buffer
+	for _, chunk := range chunks {
+		switch chunk.kind {
+		case "IHDR":
+			if len(chunk.data) < 13 {
+				return nil, errors.New("bad IHDR chunk")
+			}
+			width = int(binary.BigEndian.Uint32(chunk.data[0:4]))
+			height = int(binary.BigEndian.Uint32(chunk.data[4:8]))
+			bitDepth, colorType, interlace := chunk.data[8], chunk.data[9], chunk.data[12]
+			// RGBA, 8 bits per channel, no interlacing
+			if bitDepth != 8 || colorType != 6 || interlace != 0 {
+				return nil, errors.Errorf("unsupported crushed png format: depth %d, color %d, interlace %d",
+					bitDepth, colorType, interlace)
+			}
+		case "IDAT":
+			compressed.Write(chunk.data)
+		}
+	}
+	if width < 1 || height < 1 {
+		return nil, errors.New("bad png size")
+	}
+	if width > maxIconDimension || height > maxIconDimension {
+		return nil, errors.Errorf("png is too large: %dx%d", width, height)
+	}
+	const bpp = 4
+	stride := width * bpp
+	raw, err := io.ReadAll(io.LimitReader(flate.NewReader(&compressed), int64((stride+1)*height)))
+	if err != nil {
+		return nil, errors.WithMessage(err, "inflate")
+	}
+	if len(raw) != (stride+1)*height {
+		return nil, errors.New("bad image data size")
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	prev := make([]byte, stride)
+	for y := 0; y < height; y++ {
+		line := raw[y*(stride+1) : (y+1)*(stride+1)]
+		cur := line[1:]
+		if err := unfilterScanline(line[0], cur, prev, bpp); err != nil {
+			return nil, err
+		}
+		for x := 0; x < width; x++ {
+			b, g, r, alpha := cur[x*bpp], cur[x*bpp+1], cur[x*bpp+2], cur[x*bpp+3]
+			offset := y*img.Stride + x*bpp
+			img.Pix[offset] = unpremultiply(r, alpha)
+			img.Pix[offset+1] = unpremultiply(g, alpha)
+			img.Pix[offset+2] = unpremultiply(b, alpha)
+			img.Pix[offset+3] = alpha
+		}
+		prev = cur
+	}
+	var result bytes.Buffer
+	if err := png.Encode(&result, img); err != nil {
+		return nil, errors.WithMessage(err, "encode png")
+	}
+	return result.Bytes(), nil
+}
+
+func unpremultiply(value byte, alpha byte) byte {
+	if alpha == 0 {
+		return 0
+	}
+	result := int(value) * 255 / int(alpha)
+	if result > 255 {
+		return 255
+	}
+	return byte(result)
+}
+
+// https://www.w3.org/TR/png/#9Filters
+func unfilterScanline(filter byte, cur []byte, prev []byte, bpp int) error {
+	switch filter {
+	case 0:
+	case 1:
+		for i := bpp; i < len(cur); i++ {
+			cur[i] += cur[i-bpp]
+		}
+	case 2:
+		for i := range cur {
+			cur[i] += prev[i]
+		}
+	case 3:
+		for i := range cur {
+			var left byte
+			if i >= bpp {
+				left = cur[i-bpp]
+			}
+			cur[i] += byte((int(left) + int(prev[i])) / 2)
+		}
+	case 4:
+		for i := range cur {
+			var left, upLeft byte
+			if i >= bpp {
+				left = cur[i-bpp]
+				upLeft = prev[i-bpp]
+			}
+			cur[i] += paeth(left, prev[i], upLeft)
+		}
+	default:
+		return errors.Errorf("unknown filter type %d", filter)
+	}
+	return nil
+}
+
+func paeth(a byte, b byte, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	} else if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,247 @@
+package ipa
+
+import (
+	"archive/zip"
+	"fmt"
+	"github.com/pkg/errors"
+	"howett.net/plist"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const payloadDir = "Payload"
+
+// The metadata of an app, parsed from its Info.plist.
+type Metadata struct {
+	BundleId         string `json:"bundle_id"`
+	DisplayName      string `json:"display_name"`
+	Version          string `json:"version"`
+	BuildNumber      string `json:"build_number"`
+	MinimumOSVersion string `json:"minimum_os_version"`
+	DeviceFamilies   []int  `json:"device_families"`
+}
+
+var deviceFamilyNames = map[int]string{
+	1: "iPhone",
+	2: "iPad",
+	3: "Apple TV",
+	4: "Apple Watch",
+	6: "Mac",
+	7: "Apple Vision",
+}
+
+func (m *Metadata) DeviceFamilyNames() []string {
+	var names []string
+	for _, family := range m.DeviceFamilies {
+		if name, ok := deviceFamilyNames[family]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, fmt.Sprintf("Unknown (%d)", family))
+		}
+	}
+	return names
+}
+
+// Only the keys that are needed, the rest are ignored when decoding.
+type infoPlist struct {
+	CFBundleIdentifier         string `plist:"CFBundleIdentifier"`
+	CFBundleDisplayName        string `plist:"CFBundleDisplayName"`
+	CFBundleName               string `plist:"CFBundleName"`
+	CFBundleShortVersionString string `plist:"CFBundleShortVersionString"`
+	CFBundleVersion            string `plist:"CFBundleVersion"`
+	CFBundleExecutable         string `plist:"CFBundleExecutable"`
+	MinimumOSVersion           string `plist:"MinimumOSVersion"`
+	// Usually integers, but some apps use strings.
+	UIDeviceFamily    []any       `plist:"UIDeviceFamily"`
+	CFBundleIcons     bundleIcons `plist:"CFBundleIcons"`
+	CFBundleIconsIpad bundleIcons `plist:"CFBundleIcons~ipad"`
+	CFBundleIconFiles []string    `plist:"CFBundleIconFiles"`
+	CFBundleIconFile  string      `plist:"CFBundleIconFile"`
+}
+
+type bundleIcons struct {
+	CFBundlePrimaryIcon struct {
+		CFBundleIconFiles []string `plist:"CFBundleIconFiles"`
+		CFBundleIconName  string   `plist:"CFBundleIconName"`
+	} `plist:"CFBundlePrimaryIcon"`
+}
+
+// An opened IPA archive along with its main app bundle.
+type Archive struct {
+	zipReader *zip.Reader
+	// Path of the main app bundle inside the archive, e.g. "Payload/Example.app".
+	AppDir string
+	info   *infoPlist
+}
+
+// Opens the IPA archive and parses its main Info.plist. Both binary and XML plists are supported.
+func Open(reader io.ReaderAt, size int64) (*Archive, error) {
+	zipReader, err := zip.NewReader(reader, size)
+	if err != nil {
+		return nil, errors.WithMessage(err, "open zip")
+	}
+	appDir, err := FindAppDir(zipReader)
+	if err != nil {
+		return nil, err
+	}
+	info, err := readInfoPlist(zipReader, appDir)
+	if err != nil {
+		return nil, err
+	}
+	return &Archive{zipReader: zipReader, AppDir: appDir, info: info}, nil
+}
+
+// Parses the metadata of the IPA archive.
+func ReadMetadata(reader io.ReaderAt, size int64) (*Metadata, error) {
+	archive, err := Open(reader, size)
+	if err != nil {
+		return nil, err
+	}
+	return archive.Metadata()
+}
+
+func (a *Archive) Metadata() (*Metadata, error) {
+	metadata := Metadata{
+		BundleId:         a.info.CFBundleIdentifier,
+		DisplayName:      a.info.CFBundleDisplayName,
+		Version:          a.info.CFBundleShortVersionString,
+		BuildNumber:      a.info.CFBundleVersion,
+		MinimumOSVersion: a.info.MinimumOSVersion,
+	}
+	if metadata.DisplayName == "" {
+		metadata.DisplayName = a.info.CFBundleName
+	}
+	for _, value := range a.info.UIDeviceFamily {
+		family, err := parseDeviceFamily(value)
+		if err != nil {
+			return nil, errors.WithMessage(err, "parse UIDeviceFamily")
+		}
+		metadata.DeviceFamilies = append(metadata.DeviceFamilies, family)
+	}
+	return &metadata, nil
+}
+
+func parseDeviceFamily(value any) (int, error) {
+	switch v := value.(type) {
+	case uint64:
+		return int(v), nil
+	case int64:
+		return int(v), nil
+	case string:
+		return strconv.Atoi(strings.TrimSpace(v))
+	default:
+		return 0, errors.Errorf("unknown type %T", value)
+	}
+}
+
+// Returns the path of the main app bundle inside the archive, e.g. "Payload/Example.app".
+func FindAppDir(zipReader *zip.Reader) (string, error) {
+	for _, file := range zipReader.File {
+		// Payload/Example.app/Info.plist
+		parts := strings.Split(strings.TrimSuffix(file.Name, "/"), "/")
+		if len(parts) >= 2 && parts[0] == payloadDir && strings.HasSuffix(parts[1], ".app") {
+			return path.Join(parts[0], parts[1]), nil
+		}
+	}
+	return "", errors.New("no app bundle found in " + payloadDir)
+}
+
+func readInfoPlist(zipReader *zip.Reader, bundleDir string) (*infoPlist, error) {
+	data, err := ReadFile(zipReader, path.Join(bundleDir, "Info.plist"), maxPlistSize)
+	if err != nil {
+		return nil, err
+	}
+	info := infoPlist{}
+	if _, err := plist.Unmarshal(data, &info); err != nil {
+		return nil, errors.WithMessage(err, "parse Info.plist")
+	}
+	return &info, nil
+}
+
+// Plists, provisioning profiles and icons are read whole into memory, so the size that an archive claims
+// for them is limited. Executables are only read in parts, see fileReader.
+const (
+	maxPlistSize = 4 * 1024 * 1024
+	maxIconSize  = 8 * 1024 * 1024
+)
+
+// Reads a file from the archive, returning an error if it doesn't exist or is larger than maxSize.
+func ReadFile(zipReader *zip.Reader, name string, maxSize uint64) ([]byte, error) {
+	for _, file := range zipReader.File {
+		if file.Name != name {
+			continue
+		}
+		if file.UncompressedSize64 > maxSize {
+			return nil, errors.Errorf("%s is too large", name)
+		}
+		reader, err := file.Open()
+		if err != nil {
+			return nil, errors.WithMessagef(err, "open %s", name)
+		}
+		defer reader.Close()
+		data, err := io.ReadAll(io.LimitReader(reader, int64(file.UncompressedSize64)))
+		if err != nil {
+			return nil, errors.WithMessagef(err, "read %s", name)
+		}
+		return data, nil
+	}
+	return nil, errors.Errorf("%s not found", name)
+}
+
+// Gives random access to a file in the archive without reading it whole, for executables which can be
+// too large for that. Compressed files can only be read forward, so reading backwards reopens the file.
+type fileReader struct {
+	file   *zip.File
+	reader io.ReadCloser
+	offset int64
+}
+
+// Opens a file in the archive, returning an error if it doesn't exist.
+func openFile(zipReader *zip.Reader, name string) (*fileReader, error) {
+	for _, file := range zipReader.File {
+		if file.Name == name {
+			return &fileReader{file: file}, nil
+		}
+	}
+	return nil, errors.Errorf("%s not found", name)
+}
+
+// The size that the archive claims, reading past it fails.
+func (r *fileReader) Size() uint64 {
+	return r.file.UncompressedSize64
+}
+
+func (r *fileReader) ReadAt(p []byte, offset int64) (int, error) {
+	if r.reader == nil || offset < r.offset {
+		if err := r.Close(); err != nil {
+			return 0, err
+		}
+		reader, err := r.file.Open()
+		if err != nil {
+			return 0, errors.WithMessagef(err, "open %s", r.file.Name)
+		}
+		r.reader, r.offset = reader, 0
+	}
+	skipped, err := io.CopyN(io.Discard, r.reader, offset-r.offset)
+	r.offset += skipped
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(r.reader, p)
+	r.offset += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *fileReader) Close() error {
+	if r.reader == nil {
+		return nil
+	}
+	err := r.reader.Close()
+	r.reader = nil
+	return err
+}
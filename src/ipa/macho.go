@@ -0,0 +1,206 @@
+package ipa
+
+import (
+	"debug/macho"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Not defined by debug/macho.
+const (
+	loadCmdEncryptionInfo   macho.LoadCmd = 0x21
+	loadCmdEncryptionInfo64 macho.LoadCmd = 0x2c
+)
+
+// Returns the paths of the executables of the app and its nested bundles (extensions, watch apps)
+// which are still FairPlay encrypted. Such apps can be signed, but will crash on launch.
+func (a *Archive) EncryptedBinaries() ([]string, error) {
+	executables, err := a.executables()
+	if err != nil {
+		return nil, err
+	}
+	var encrypted []string
+	for _, executablePath := range executables {
+		isEncrypted, err := a.isEncrypted(executablePath)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "parse %s", executablePath)
+		}
+		if isEncrypted {
+			encrypted = append(encrypted, executablePath)
+		}
+	}
+	return encrypted, nil
+}
+
+// A fat (universal) binary is considered encrypted if any of its architectures is.
+func (a *Archive) isEncrypted(executablePath string) (bool, error) {
+	file, err := openFile(a.zipReader, executablePath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	slices, err := readMachOSlices(file)
+	if err != nil {
+		return false, err
+	}
+	for _, slice := range slices {
+		if slice.hasCryptId() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Returns the paths of the main executables of the app and its nested bundles.
+func (a *Archive) executables() ([]string, error) {
+	var executables []string
+	for _, bundleDir := range a.bundleDirs() {
+		info, err := readInfoPlist(a.zipReader, bundleDir)
+		if err != nil {
+			return nil, err
+		}
+		if info.CFBundleExecutable != "" {
+			executables = append(executables, path.Join(bundleDir, info.CFBundleExecutable))
+		}
+	}
+	return executables, nil
+}
+
+// Returns the main app bundle followed by all nested bundles that have an Info.plist.
+func (a *Archive) bundleDirs() []string {
+	var nested []string
+	for _, file := range a.zipReader.File {
+		dir, name := path.Split(file.Name)
+		dir = path.Clean(dir)
+		if name != "Info.plist" || dir == a.AppDir || !strings.HasPrefix(dir, a.AppDir+"/") {
+			continue
+		}
+		if ext := path.Ext(dir); ext == ".appex" || ext == ".app" {
+			nested = append(nested, dir)
+		}
+	}
+	sort.Strings(nested)
+	return append([]string{a.AppDir}, nested...)
+}
+
+// Only the header and load commands of executables are read, so the size of the load commands is limited.
+const (
+	maxLoadCommandsSize = 16 * 1024 * 1024
+	maxFatArches        = 64
+	fatArchSize         = 20
+)
+
+// One architecture of an executable: where it is in the file, and its load commands.
+type machOSlice struct {
+	offset    uint64
+	size      uint64
+	byteOrder binary.ByteOrder
+	loads     [][]byte
+}
+
+// Reads the load commands of each architecture of the executable, without reading the rest of it. Thin
+// executables have a single slice.
+func readMachOSlices(file *fileReader) ([]machOSlice, error) {
+	var magic [4]byte
+	if _, err := file.ReadAt(magic[:], 0); err != nil {
+		return nil, errors.WithMessage(err, "read magic")
+	}
+	if binary.BigEndian.Uint32(magic[:]) != macho.MagicFat {
+		slice, err := readMachOSlice(file, 0, file.Size())
+		if err != nil {
+			return nil, err
+		}
+		return []machOSlice{slice}, nil
+	}
+	// The fat header is always big endian: magic, count, then count * (cputype, cpusubtype, offset, size, align)
+	var header [8]byte
+	if _, err := file.ReadAt(header[:], 0); err != nil {
+		return nil, errors.WithMessage(err, "read fat header")
+	}
+	count := binary.BigEndian.Uint32(header[4:8])
+	if count < 1 {
+		return nil, errors.New("fat binary has no architectures")
+	} else if count > maxFatArches {
+		return nil, errors.New("fat binary has too many architectures")
+	}
+	arches := make([]byte, count*fatArchSize)
+	if _, err := file.ReadAt(arches, int64(len(header))); err != nil {
+		return nil, errors.WithMessage(err, "read fat architectures")
+	}
+	var slices []machOSlice
+	for i := uint32(0); i < count; i++ {
+		arch := arches[i*fatArchSize:]
+		offset, size := uint64(binary.BigEndian.Uint32(arch[8:12])), uint64(binary.BigEndian.Uint32(arch[12:16]))
+		if offset+size > file.Size() {
+			return nil, errors.New("architecture out of bounds")
+		}
+		slice, err := readMachOSlice(file, offset, size)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "architecture %d", i)
+		}
+		slices = append(slices, slice)
+	}
+	return slices, nil
+}
+
+func readMachOSlice(file *fileReader, offset uint64, size uint64) (machOSlice, error) {
+	// magic, cputype, cpusubtype, filetype, ncmds, sizeofcmds, flags, and reserved for 64-bit
+	var header [32]byte
+	if size < uint64(len(header)) {
+		return machOSlice{}, errors.New("header out of bounds")
+	}
+	if _, err := file.ReadAt(header[:], int64(offset)); err != nil {
+		return machOSlice{}, errors.WithMessage(err, "read header")
+	}
+	slice := machOSlice{offset: offset, size: size}
+	headerSize := uint64(len(header))
+	for _, byteOrder := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch byteOrder.Uint32(header[0:4]) {
+		case macho.Magic32:
+			slice.byteOrder, headerSize = byteOrder, 28
+		case macho.Magic64:
+			slice.byteOrder = byteOrder
+		}
+	}
+	if slice.byteOrder == nil {
+		return machOSlice{}, errors.New("bad magic")
+	}
+	count, commandsSize := slice.byteOrder.Uint32(header[16:20]), uint64(slice.byteOrder.Uint32(header[20:24]))
+	if commandsSize > maxLoadCommandsSize || headerSize+commandsSize > size {
+		return machOSlice{}, errors.New("load commands out of bounds")
+	}
+	commands := make([]byte, commandsSize)
+	if _, err := file.ReadAt(commands, int64(offset+headerSize)); err != nil {
+		return machOSlice{}, errors.WithMessage(err, "read load commands")
+	}
+	for i := uint32(0); i < count; i++ {
+		// cmd, cmdsize, then the command's fields
+		if len(commands) < 8 {
+			return machOSlice{}, errors.Errorf("load command %d out of bounds", i)
+		}
+		commandSize := uint64(slice.byteOrder.Uint32(commands[4:8]))
+		if commandSize < 8 || commandSize > uint64(len(commands)) {
+			return machOSlice{}, errors.Errorf("load command %d out of bounds", i)
+		}
+		slice.loads = append(slice.loads, commands[:commandSize])
+		commands = commands[commandSize:]
+	}
+	return slice, nil
+}
+
+func (s *machOSlice) hasCryptId() bool {
+	for _, raw := range s.loads {
+		if len(raw) < 20 {
+			continue
+		}
+		// cmd, cmdsize, cryptoff, cryptsize, cryptid
+		cmd := macho.LoadCmd(s.byteOrder.Uint32(raw[0:4]))
+		if (cmd == loadCmdEncryptionInfo || cmd == loadCmdEncryptionInfo64) && s.byteOrder.Uint32(raw[16:20]) != 0 {
+			return true
+		}
+	}
+	return false
+}
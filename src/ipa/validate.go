@@ -0,0 +1,64 @@
+package ipa
+
+import (
+	"archive/zip"
+	"github.com/pkg/errors"
+	"io"
+	"path"
+	"strings"
+)
+
+// Checks that the archive is a well-formed IPA: a zip with no path traversal entries and exactly one
+// app bundle in Payload, which contains an Info.plist and the main executable it references.
+func Validate(reader io.ReaderAt, size int64) error {
+	zipReader, err := zip.NewReader(reader, size)
+	if err != nil {
+		return errors.New("not a zip archive")
+	}
+	appDirs := map[string]bool{}
+	for _, file := range zipReader.File {
+		if !isSafePath(file.Name) {
+			return errors.Errorf("unsafe path %q", file.Name)
+		}
+		parts := strings.Split(file.Name, "/")
+		if len(parts) >= 2 && parts[0] == payloadDir && strings.HasSuffix(parts[1], ".app") {
+			appDirs[parts[1]] = true
+		}
+	}
+	if len(appDirs) != 1 {
+		return errors.Errorf("expected exactly one app bundle in %s, found %d", payloadDir, len(appDirs))
+	}
+	archive, err := Open(reader, size)
+	if err != nil {
+		return err
+	}
+	if archive.info.CFBundleExecutable == "" {
+		return errors.New("Info.plist has no CFBundleExecutable")
+	}
+	executablePath := path.Join(archive.AppDir, archive.info.CFBundleExecutable)
+	if !isSafePath(executablePath) || archive.findFile(executablePath) == nil {
+		return errors.Errorf("main executable %s not found", executablePath)
+	}
+	return nil
+}
+
+func isSafePath(name string) bool {
+	if strings.Contains(name, "\\") || path.IsAbs(name) {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *Archive) findFile(name string) *zip.File {
+	for _, file := range a.zipReader.File {
+		if file.Name == name {
+			return file
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package ipa
+
+import (
+	"bytes"
+	"crypto/x509"
+	"github.com/pkg/errors"
+	"github.com/smallstep/pkcs7"
+	"howett.net/plist"
+	"path"
+	"strings"
+	"time"
+)
+
+const embeddedProvisioningProfile = "embedded.mobileprovision"
+
+// Only the keys that are needed, the rest are ignored when decoding.
+type ProvisioningProfile struct {
+	UUID                  string         `plist:"UUID"`
+	Name                  string         `plist:"Name"`
+	TeamIdentifier        []string       `plist:"TeamIdentifier"`
+	DeveloperCertificates [][]byte       `plist:"DeveloperCertificates"`
+	Entitlements          map[string]any `plist:"Entitlements"`
+	ExpirationDate        time.Time      `plist:"ExpirationDate"`
+}
+
+// Parses the plist inside the signed provisioning profile. Apple's signature itself is not verified.
+func ParseProvisioningProfile(data []byte) (*ProvisioningProfile, error) {
+	p7, err := pkcs7.Parse(data)
+	if err != nil {
+		return nil, errors.WithMessage(err, "parse signed data")
+	}
+	profile := ProvisioningProfile{}
+	if _, err := plist.Unmarshal(p7.Content, &profile); err != nil {
+		return nil, errors.WithMessage(err, "parse plist")
+	}
+	return &profile, nil
+}
+
+// Checks whether the profile's application identifier, e.g. "TEAMID.com.example.*", allows the bundle id.
+func (p *ProvisioningProfile) AllowsBundleId(bundleId string) bool {
+	appId, _ := p.Entitlements["application-identifier"].(string)
+	_, pattern, ok := strings.Cut(appId, ".")
+	if !ok {
+		return false
+	}
+	if prefix, isWildcard := strings.CutSuffix(pattern, "*"); isWildcard {
+		return strings.HasPrefix(bundleId, prefix)
+	}
+	return pattern == bundleId
+}
+
+// Returns the raw provisioning profile embedded in the main app bundle.
+func (a *Archive) ProvisioningProfile() ([]byte, error) {
+	return ReadFile(a.zipReader, path.Join(a.AppDir, embeddedProvisioningProfile), maxPlistSize)
+}
+
+// Verifies the CMS signature of the main executable's code directory and returns the signing certificate.
+// The certificate chain is not verified, since that's up to the device.
+func (a *Archive) SigningCertificate() (*x509.Certificate, error) {
+	executablePath := path.Join(a.AppDir, a.info.CFBundleExecutable)
+	blobs, err := a.readCodeSignature(executablePath)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "parse %s", executablePath)
+	}
+	codeDirectory, hasCodeDirectory := blobs[csSlotCodeDirectory]
+	signature, hasSignature := blobs[csSlotSignature]
+	if !hasCodeDirectory || !hasSignature || len(signature) <= csBlobHeaderSize {
+		return nil, errors.Errorf("%s is not signed", executablePath)
+	}
+	p7, err := pkcs7.Parse(signature[csBlobHeaderSize:])
+	if err != nil {
+		return nil, errors.WithMessage(err, "parse signature")
+	}
+	// The signature is detached, its content is the code directory
+	p7.Content = codeDirectory
+	if err := p7.Verify(); err != nil {
+		return nil, errors.WithMessage(err, "verify signature")
+	}
+	signer := p7.GetOnlySigner()
+	if signer == nil {
+		return nil, errors.New("signature must have exactly one signer")
+	}
+	return signer, nil
+}
+
+// Checks that the app is signed by one of the certificates, that its embedded provisioning profile
+// contains the signing certificate and allows the app's bundle id, and that the bundle id is as expected.
+// Returns the embedded provisioning profile.
+func (a *Archive) VerifySignature(certificates []*x509.Certificate, bundleId string) ([]byte, error) {
+	if a.info.CFBundleIdentifier != bundleId {
+		return nil, errors.Errorf("bundle id %s does not match expected %s", a.info.CFBundleIdentifier, bundleId)
+	}
+	signer, err := a.SigningCertificate()
+	if err != nil {
+		return nil, err
+	}
+	if !containsCertificate(certificates, signer.Raw) {
+		return nil, errors.Errorf("signed with unexpected certificate %s (%s)", signer.Subject.CommonName, signer.SerialNumber.String())
+	}
+	provBytes, err := a.ProvisioningProfile()
+	if err != nil {
+		return nil, err
+	}
+	prov, err := ParseProvisioningProfile(provBytes)
+	if err != nil {
+		return nil, errors.WithMessage(err, "parse provisioning profile")
+	}
+	found := false
+	for _, cert := range prov.DeveloperCertificates {
+		if bytes.Equal(cert, signer.Raw) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, errors.Errorf("provisioning profile %s does not contain the signing certificate", prov.UUID)
+	}
+	if !prov.AllowsBundleId(bundleId) {
+		return nil, errors.Errorf("provisioning profile %s does not allow bundle id %s", prov.UUID, bundleId)
+	}
+	return provBytes, nil
+}
+
+func containsCertificate(certificates []*x509.Certificate, raw []byte) bool {
+	for _, cert := range certificates {
+		if bytes.Equal(cert.Raw, raw) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+package oidc
+
+import (
+	"SignTools/src/util"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/ViRb3/sling/v2"
+	"github.com/pkg/errors"
+	"math/big"
+	"strings"
+	"sync"
+)
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// The signing keys of the identity provider. They are fetched again whenever a token is signed by an unknown
+// key, so that key rotation is picked up.
+type keySet struct {
+	url  string
+	mu   sync.Mutex
+	keys map[string]crypto.PublicKey
+}
+
+func newKeySet(url string) *keySet {
+	return &keySet{url: url}
+}
+
+func (s *keySet) refresh() error {
+	var set jwks
+	response, err := sling.New().Get(s.url).ReceiveSuccess(&set)
+	if err != nil {
+		return errors.WithMessage(err, "get jwks")
+	}
+	if err := util.Check2xxCode(response.StatusCode); err != nil {
+		return errors.WithMessage(err, "get jwks")
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		// keys of unsupported types are skipped, the provider may use another one
+		if publicKey, err := parseJwk(key); err == nil {
+			keys[key.Kid] = publicKey
+		}
+	}
+	s.keys = keys
+	return nil
+}
+
+func parseJwk(key jwk) (crypto.PublicKey, error) {
+	switch key.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return nil, errors.WithMessage(err, "decode n")
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return nil, errors.WithMessage(err, "decode e")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if key.Crv != "P-256" {
+			return nil, errors.Errorf("unsupported curve %s", key.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil {
+			return nil, errors.WithMessage(err, "decode x")
+		}
+		y, err := base64.RawURLEncoding.DecodeString(key.Y)
+		if err != nil {
+			return nil, errors.WithMessage(err, "decode y")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, errors.Errorf("unsupported key type %s", key.Kty)
+}
+
+func (s *keySet) getKey(kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, ok := s.keys[kid]; ok {
+		return key, nil
+	}
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	if key, ok := s.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errors.Errorf("unknown key %q", kid)
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Verifies the signature of a compact JWT and returns its claims. Only RS256 and ES256 are supported.
+func (s *keySet) verifyJwt(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed jwt")
+	}
+	var header jwtHeader
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return nil, errors.WithMessage(err, "decode header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.WithMessage(err, "decode signature")
+	}
+	key, err := s.getKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch publicKey := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, errors.Errorf("algorithm %s doesn't match the RSA key", header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], signature); err != nil {
+			return nil, errors.WithMessage(err, "verify signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" {
+			return nil, errors.Errorf("algorithm %s doesn't match the EC key", header.Alg)
+		}
+		if len(signature) != 64 {
+			return nil, errors.New("malformed signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		sig := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(publicKey, hash[:], r, sig) {
+			return nil, errors.New("verify signature")
+		}
+	default:
+		return nil, errors.New("unsupported key")
+	}
+	var claims map[string]any
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return nil, errors.WithMessage(err, "decode claims")
+	}
+	return claims, nil
+}
+
+func decodeJwtPart(part string, value any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
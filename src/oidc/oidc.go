@@ -0,0 +1,200 @@
+package oidc
+
+import (
+	"SignTools/src/util"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/ViRb3/sling/v2"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long the user has to log in at the identity provider.
+const LoginTimeout = 10 * time.Minute
+
+// How many logins can be pending at once. Anyone can start a login, so when there are too many, the oldest is
+// dropped to keep the memory bounded.
+const MaxPendingLogins = 1000
+
+// A login started with AuthCodeUrl, waiting for the callback.
+type pendingLogin struct {
+	nonce    string
+	verifier string
+	next     string
+	expires  time.Time
+}
+
+// An OpenID Connect relying party, using the authorization code flow with PKCE.
+type Provider struct {
+	issuer   string
+	oauth    oauth2.Config
+	keys     *keySet
+	mu       sync.Mutex
+	pendings map[string]pendingLogin
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+// Discovers the endpoints of the issuer. The "openid" scope is always requested.
+func New(issuerUrl string, clientId string, clientSecret string, redirectUrl string, scopes []string) (*Provider, error) {
+	issuerUrl = strings.TrimSuffix(issuerUrl, "/")
+	var doc discovery
+	response, err := sling.New().Get(issuerUrl + "/.well-known/openid-configuration").ReceiveSuccess(&doc)
+	if err != nil {
+		return nil, errors.WithMessage(err, "get discovery document")
+	}
+	if err := util.Check2xxCode(response.StatusCode); err != nil {
+		return nil, errors.WithMessage(err, "get discovery document")
+	}
+	if doc.Issuer != issuerUrl {
+		return nil, errors.Errorf("discovery document is for issuer %q instead of %q", doc.Issuer, issuerUrl)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JwksUri == "" {
+		return nil, errors.New("discovery document is missing endpoints")
+	}
+	if !slices.Contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+	return &Provider{
+		issuer: doc.Issuer,
+		oauth: oauth2.Config{
+			ClientID:     clientId,
+			ClientSecret: clientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  doc.AuthorizationEndpoint,
+				TokenURL: doc.TokenEndpoint,
+			},
+			RedirectURL: redirectUrl,
+			Scopes:      scopes,
+		},
+		keys:     newKeySet(doc.JwksUri),
+		pendings: map[string]pendingLogin{},
+	}, nil
+}
+
+func randomString() (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Starts a login and returns the url of the identity provider to redirect the user to, along with the state
+// that the callback must be called with. The state should also be bound to the user's browser, e.g. with a
+// cookie, so that nobody else can finish the login. The next value is returned by Exchange.
+func (p *Provider) AuthCodeUrl(next string) (string, string, error) {
+	state, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for key, pending := range p.pendings {
+		if now.After(pending.expires) {
+			delete(p.pendings, key)
+		}
+	}
+	if len(p.pendings) >= MaxPendingLogins {
+		p.dropOldestPending()
+	}
+	p.pendings[state] = pendingLogin{nonce: nonce, verifier: verifier, next: next, expires: now.Add(LoginTimeout)}
+	return p.oauth.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier), oauth2.SetAuthURLParam("nonce", nonce)), state, nil
+}
+
+// Must be called with the lock held. All logins have the same timeout, so the oldest expires first.
+func (p *Provider) dropOldestPending() {
+	var oldestKey string
+	var oldest time.Time
+	for key, pending := range p.pendings {
+		if oldestKey == "" || pending.expires.Before(oldest) {
+			oldestKey, oldest = key, pending.expires
+		}
+	}
+	delete(p.pendings, oldestKey)
+}
+
+// Finishes the login with the state and code of the callback. Returns the verified claims of the ID token,
+// and the next value that the login was started with.
+func (p *Provider) Exchange(ctx context.Context, state string, code string) (map[string]any, string, error) {
+	p.mu.Lock()
+	pending, ok := p.pendings[state]
+	delete(p.pendings, state)
+	p.mu.Unlock()
+	if !ok || time.Now().After(pending.expires) {
+		return nil, "", errors.New("unknown or expired login state")
+	}
+	token, err := p.oauth.Exchange(ctx, code, oauth2.VerifierOption(pending.verifier))
+	if err != nil {
+		return nil, "", errors.WithMessage(err, "exchange code")
+	}
+	idToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, "", errors.New("token response has no id_token")
+	}
+	claims, err := p.verify(idToken, pending.nonce)
+	if err != nil {
+		return nil, "", errors.WithMessage(err, "verify id_token")
+	}
+	return claims, pending.next, nil
+}
+
+// Clock skew allowed when checking the expiry of ID tokens.
+const leeway = time.Minute
+
+func (p *Provider) verify(idToken string, nonce string) (map[string]any, error) {
+	claims, err := p.keys.verifyJwt(idToken)
+	if err != nil {
+		return nil, err
+	}
+	if issuer, _ := claims["iss"].(string); issuer != p.issuer {
+		return nil, errors.Errorf("wrong issuer %q", issuer)
+	}
+	if !slices.Contains(GetStrings(claims, "aud"), p.oauth.ClientID) {
+		return nil, errors.New("wrong audience")
+	}
+	expiry, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("missing expiry")
+	}
+	if time.Now().Add(-leeway).After(time.Unix(int64(expiry), 0)) {
+		return nil, errors.New("expired")
+	}
+	if claimNonce, _ := claims["nonce"].(string); claimNonce != nonce {
+		return nil, errors.New("wrong nonce")
+	}
+	return claims, nil
+}
+
+// Returns a claim that is either a string or a list of strings, like "aud" or a groups claim.
+func GetStrings(claims map[string]any, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []any:
+		var result []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
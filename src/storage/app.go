@@ -1,9 +1,13 @@
 package storage
 
 import (
+	"SignTools/src/ipa"
 	"SignTools/src/util"
+	"bytes"
+	"encoding/json"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
 	"io"
 	"os"
 	"sync"
@@ -16,12 +20,22 @@ const (
 	AppBundleId     = FSName("bundle_id")
 	AppSignedFile   = FSName("signed")
 	AppUnsignedFile = FSName("unsigned")
+	// SHA-256 hash of the unsigned file, which is stored as a shared blob.
+	// Apps uploaded before blobs were introduced store it in AppUnsignedFile instead.
+	AppUnsignedHash = FSName("unsigned_hash")
 	AppName         = FSName("name")
 	AppUserBundleId = FSName("user_bundle_id")
 	AppWorkflowUrl  = FSName("workflow_url")
 	AppProfileId    = FSName("profile_id")
 	AppBuilderId    = FSName("builder_id")
 	AppBundleName   = FSName("bundle_name")
+	AppMetadata     = FSName("metadata.json")
+	AppIcon         = FSName("icon.png")
+	AppFailReason   = FSName("fail_reason")
+	AppFolder       = FSName("folder")
+	AppTags         = FSName("tags")
+	AppNotes        = FSName("notes")
+	AppOwner        = FSName("owner")
 	TweaksDir       = FSName("tweaks")
 )
 
@@ -30,15 +44,32 @@ type App interface {
 	IsSigned() (bool, error)
 	GetModTime() (time.Time, error)
 	ResetModTime() error
+	GetMetadata() (*ipa.Metadata, error)
+	GetInfo() AppInfo
+	getUnsignedHash() (string, error)
 	delete() error
 	FileSystem
 }
 
 func loadApp(id string) App {
-	return newApp(id)
+	app := newApp(id)
+	if hash, err := app.GetString(AppUnsignedHash); err == nil {
+		app.unsignedHash = hash
+	} else if !os.IsNotExist(err) {
+		log.Err(err).Str("app_id", id).Msgf("get %s", AppUnsignedHash)
+		app.unsignedHashErr = err
+	}
+	// Parses apps uploaded before metadata was introduced
+	if _, err := app.GetMetadata(); err != nil {
+		log.Warn().Err(err).Str("app_id", id).Msg("get metadata")
+	}
+	if err := app.loadInfo(); err != nil {
+		log.Err(err).Str("app_id", id).Msg("load app info")
+	}
+	return app
 }
 
-func createApp(unsignedFile io.Reader, name string, profile Profile, signArgs string, userBundleId string, builderId string, tweakMap map[string]io.Reader) (App, error) {
+func createApp(unsignedFile io.Reader, name string, owner string, profile Profile, signArgs string, userBundleId string, builderId string, tweakMap map[string]io.Reader) (App, error) {
 	app := newApp(uuid.NewString())
 	if err := os.MkdirAll(app.resolvePath(AppRoot), os.ModePerm); err != nil {
 		return nil, errors.New("make app dir")
@@ -49,14 +80,26 @@ func createApp(unsignedFile io.Reader, name string, profile Profile, signArgs st
 		AppUserBundleId: userBundleId,
 		AppBuilderId:    builderId,
 		AppProfileId:    profile.GetId(),
+		AppOwner:        owner,
 	}
 	for fileType, value := range pairs {
 		if err := app.SetString(fileType, value); err != nil {
 			return nil, errors.WithMessagef(err, "set %s", fileType)
 		}
 	}
-	if err := app.SetFile(AppUnsignedFile, unsignedFile); err != nil {
-		return nil, errors.WithMessagef(err, "set %s", AppUnsignedFile)
+	hash, err := Blobs.Put(unsignedFile)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "store %s", AppUnsignedFile)
+	}
+	if err := app.SetString(AppUnsignedHash, hash); err != nil {
+		if err := Blobs.Release(hash); err != nil {
+			log.Err(err).Str("hash", hash).Msg("release blob")
+		}
+		return nil, errors.WithMessagef(err, "set %s", AppUnsignedHash)
+	}
+	app.unsignedHash = hash
+	if _, err := app.parseUnsigned(); err != nil {
+		log.Warn().Err(err).Str("app_id", app.GetId()).Msg("parse unsigned app")
 	}
 	if len(tweakMap) > 0 {
 		if err := app.MkDir(TweaksDir); err != nil {
@@ -69,21 +112,39 @@ func createApp(unsignedFile io.Reader, name string, profile Profile, signArgs st
 			return nil, errors.WithMessagef(err, "set %s", tweakPath)
 		}
 	}
+	if err := app.loadInfo(); err != nil {
+		return nil, errors.WithMessage(err, "load info")
+	}
 	return app, nil
 }
 
 func newApp(id string) *app {
-	return &app{id: id, FileSystemBase: FileSystemBase{resolvePath: func(name FSName) string {
+	a := &app{id: id}
+	a.resolvePath = func(name FSName) string {
+		if name == AppUnsignedFile && a.unsignedHash != "" {
+			return Blobs.resolvePath(a.unsignedHash)
+		}
 		return util.SafeJoinFilePaths(appsPath, id, string(name))
-	}}}
+	}
+	return a
 }
 
 type app struct {
-	mu sync.RWMutex
-	id string
+	mu     sync.RWMutex
+	id     string
+	infoMu sync.Mutex
+	info   *AppInfo
+	// Set once when the app is created or loaded.
+	unsignedHash string
+	// Set if the app has a hash that couldn't be read, so its blob must not be removed.
+	unsignedHashErr error
 	FileSystemBase
 }
 
+func (a *app) getUnsignedHash() (string, error) {
+	return a.unsignedHash, a.unsignedHashErr
+}
+
 func (a *app) delete() error {
 	a.mu.Lock()
 	defer a.mu.Unlock()
@@ -116,6 +177,7 @@ func (a *app) GetId() string {
 }
 
 func (a *app) ResetModTime() error {
+	defer a.onWrite()
 	a.mu.Lock()
 	defer a.mu.Unlock()
 	now := time.Now()
@@ -124,3 +186,49 @@ func (a *app) ResetModTime() error {
 	}
 	return nil
 }
+
+// Returns the metadata parsed from the unsigned app. Apps uploaded before metadata
+// was introduced are parsed on first access.
+func (a *app) GetMetadata() (*ipa.Metadata, error) {
+	metadata, err := a.readMetadata()
+	if os.IsNotExist(err) {
+		return a.parseUnsigned()
+	}
+	return metadata, err
+}
+
+// Parses the unsigned app and saves its metadata and icon, if it has one.
+func (a *app) parseUnsigned() (*ipa.Metadata, error) {
+	file, err := a.GetFile(AppUnsignedFile)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "get %s", AppUnsignedFile)
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, errors.WithMessagef(err, "stat %s", AppUnsignedFile)
+	}
+	archive, err := ipa.Open(file, stat.Size())
+	if err != nil {
+		return nil, errors.WithMessage(err, "open archive")
+	}
+	metadata, err := archive.Metadata()
+	if err != nil {
+		return nil, errors.WithMessage(err, "read metadata")
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, errors.WithMessage(err, "marshal metadata")
+	}
+	if err := a.SetString(AppMetadata, string(data)); err != nil {
+		return nil, errors.WithMessagef(err, "set %s", AppMetadata)
+	}
+	if icon, err := archive.Icon(); err == nil {
+		if err := a.SetFile(AppIcon, bytes.NewReader(icon)); err != nil {
+			return nil, errors.WithMessagef(err, "set %s", AppIcon)
+		}
+	} else if !errors.Is(err, ipa.ErrNoIcon) {
+		log.Warn().Err(err).Str("app_id", a.GetId()).Msg("read icon")
+	}
+	return metadata, nil
+}
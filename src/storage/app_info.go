@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"SignTools/src/ipa"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"time"
+)
+
+// A snapshot of the values needed to list an app. It's kept in memory and reloaded whenever the app
+// is written to, so that listing apps doesn't hit the disk.
+type AppInfo struct {
+	Id          string
+	Name        string
+	BundleId    string
+	ProfileId   string
+	WorkflowUrl string
+	FailReason  string
+	Folder      string
+	Tags        []string
+	Notes       string
+	Owner       string
+	IsSigned    bool
+	HasIcon     bool
+	TweakCount  int
+	ModTime     time.Time
+	Metadata    ipa.Metadata
+}
+
+func (a *app) GetInfo() AppInfo {
+	a.infoMu.Lock()
+	defer a.infoMu.Unlock()
+	if a.info == nil {
+		if err := a.reloadInfo(); err != nil {
+			log.Err(err).Str("app_id", a.id).Msg("load app info")
+			return AppInfo{Id: a.id}
+		}
+	}
+	return *a.info
+}
+
+func (a *app) loadInfo() error {
+	a.infoMu.Lock()
+	defer a.infoMu.Unlock()
+	return a.reloadInfo()
+}
+
+// Reloads the info if it has been loaded. Must be called after every write.
+func (a *app) onWrite() {
+	a.infoMu.Lock()
+	defer a.infoMu.Unlock()
+	if a.info == nil {
+		return
+	}
+	if err := a.reloadInfo(); err != nil {
+		log.Err(err).Str("app_id", a.id).Msg("reload app info")
+	}
+}
+
+// Must be called with infoMu held.
+func (a *app) reloadInfo() error {
+	info := AppInfo{Id: a.id}
+	var err error
+	for name, value := range map[FSName]*string{
+		AppName:        &info.Name,
+		AppBundleId:    &info.BundleId,
+		AppProfileId:   &info.ProfileId,
+		AppWorkflowUrl: &info.WorkflowUrl,
+		AppFailReason:  &info.FailReason,
+		AppFolder:      &info.Folder,
+		AppNotes:       &info.Notes,
+		AppOwner:       &info.Owner,
+	} {
+		if *value, err = a.GetString(name); err != nil && !os.IsNotExist(err) {
+			return errors.WithMessagef(err, "get %s", name)
+		}
+	}
+	if tags, err := a.GetString(AppTags); err == nil {
+		info.Tags = ParseTags(tags)
+	} else if !os.IsNotExist(err) {
+		return errors.WithMessagef(err, "get %s", AppTags)
+	}
+	if info.IsSigned, err = a.IsSigned(); err != nil {
+		return errors.WithMessage(err, "get is signed")
+	}
+	if info.ModTime, err = a.GetModTime(); err != nil {
+		return errors.WithMessage(err, "get mod time")
+	}
+	if _, err := a.Stat(AppIcon); err == nil {
+		info.HasIcon = true
+	} else if !os.IsNotExist(err) {
+		return errors.WithMessagef(err, "stat %s", AppIcon)
+	}
+	if tweaks, err := a.ReadDir(TweaksDir); err == nil {
+		info.TweakCount = len(tweaks)
+	} else if !os.IsNotExist(err) {
+		return errors.WithMessagef(err, "read %s", TweaksDir)
+	}
+	if metadata, err := a.readMetadata(); err == nil {
+		info.Metadata = *metadata
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	a.info = &info
+	return nil
+}
+
+// Parses a list of tags separated by newlines or commas, removing duplicates.
+func ParseTags(list string) []string {
+	var tags []string
+	seen := map[string]bool{}
+	for _, tag := range parseUserList(list) {
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func (a *app) readMetadata() (*ipa.Metadata, error) {
+	data, err := a.GetString(AppMetadata)
+	if err != nil {
+		return nil, err
+	}
+	metadata := ipa.Metadata{}
+	if err := json.Unmarshal([]byte(data), &metadata); err != nil {
+		return nil, errors.WithMessagef(err, "unmarshal %s", AppMetadata)
+	}
+	return &metadata, nil
+}
+
+func (a *app) SetString(name FSName, value string) error {
+	defer a.onWrite()
+	return a.FileSystemBase.SetString(name, value)
+}
+
+func (a *app) SetFile(name FSName, value io.Reader) error {
+	defer a.onWrite()
+	return a.FileSystemBase.SetFile(name, value)
+}
+
+func (a *app) RemoveFile(name FSName) error {
+	defer a.onWrite()
+	return a.FileSystemBase.RemoveFile(name)
+}
+
+func (a *app) MkDir(name FSName) error {
+	defer a.onWrite()
+	return a.FileSystemBase.MkDir(name)
+}
@@ -44,9 +44,7 @@ func (r *appResolver) GetAll() ([]App, error) {
 	}
 	// reverse sort
 	sort.Slice(apps, func(i, j int) bool {
-		time1, _ := apps[i].GetModTime()
-		time2, _ := apps[j].GetModTime()
-		return time1.After(time2)
+		return apps[i].GetInfo().ModTime.After(apps[j].GetInfo().ModTime)
 	})
 	return apps, nil
 }
@@ -61,8 +59,8 @@ func (r *appResolver) Get(id string) (App, bool) {
 	return app, true
 }
 
-func (r *appResolver) New(unsignedFile io.Reader, name string, profile Profile, signArgs string, userBundleId string, builderId string, tweakMap map[string]io.Reader) (App, error) {
-	app, err := createApp(unsignedFile, name, profile, signArgs, userBundleId, builderId, tweakMap)
+func (r *appResolver) New(unsignedFile io.Reader, name string, owner string, profile Profile, signArgs string, userBundleId string, builderId string, tweakMap map[string]io.Reader) (App, error) {
+	app, err := createApp(unsignedFile, name, owner, profile, signArgs, userBundleId, builderId, tweakMap)
 	if err != nil {
 		return nil, err
 	}
@@ -85,5 +83,10 @@ func (r *appResolver) Delete(id string) error {
 	if err := app.delete(); err != nil {
 		return errors.WithMessagef(err, "delete app id=%s", appId)
 	}
+	if hash, _ := app.getUnsignedHash(); hash != "" {
+		if err := Blobs.Release(hash); err != nil {
+			return errors.WithMessagef(err, "release unsigned blob of app id=%s", appId)
+		}
+	}
 	return nil
 }
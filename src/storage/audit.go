@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"os"
+	"sync"
+	"time"
+)
+
+// A user or builder action. Which ids are set depends on the action.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	AppId  string    `json:"app_id,omitempty"`
+	// The profile that the app is signed with, or the profile that the action is about.
+	ProfileId string `json:"profile_id,omitempty"`
+	JobId     string `json:"job_id,omitempty"`
+	// Anything else the action is about, like a token id, a username or an upload id.
+	Target string `json:"target,omitempty"`
+	Ip     string `json:"ip"`
+	// The HTTP status code of the response.
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (e AuditEntry) Failed() bool {
+	return e.Status >= 400
+}
+
+// Selects audit entries. Empty fields match everything.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	// Matches any of the ids of an entry.
+	Id string
+	// Either "ok" or "failed".
+	Result string
+}
+
+func (f AuditFilter) Matches(entry AuditEntry) bool {
+	if f.Actor != "" && f.Actor != entry.Actor {
+		return false
+	}
+	if f.Action != "" && f.Action != entry.Action {
+		return false
+	}
+	if f.Id != "" && f.Id != entry.AppId && f.Id != entry.ProfileId && f.Id != entry.JobId && f.Id != entry.Target {
+		return false
+	}
+	if (f.Result == "ok" && entry.Failed()) || (f.Result == "failed" && !entry.Failed()) {
+		return false
+	}
+	return true
+}
+
+func newAuditResolver() *auditResolver {
+	return &auditResolver{}
+}
+
+// The audit log is a JSON Lines file that is only ever appended to.
+type auditResolver struct {
+	mu sync.Mutex
+}
+
+func (r *auditResolver) Add(entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	file, err := os.OpenFile(auditPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.WithMessage(err, "open audit log")
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return errors.WithMessage(err, "write audit log")
+	}
+	return nil
+}
+
+// Returns the entries matching the filter, oldest first.
+func (r *auditResolver) Query(filter AuditFilter) ([]AuditEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	file, err := os.Open(auditPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithMessage(err, "open audit log")
+	}
+	defer file.Close()
+	var result []AuditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// e.g. a line that was cut off by a crash
+			log.Warn().Err(err).Msg("skipping invalid audit log entry")
+			continue
+		}
+		if filter.Matches(entry) {
+			result = append(result, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithMessage(err, "read audit log")
+	}
+	return result, nil
+}
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"SignTools/src/util"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const blobTempPrefix = ".upload-"
+
+func newBlobResolver() *blobResolver {
+	return &blobResolver{
+		hashToRefsMap: map[string]int{},
+	}
+}
+
+// Stores files by the SHA-256 hash of their content, so that identical files are only stored once.
+// Blobs are reference counted and removed when the last reference is released. The counts are not
+// persisted, but rebuilt from the apps on startup.
+type blobResolver struct {
+	mu            sync.Mutex
+	hashToRefsMap map[string]int
+}
+
+// Counts the references of all apps, removes leftover temporary files, and removes the blobs that are no
+// longer referenced. If the hash of any app couldn't be read, no blobs are removed, since it may be theirs.
+func (r *blobResolver) refresh() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	apps, err := Apps.GetAll()
+	if err != nil {
+		return err
+	}
+	r.hashToRefsMap = map[string]int{}
+	allHashesRead := true
+	for _, app := range apps {
+		hash, err := app.getUnsignedHash()
+		if err != nil {
+			allHashesRead = false
+		} else if hash != "" {
+			r.hashToRefsMap[hash]++
+		}
+	}
+	entries, err := os.ReadDir(blobsPath)
+	if err != nil {
+		return errors.WithMessage(err, "read blobs dir")
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), blobTempPrefix) {
+			log.Info().Str("name", entry.Name()).Msg("removing leftover blob upload")
+			if err := os.RemoveAll(r.resolvePath(entry.Name())); err != nil {
+				return errors.WithMessagef(err, "remove blob upload %s", entry.Name())
+			}
+			continue
+		}
+		if !isBlobHash(entry.Name()) || r.hashToRefsMap[entry.Name()] > 0 {
+			continue
+		}
+		if !allHashesRead {
+			log.Warn().Str("hash", entry.Name()).Msg("keeping unreferenced blob, since the hash of an app couldn't be read")
+			continue
+		}
+		log.Info().Str("hash", entry.Name()).Msg("removing unreferenced blob")
+		if err := os.RemoveAll(r.resolvePath(entry.Name())); err != nil {
+			return errors.WithMessagef(err, "remove blob %s", entry.Name())
+		}
+	}
+	return nil
+}
+
+func isBlobHash(name string) bool {
+	hash, err := hex.DecodeString(name)
+	return err == nil && len(hash) == sha256.Size
+}
+
+func (r *blobResolver) resolvePath(hash string) string {
+	return util.SafeJoinFilePaths(blobsPath, hash)
+}
+
+// Stores the content and adds a reference to it. Returns the content's hash.
+func (r *blobResolver) Put(reader io.Reader) (string, error) {
+	tempFile, err := os.CreateTemp(blobsPath, blobTempPrefix+"*")
+	if err != nil {
+		return "", errors.WithMessage(err, "create temp file")
+	}
+	defer os.Remove(tempFile.Name())
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tempFile, hasher), reader)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", errors.WithMessage(err, "write temp file")
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hashToRefsMap[hash] < 1 {
+		if err := os.Rename(tempFile.Name(), r.resolvePath(hash)); err != nil {
+			return "", errors.WithMessage(err, "move blob")
+		}
+	}
+	r.hashToRefsMap[hash]++
+	return hash, nil
+}
+
+// Removes a reference to the blob, and the blob itself if it was the last one.
+func (r *blobResolver) Release(hash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hashToRefsMap[hash] < 1 {
+		return errors.Errorf("blob %s is not referenced", hash)
+	}
+	r.hashToRefsMap[hash]--
+	if r.hashToRefsMap[hash] > 0 {
+		return nil
+	}
+	delete(r.hashToRefsMap, hash)
+	if err := os.Remove(r.resolvePath(hash)); err != nil && !os.IsNotExist(err) {
+		return errors.WithMessagef(err, "remove blob %s", hash)
+	}
+	return nil
+}
+
+func (r *blobResolver) GetRefs(hash string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.hashToRefsMap[hash]
+}
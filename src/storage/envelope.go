@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Sealed files are laid out as: magic | key nonce | wrapped data key | data nonce | ciphertext.
+// Each file is encrypted with its own random data key, which is in turn encrypted with the master key.
+// This way, rotating the master key only needs to re-wrap the data keys.
+const envelopeMagic = "STENVLP1"
+
+const (
+	envelopeKeySize   = 32
+	envelopeNonceSize = 12
+	envelopeTagSize   = 16
+	wrappedKeySize    = envelopeKeySize + envelopeTagSize
+	envelopeHeaderLen = len(envelopeMagic) + envelopeNonceSize + wrappedKeySize + envelopeNonceSize
+)
+
+var ErrNoMasterKey = errors.New("file is encrypted but no master key is configured")
+
+// Set during Load if a master key is configured, nil otherwise.
+var profileEnvelope *envelope
+
+type envelope struct {
+	masterKey cipher.AEAD
+}
+
+func newEnvelope(masterKey []byte) (*envelope, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, errors.WithMessage(err, "master key")
+	}
+	return &envelope{masterKey: aead}, nil
+}
+
+// Sets the master key that profile files are encrypted with, or stops encrypting new files if nil.
+func SetMasterKey(masterKey []byte) error {
+	if masterKey == nil {
+		profileEnvelope = nil
+		return nil
+	}
+	envelope, err := newEnvelope(masterKey)
+	if err != nil {
+		return err
+	}
+	profileEnvelope = envelope
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != envelopeKeySize {
+		return nil, errors.Errorf("bad key size %d, expected %d", len(key), envelopeKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func isSealed(data []byte) bool {
+	return len(data) >= envelopeHeaderLen && bytes.HasPrefix(data, []byte(envelopeMagic))
+}
+
+func randomBytes(size int) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (e *envelope) seal(plaintext []byte) ([]byte, error) {
+	dataKey, err := randomBytes(envelopeKeySize)
+	if err != nil {
+		return nil, errors.WithMessage(err, "generate data key")
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	keyNonce, err := randomBytes(envelopeNonceSize)
+	if err != nil {
+		return nil, errors.WithMessage(err, "generate key nonce")
+	}
+	dataNonce, err := randomBytes(envelopeNonceSize)
+	if err != nil {
+		return nil, errors.WithMessage(err, "generate data nonce")
+	}
+	result := []byte(envelopeMagic)
+	result = append(result, keyNonce...)
+	result = e.masterKey.Seal(result, keyNonce, dataKey, []byte(envelopeMagic))
+	result = append(result, dataNonce...)
+	result = dataAEAD.Seal(result, dataNonce, plaintext, []byte(envelopeMagic))
+	return result, nil
+}
+
+// Returns the data unchanged if it is not sealed, so that plaintext files keep working.
+func (e *envelope) open(data []byte) ([]byte, error) {
+	if !isSealed(data) {
+		return data, nil
+	}
+	if e == nil {
+		return nil, ErrNoMasterKey
+	}
+	wrappedKey, keyNonce, dataNonce, ciphertext := splitSealed(data)
+	dataKey, err := e.masterKey.Open(nil, keyNonce, wrappedKey, []byte(envelopeMagic))
+	if err != nil {
+		return nil, errors.WithMessage(err, "unwrap data key")
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := dataAEAD.Open(nil, dataNonce, ciphertext, []byte(envelopeMagic))
+	if err != nil {
+		return nil, errors.WithMessage(err, "decrypt data")
+	}
+	return plaintext, nil
+}
+
+// Re-encrypts the data key of sealed data with a new master key, leaving the ciphertext untouched.
+func (e *envelope) rewrap(data []byte, newEnvelope *envelope) ([]byte, error) {
+	wrappedKey, keyNonce, dataNonce, ciphertext := splitSealed(data)
+	dataKey, err := e.masterKey.Open(nil, keyNonce, wrappedKey, []byte(envelopeMagic))
+	if err != nil {
+		return nil, errors.WithMessage(err, "unwrap data key")
+	}
+	newKeyNonce, err := randomBytes(envelopeNonceSize)
+	if err != nil {
+		return nil, errors.WithMessage(err, "generate key nonce")
+	}
+	result := []byte(envelopeMagic)
+	result = append(result, newKeyNonce...)
+	result = newEnvelope.masterKey.Seal(result, newKeyNonce, dataKey, []byte(envelopeMagic))
+	result = append(result, dataNonce...)
+	result = append(result, ciphertext...)
+	return result, nil
+}
+
+func splitSealed(data []byte) (wrappedKey []byte, keyNonce []byte, dataNonce []byte, ciphertext []byte) {
+	offset := len(envelopeMagic)
+	keyNonce = data[offset : offset+envelopeNonceSize]
+	offset += envelopeNonceSize
+	wrappedKey = data[offset : offset+wrappedKeySize]
+	offset += wrappedKeySize
+	dataNonce = data[offset : offset+envelopeNonceSize]
+	offset += envelopeNonceSize
+	return wrappedKey, keyNonce, dataNonce, data[offset:]
+}
+
+// An in-memory ReadonlyFile holding decrypted data.
+type memFile struct {
+	*bytes.Reader
+	info os.FileInfo
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+type memFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i *memFileInfo) Size() int64 {
+	return i.size
+}
+
+// Encrypts all plaintext profile files in place using the configured master key.
+func EncryptProfiles() error {
+	if profileEnvelope == nil {
+		return ErrNoMasterKey
+	}
+	return transformProfileFiles(func(data []byte) ([]byte, error) {
+		if isSealed(data) {
+			return nil, nil
+		}
+		return profileEnvelope.seal(data)
+	})
+}
+
+// Re-wraps all profile files with a new master key. Plaintext files are encrypted as well.
+// The new key must be configured in place of the old one afterwards.
+func RotateProfileKey(newMasterKey []byte) error {
+	newEnvelope, err := newEnvelope(newMasterKey)
+	if err != nil {
+		return err
+	}
+	return transformProfileFiles(func(data []byte) ([]byte, error) {
+		if !isSealed(data) {
+			return newEnvelope.seal(data)
+		}
+		if profileEnvelope == nil {
+			return nil, ErrNoMasterKey
+		}
+		return profileEnvelope.rewrap(data, newEnvelope)
+	})
+}
+
+// Applies f to every file of every profile on disk. If f returns nil data, the file is left untouched.
+// All results are written to temporary files first, and only replace the files once every one succeeded.
+// Otherwise, a failure halfway through a rotation would leave files under two different master keys.
+func transformProfileFiles(f func([]byte) ([]byte, error)) error {
+	// temporary file -> file it replaces
+	replacements := map[string]string{}
+	defer func() {
+		for tempPath := range replacements {
+			os.Remove(tempPath)
+		}
+	}()
+	if err := writeProfileTransforms(f, replacements); err != nil {
+		return err
+	}
+	for tempPath, filePath := range replacements {
+		if err := os.Rename(tempPath, filePath); err != nil {
+			return errors.WithMessagef(err, "replace %s", filePath)
+		}
+		delete(replacements, tempPath)
+	}
+	return nil
+}
+
+func writeProfileTransforms(f func([]byte) ([]byte, error), replacements map[string]string) error {
+	idDirs, err := os.ReadDir(profilesPath)
+	if err != nil {
+		return errors.WithMessage(err, "read profiles dir")
+	}
+	for _, idDir := range idDirs {
+		if !idDir.IsDir() {
+			continue
+		}
+		for _, name := range ProfilePaths {
+			filePath := filepath.Join(profilesPath, idDir.Name(), string(name))
+			data, err := os.ReadFile(filePath)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return errors.WithMessagef(err, "read %s", filePath)
+			}
+			newData, err := f(data)
+			if err != nil {
+				return errors.WithMessagef(err, "transform %s", filePath)
+			}
+			if newData == nil {
+				continue
+			}
+			tempPath, err := writeTempFile(filepath.Dir(filePath), newData)
+			if err != nil {
+				return errors.WithMessagef(err, "write %s", filePath)
+			}
+			replacements[tempPath] = filePath
+		}
+	}
+	return nil
+}
+
+func writeTempFile(dir string, data []byte) (string, error) {
+	file, err := os.CreateTemp(dir, ".transform-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
@@ -29,6 +29,9 @@ type FileSystem interface {
 type FileSystemBase struct {
 	mu          sync.RWMutex
 	resolvePath func(FSName) string
+	// If set, files are transparently encrypted with the master key, if one is configured.
+	// Reading plaintext files is still supported.
+	encrypted bool
 }
 
 func (a *FileSystemBase) GetString(name FSName) (string, error) {
@@ -38,23 +41,58 @@ func (a *FileSystemBase) GetString(name FSName) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if a.encrypted {
+		if data, err = profileEnvelope.open(data); err != nil {
+			return "", errors.WithMessagef(err, "decrypt %s", name)
+		}
+	}
 	return strings.TrimSpace(string(data)), nil
 }
 
 func (a *FileSystemBase) SetString(name FSName, value string) error {
+	data := []byte(strings.TrimSpace(value))
+	if a.encrypted && profileEnvelope != nil {
+		var err error
+		if data, err = profileEnvelope.seal(data); err != nil {
+			return errors.WithMessagef(err, "encrypt %s", name)
+		}
+	}
 	a.mu.Lock()
 	defer a.mu.Unlock()
-	reader := bytes.NewReader([]byte(strings.TrimSpace(value)))
-	return atomic.WriteFile(a.resolvePath(name), reader)
+	return atomic.WriteFile(a.resolvePath(name), bytes.NewReader(data))
 }
 
 func (a *FileSystemBase) GetFile(name FSName) (ReadonlyFile, error) {
 	a.mu.RLock()
 	defer a.mu.RUnlock()
-	return os.Open(a.resolvePath(name))
+	if !a.encrypted {
+		return os.Open(a.resolvePath(name))
+	}
+	data, err := ioutil.ReadFile(a.resolvePath(name))
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(a.resolvePath(name))
+	if err != nil {
+		return nil, err
+	}
+	if data, err = profileEnvelope.open(data); err != nil {
+		return nil, errors.WithMessagef(err, "decrypt %s", name)
+	}
+	return &memFile{Reader: bytes.NewReader(data), info: &memFileInfo{FileInfo: stat, size: int64(len(data))}}, nil
 }
 
 func (a *FileSystemBase) SetFile(name FSName, value io.Reader) error {
+	if a.encrypted && profileEnvelope != nil {
+		data, err := io.ReadAll(value)
+		if err != nil {
+			return errors.WithMessage(err, "read file")
+		}
+		if data, err = profileEnvelope.seal(data); err != nil {
+			return errors.WithMessagef(err, "encrypt %s", name)
+		}
+		value = bytes.NewReader(data)
+	}
 	dir, file := filepath.Split(a.resolvePath(name))
 	if dir == "" {
 		dir = "."
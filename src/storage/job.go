@@ -36,6 +36,9 @@ func (j *signJob) writeArchive(returnJobId string, writer io.Writer) error {
 	if !ok {
 		return errors.New("invalid profile id")
 	}
+	if Revocations.IsRevoked(j.profileId) {
+		return errors.New("profile certificate is revoked")
+	}
 	w := tar.NewWriter(writer)
 	defer w.Close()
 	files, err := profile.GetFiles()
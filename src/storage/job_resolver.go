@@ -5,6 +5,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"io"
+	"sort"
 	"sync"
 	"time"
 )
@@ -37,11 +38,11 @@ func (r *JobResolver) MakeSignJob(appId string, profileId string) {
 
 var ErrNotFound = errors.New("not found")
 
-func (r *JobResolver) TakeLastJob(writer io.Writer) error {
+func (r *JobResolver) TakeLastJob(writer io.Writer) (*ReturnJob, error) {
 	r.mu.Lock()
 	if r.appIdToSignJobMap.Len() < 1 {
 		r.mu.Unlock()
-		return errors.WithMessage(ErrNotFound, "sign job")
+		return nil, errors.WithMessage(ErrNotFound, "sign job")
 	}
 
 	elem := r.appIdToSignJobMap.Back()
@@ -58,9 +59,9 @@ func (r *JobResolver) TakeLastJob(writer io.Writer) error {
 		delete(r.idToReturnJobMap, returnJobId)
 		delete(r.appIdToReturnJobMap, job.appId)
 		r.mu.Unlock()
-		return errors.WithMessage(err, "write archive")
+		return nil, errors.WithMessage(err, "write archive")
 	}
-	return nil
+	return &returnJob, nil
 }
 
 func (r *JobResolver) Cleanup(timeout time.Duration) {
@@ -96,6 +97,33 @@ func (r *JobResolver) GetStatusByAppId(id string) (bool, bool) {
 	return jobPending, jobExists
 }
 
+// A snapshot of a sign job or a return job.
+type JobInfo struct {
+	// Empty if the job is waiting to be picked up by a builder.
+	Id    string
+	AppId string
+	Ts    time.Time
+}
+
+// Returns the sign jobs from oldest to newest, followed by the return jobs.
+func (r *JobResolver) GetAll() []JobInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var jobs []JobInfo
+	for el := r.appIdToSignJobMap.Front(); el != nil; el = el.Next() {
+		job := el.Value.(*signJob)
+		jobs = append(jobs, JobInfo{AppId: job.appId, Ts: job.ts})
+	}
+	var returnJobs []JobInfo
+	for _, job := range r.idToReturnJobMap {
+		returnJobs = append(returnJobs, JobInfo{Id: job.Id, AppId: job.AppId, Ts: job.Ts})
+	}
+	sort.Slice(returnJobs, func(i, j int) bool {
+		return returnJobs[i].Ts.Before(returnJobs[j].Ts)
+	})
+	return append(jobs, returnJobs...)
+}
+
 func (r *JobResolver) GetById(id string) (*ReturnJob, bool) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
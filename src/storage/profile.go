@@ -14,9 +14,10 @@ import (
 	"os"
 	"path"
 	"software.sslmate.com/src/go-pkcs12"
+	"strings"
 )
 
-var ProfilePaths = []FSName{ProfileCert, ProfileCertPass, ProfileProv, ProfileName, ProfileAccountName, ProfileAccountPass}
+var ProfilePaths = []FSName{ProfileCert, ProfileCertPass, ProfileProv, ProfileName, ProfileAccountName, ProfileAccountPass, ProfileAllowedUsers}
 
 const (
 	ProfileRoot        = FSName("")
@@ -26,17 +27,52 @@ const (
 	ProfileName        = FSName("name.txt")
 	ProfileAccountName = FSName("account_name.txt")
 	ProfileAccountPass = FSName("account_pass.txt")
+	// Optional, one user per line. If missing, everyone can use the profile.
+	ProfileAllowedUsers = FSName("allowed_users.txt")
 )
 
 type Profile interface {
 	GetId() string
 	GetFiles() ([]fileGetter, error)
 	IsAccount() (bool, error)
+	GetAllowedUsers() ([]string, error)
+	// Returns the provisioning profile, or an error for account profiles.
+	GetProv() ([]byte, error)
+	GetCertificates() []*x509.Certificate
+	GetAuthorities() []*x509.Certificate
 	FileSystem
 }
 
+// Checks whether the user can use the profile. Profiles with no allowed users can be used by everyone.
+func IsProfileAllowed(profile Profile, user string) (bool, error) {
+	allowedUsers, err := profile.GetAllowedUsers()
+	if err != nil {
+		return false, err
+	}
+	if len(allowedUsers) < 1 {
+		return true, nil
+	}
+	for _, allowedUser := range allowedUsers {
+		if allowedUser == user {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Parses a list of users separated by newlines or commas.
+func parseUserList(list string) []string {
+	var users []string
+	for _, user := range strings.FieldsFunc(list, func(r rune) bool { return r == '\n' || r == ',' }) {
+		if user = strings.TrimSpace(user); user != "" {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
 func newProfile(id string) *profile {
-	return &profile{id: id, FileSystemBase: FileSystemBase{resolvePath: func(name FSName) string {
+	return &profile{id: id, FileSystemBase: FileSystemBase{encrypted: true, resolvePath: func(name FSName) string {
 		return util.SafeJoinFilePaths(profilesPath, id, string(name))
 	}}}
 }
@@ -54,6 +90,9 @@ func loadProfile(id string) (*profile, error) {
 		if isAccount && file == ProfileProv {
 			continue
 		}
+		if file == ProfileAllowedUsers {
+			continue
+		}
 		if _, err := p.Stat(file); err != nil {
 			return nil, errors.WithMessagef(err, "check required file %s", file)
 		}
@@ -71,12 +110,11 @@ func loadProfile(id string) (*profile, error) {
 	if err != nil {
 		return nil, errors.WithMessage(err, "read cert file")
 	}
-	fixedCert, teamId, err := processP12(origCertBytes, pass)
+	p12, err := processP12(origCertBytes, pass)
 	if err != nil {
 		return nil, errors.WithMessage(err, "validate certificate")
 	}
-	p.fixedCert = fixedCert
-	p.teamId = teamId
+	p.p12Data = *p12
 	return p, nil
 }
 
@@ -84,20 +122,37 @@ type PublicKeyComparator interface {
 	Equal(x crypto.PublicKey) bool
 }
 
-// Validates the input P12 file, adds any missing standard CAs, and returns the new P12 along with the team ID.
-func processP12(originalP12 []byte, pass string) ([]byte, string, error) {
+// The validated contents of a profile's certificate archive.
+type p12Data struct {
+	fixedCert    []byte
+	teamId       string
+	certificates []*x509.Certificate
+	authorities  []*x509.Certificate
+}
+
+func (d *p12Data) GetCertificates() []*x509.Certificate {
+	return d.certificates
+}
+
+func (d *p12Data) GetAuthorities() []*x509.Certificate {
+	return d.authorities
+}
+
+// Validates the input P12 file, adds any missing standard CAs, and returns the new P12 along with the team ID
+// and the parsed signing certificates and authorities.
+func processP12(originalP12 []byte, pass string) (*p12Data, error) {
 	blocks, err := pkcs12.ToPEM(originalP12, pass)
 	if err != nil {
-		return nil, "", errors.WithMessage(err, "p12 to pem")
+		return nil, errors.WithMessage(err, "p12 to pem")
 	}
 	appleCerts, err := assets.AppleCerts.ReadDir("certs")
 	if err != nil {
-		return nil, "", errors.WithMessage(err, "read certs dir")
+		return nil, errors.WithMessage(err, "read certs dir")
 	}
 	for _, cert := range appleCerts {
 		certBytes, err := assets.AppleCerts.ReadFile(path.Join("certs", cert.Name()))
 		if err != nil {
-			return nil, "", errors.WithMessagef(err, "read cert %s", cert.Name())
+			return nil, errors.WithMessagef(err, "read cert %s", cert.Name())
 		}
 		block, _ := pem.Decode(certBytes)
 		blocks = append(blocks, block)
@@ -111,7 +166,7 @@ func processP12(originalP12 []byte, pass string) ([]byte, string, error) {
 		case "CERTIFICATE":
 			cert, err := x509.ParseCertificate(block.Bytes)
 			if err != nil {
-				return nil, "", errors.WithMessage(err, "parse certificate")
+				return nil, errors.WithMessage(err, "parse certificate")
 			}
 			serialNumber := cert.SerialNumber.String()
 			if _, ok := serialNumbers[serialNumber]; ok {
@@ -136,27 +191,27 @@ func processP12(originalP12 []byte, pass string) ([]byte, string, error) {
 				case *ed25519.PrivateKey:
 					keyMap[key] = v.Public().(*ed25519.PublicKey)
 				default:
-					return nil, "", errors.New("unknown private key type")
+					return nil, errors.New("unknown private key type")
 				}
 			} else if key, err = x509.ParseECPrivateKey(block.Bytes); err == nil {
 				keyMap[key] = key.(*ecdsa.PrivateKey).Public().(*ecdsa.PublicKey)
 			} else {
-				return nil, "", errors.New("unknown private key type")
+				return nil, errors.New("unknown private key type")
 			}
 		}
 	}
 	if len(keyMap) < 1 {
-		return nil, "", errors.Errorf("no private keys found")
+		return nil, errors.Errorf("no private keys found")
 	}
 	if len(certificates) < 1 {
-		return nil, "", errors.Errorf("no signing certificates found")
+		return nil, errors.Errorf("no signing certificates found")
 	}
 	if len(authorities) < 1 {
-		return nil, "", errors.New("no certificate authorities found")
+		return nil, errors.New("no certificate authorities found")
 	}
 	for _, cert := range certificates {
 		if len(cert.Subject.OrganizationalUnit) != 1 {
-			return nil, "", errors.Errorf("certificate %s has invalid organization unit, bad item count", cert.SerialNumber.String())
+			return nil, errors.Errorf("certificate %s has invalid organization unit, bad item count", cert.SerialNumber.String())
 		}
 		valid := false
 		for _, publicKey := range keyMap {
@@ -166,13 +221,13 @@ func processP12(originalP12 []byte, pass string) ([]byte, string, error) {
 			}
 		}
 		if !valid {
-			return nil, "", errors.Errorf("certificate %s has no matching private key", cert.SerialNumber.String())
+			return nil, errors.Errorf("certificate %s has no matching private key", cert.SerialNumber.String())
 		}
 	}
 	orgUnit := certificates[0].Subject.OrganizationalUnit[0]
 	for _, cert := range certificates {
 		if cert.Subject.OrganizationalUnit[0] != orgUnit {
-			return nil, "", errors.Errorf("certificate %s has invalid organization unit, not the same as the others", cert.SerialNumber.String())
+			return nil, errors.Errorf("certificate %s has invalid organization unit, not the same as the others", cert.SerialNumber.String())
 		}
 	}
 	var keys []any
@@ -181,15 +236,19 @@ func processP12(originalP12 []byte, pass string) ([]byte, string, error) {
 	}
 	fixedP12, err := pkcs12.LegacyDES.Encode(keys, certificates, authorities, pass)
 	if err != nil {
-		return nil, "", errors.WithMessage(err, "encode final p12")
+		return nil, errors.WithMessage(err, "encode final p12")
 	}
-	return fixedP12, orgUnit, nil
+	return &p12Data{
+		fixedCert:    fixedP12,
+		teamId:       orgUnit,
+		certificates: certificates,
+		authorities:  authorities,
+	}, nil
 }
 
 type profile struct {
-	id        string
-	teamId    string
-	fixedCert []byte
+	id string
+	p12Data
 	FileSystemBase
 }
 
@@ -206,6 +265,16 @@ func (p *profile) IsAccount() (bool, error) {
 	return true, nil
 }
 
+func (p *profile) GetAllowedUsers() ([]string, error) {
+	users, err := p.GetString(ProfileAllowedUsers)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return parseUserList(users), nil
+}
+
 func (p *profile) GetFiles() ([]fileGetter, error) {
 	isAccount, err := p.IsAccount()
 	if err != nil {
@@ -229,6 +298,15 @@ func (p *profile) GetFiles() ([]fileGetter, error) {
 	return files, nil
 }
 
+func (p *profile) GetProv() ([]byte, error) {
+	file, err := p.GetFile(ProfileProv)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
 func (p *profile) getFixedCert() ([]byte, error) {
 	return p.fixedCert, nil
 }
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"os"
+)
+
+// Password-protected bundles are laid out as: magic | salt | sealed tar archive.
+const bundleMagic = "STBUNDL1"
+const bundleSaltSize = 16
+const maxBundleFileSize = 10 * 1024 * 1024
+
+var (
+	ErrBundlePasswordRequired = errors.New("a password is required to export a profile")
+	ErrProfileNotExportable   = errors.New("profiles from environment variables can't be exported")
+)
+
+// Writes all files of the profile into a single tar archive, encrypted with a key derived from the password.
+// Bundles hold the signing keys, so they are never exported unencrypted.
+func ExportProfile(profile Profile, writer io.Writer, password string) error {
+	if password == "" {
+		return ErrBundlePasswordRequired
+	}
+	if _, ok := profile.(*envProfile); ok {
+		return ErrProfileNotExportable
+	}
+	var buffer bytes.Buffer
+	w := tar.NewWriter(&buffer)
+	for _, name := range ProfilePaths {
+		file, err := profile.GetFile(name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return errors.WithMessagef(err, "get %s", name)
+		}
+		err = tarWriteFile(w, string(name), file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return errors.WithMessage(err, "close archive")
+	}
+	salt, err := randomBytes(bundleSaltSize)
+	if err != nil {
+		return errors.WithMessage(err, "generate salt")
+	}
+	envelope, err := newBundleEnvelope(password, salt)
+	if err != nil {
+		return err
+	}
+	sealed, err := envelope.seal(buffer.Bytes())
+	if err != nil {
+		return errors.WithMessage(err, "encrypt archive")
+	}
+	data := append(append([]byte(bundleMagic), salt...), sealed...)
+	if _, err := writer.Write(data); err != nil {
+		return errors.WithMessage(err, "write archive")
+	}
+	return nil
+}
+
+func newBundleEnvelope(password string, salt []byte) (*envelope, error) {
+	key, err := scrypt.Key([]byte(password), salt, 1<<15, 8, 1, envelopeKeySize)
+	if err != nil {
+		return nil, errors.WithMessage(err, "derive key")
+	}
+	return newEnvelope(key)
+}
+
+// Reads and validates a profile bundle created by ExportProfile, then saves it as a new profile.
+func (r *profileResolver) Import(reader io.Reader, password string) (Profile, error) {
+	files, err := readBundle(reader, password)
+	if err != nil {
+		return nil, errors.WithMessage(err, "read bundle")
+	}
+	if err := validateBundle(files); err != nil {
+		return nil, errors.WithMessage(err, "validate bundle")
+	}
+	id := uuid.NewString()
+	p := newProfile(id)
+	if err := p.MkDir(ProfileRoot); err != nil {
+		return nil, errors.WithMessage(err, "make profile dir")
+	}
+	for name, data := range files {
+		if err := p.SetFile(name, bytes.NewReader(data)); err != nil {
+			os.RemoveAll(p.resolvePath(ProfileRoot))
+			return nil, errors.WithMessagef(err, "set %s", name)
+		}
+	}
+	profile, err := loadProfile(id)
+	if err != nil {
+		os.RemoveAll(p.resolvePath(ProfileRoot))
+		return nil, errors.WithMessage(err, "load profile")
+	}
+	r.mu.Lock()
+	r.idToProfileMap[id] = profile
+	r.mu.Unlock()
+	return profile, nil
+}
+
+func readBundle(reader io.Reader, password string) (map[FSName][]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(reader, int64(len(ProfilePaths))*maxBundleFileSize))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, []byte(bundleMagic)) {
+		if password == "" {
+			return nil, errors.New("bundle is password protected")
+		}
+		data = data[len(bundleMagic):]
+		if len(data) < bundleSaltSize {
+			return nil, errors.New("bundle is truncated")
+		}
+		// open passes unsealed data through, which would skip the password check
+		sealed := data[bundleSaltSize:]
+		if !isSealed(sealed) {
+			return nil, errors.New("bundle is not encrypted")
+		}
+		envelope, err := newBundleEnvelope(password, data[:bundleSaltSize])
+		if err != nil {
+			return nil, err
+		}
+		if data, err = envelope.open(sealed); err != nil {
+			return nil, errors.WithMessage(err, "decrypt, wrong password?")
+		}
+	}
+	allowedNames := map[FSName]bool{}
+	for _, name := range ProfilePaths {
+		allowedNames[name] = true
+	}
+	files := map[FSName][]byte{}
+	tarReader := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		name := FSName(header.Name)
+		if !allowedNames[name] {
+			return nil, errors.Errorf("unknown file %s", header.Name)
+		}
+		if header.Size > maxBundleFileSize {
+			return nil, errors.Errorf("file %s is too large", header.Name)
+		}
+		fileBytes, err := io.ReadAll(tarReader)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "read %s", header.Name)
+		}
+		files[name] = fileBytes
+	}
+	return files, nil
+}
+
+func validateBundle(files map[FSName][]byte) error {
+	for _, name := range []FSName{ProfileName, ProfileCert, ProfileCertPass} {
+		if _, ok := files[name]; !ok {
+			return &MissingData{string(name)}
+		}
+	}
+	_, hasProv := files[ProfileProv]
+	_, hasAccountName := files[ProfileAccountName]
+	_, hasAccountPass := files[ProfileAccountPass]
+	if !hasProv && !(hasAccountName && hasAccountPass) {
+		return &MissingData{"provisioning profile or account name and password"}
+	}
+	if _, err := processP12(files[ProfileCert], string(bytes.TrimSpace(files[ProfileCertPass]))); err != nil {
+		return errors.WithMessage(err, "validate certificate")
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"SignTools/src/config"
 	"bytes"
 	"compress/zlib"
+	"crypto/x509"
 	"encoding/base64"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
@@ -29,12 +30,12 @@ func newEnvProfile(cfg *config.EnvProfile) (*envProfile, error) {
 	if err != nil {
 		return nil, err
 	}
-	fixedCert, teamId, err := processP12(p.originalCert, p.certPass)
+	p12, err := processP12(p.originalCert, p.certPass)
 	if err != nil {
 		return nil, errors.WithMessage(err, "validate certificate")
 	}
-	p.fixedCert = fixedCert
-	p.teamId = teamId
+	p.p12Data = *p12
+	p.id = getEnvProfileId(cfg, p12.certificates, p.accountName)
 	return p, nil
 }
 
@@ -53,7 +54,7 @@ func parseEnvProfile(cfg *config.EnvProfile) (*envProfile, error) {
 		}
 	}
 	if cfg.ProvBase64 != "" {
-		log.Info().Msg("importing prov profile from envvars")
+		log.Info().Str("name", cfg.Name).Msg("importing prov profile from envvars")
 		certBytes, err := decodeVar(cfg.CertBase64)
 		if err != nil {
 			return nil, errors.WithMessage(err, "decode cert base64")
@@ -62,19 +63,35 @@ func parseEnvProfile(cfg *config.EnvProfile) (*envProfile, error) {
 		if err != nil {
 			return nil, errors.WithMessage(err, "decode prov base64")
 		}
-		return newEnvProfileProv(uuid.NewString(), cfg, certBytes, provBytes), nil
+		return newEnvProfileProv(cfg, certBytes, provBytes), nil
 	} else if cfg.AccountName != "" && cfg.AccountPass != "" {
-		log.Info().Msg("importing account profile from envvars")
+		log.Info().Str("name", cfg.Name).Msg("importing account profile from envvars")
 		certBytes, err := decodeVar(cfg.CertBase64)
 		if err != nil {
 			return nil, errors.WithMessage(err, "decode cert base64")
 		}
-		return newEnvProfileAccount(uuid.NewString(), cfg, certBytes), nil
+		return newEnvProfileAccount(cfg, certBytes), nil
 	} else {
 		return nil, &MissingData{"provisioning profile or account name and password"}
 	}
 }
 
+var envProfileNamespace = uuid.MustParse("6f1d3c2e-7a0b-4b8e-9c51-2d4f0e8a9b17")
+
+// Returns the explicit ID if one is set, otherwise derives a stable ID from the signing certificates
+// and account name, so that apps keep referencing the same profile across restarts and prov renewals.
+func getEnvProfileId(cfg *config.EnvProfile, certificates []*x509.Certificate, accountName string) string {
+	if cfg.Id != "" {
+		return cfg.Id
+	}
+	var data []byte
+	for _, cert := range certificates {
+		data = append(data, cert.Raw...)
+	}
+	data = append(data, accountName...)
+	return uuid.NewSHA1(envProfileNamespace, data).String()
+}
+
 func decodeVar(dataStr string) ([]byte, error) {
 	data, err := base64.StdEncoding.DecodeString(dataStr)
 	if err != nil {
@@ -99,10 +116,10 @@ type envProfile struct {
 	prov         []byte
 	certPass     string
 	originalCert []byte
-	fixedCert    []byte
 	accountName  string
 	accountPass  string
-	teamId       string
+	allowedUsers []string
+	p12Data
 }
 
 func (p *envProfile) MkDir(name FSName) error {
@@ -142,24 +159,24 @@ func (p *envProfile) RemoveFile(name FSName) error {
 	return errors.New("unsupported operation")
 }
 
-func newEnvProfileProv(id string, cfg *config.EnvProfile, certBytes []byte, provBytes []byte) *envProfile {
+func newEnvProfileProv(cfg *config.EnvProfile, certBytes []byte, provBytes []byte) *envProfile {
 	return &envProfile{
-		id:           id,
 		name:         cfg.Name,
 		prov:         provBytes,
 		certPass:     cfg.CertPass,
 		originalCert: certBytes,
+		allowedUsers: parseUserList(cfg.AllowedUsers),
 	}
 }
 
-func newEnvProfileAccount(id string, cfg *config.EnvProfile, certBytes []byte) *envProfile {
+func newEnvProfileAccount(cfg *config.EnvProfile, certBytes []byte) *envProfile {
 	return &envProfile{
-		id:           id,
 		name:         cfg.Name,
 		certPass:     cfg.CertPass,
 		originalCert: certBytes,
 		accountName:  cfg.AccountName,
 		accountPass:  cfg.AccountPass,
+		allowedUsers: parseUserList(cfg.AllowedUsers),
 	}
 }
 
@@ -200,6 +217,17 @@ func (p *envProfile) GetFiles() ([]fileGetter, error) {
 	return files, nil
 }
 
+func (p *envProfile) GetProv() ([]byte, error) {
+	if p.prov == nil {
+		return nil, errors.New("account profiles have no provisioning profile")
+	}
+	return p.prov, nil
+}
+
+func (p *envProfile) GetAllowedUsers() ([]string, error) {
+	return p.allowedUsers, nil
+}
+
 func (p *envProfile) IsAccount() (bool, error) {
 	return p.accountName != "", nil
 }
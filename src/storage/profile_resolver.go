@@ -7,6 +7,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"os"
 	"sort"
+	"sync"
 )
 
 func newProfileResolver() *profileResolver {
@@ -17,22 +18,29 @@ func newProfileResolver() *profileResolver {
 
 type profileResolver struct {
 	idToProfileMap map[string]Profile
+	mu             sync.RWMutex
 }
 
 func (r *profileResolver) refresh() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	idDirs, err := os.ReadDir(profilesPath)
 	if err != nil {
 		return errors.WithMessage(err, "read profiles dir")
 	}
 	idDirs = util.RemoveHiddenDirs(idDirs)
-	envProfile, err := newEnvProfile(config.Current.EnvProfile)
-	if err == nil {
-		r.idToProfileMap[envProfile.GetId()] = envProfile
-	} else if !os.IsNotExist(err) {
-		return errors.WithMessage(err, "import profile from envvars")
+	envProfiles, err := LoadEnvProfiles(config.Current.EnvProfiles)
+	if err != nil {
+		return err
+	}
+	for id, profile := range envProfiles {
+		r.idToProfileMap[id] = profile
 	}
 	for _, idDir := range idDirs {
 		id := idDir.Name()
+		if _, ok := r.idToProfileMap[id]; ok {
+			return errors.Errorf("duplicate profile id %s, already used by envvars", id)
+		}
 		profile, err := loadProfile(id)
 		if err != nil {
 			log.Fatal().Err(err).Str("id", id).Msg("load profile from files")
@@ -42,7 +50,29 @@ func (r *profileResolver) refresh() error {
 	return nil
 }
 
+// Imports the profiles configured via envvars, skipping empty ones, and maps them by ID.
+// Returns an error if any of them is invalid or two of them share the same ID.
+func LoadEnvProfiles(cfgs []config.EnvProfile) (map[string]Profile, error) {
+	profiles := map[string]Profile{}
+	for i := range cfgs {
+		envProfile, err := newEnvProfile(&cfgs[i])
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, errors.WithMessagef(err, "import profile %d from envvars", i)
+		}
+		id := envProfile.GetId()
+		if _, ok := profiles[id]; ok {
+			return nil, errors.Errorf("duplicate profile id %s from envvars, set a unique id for each profile", id)
+		}
+		profiles[id] = envProfile
+	}
+	return profiles, nil
+}
+
 func (r *profileResolver) GetAll() ([]Profile, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	var profiles []Profile
 	for _, profile := range r.idToProfileMap {
 		profiles = append(profiles, profile)
@@ -56,6 +86,8 @@ func (r *profileResolver) GetAll() ([]Profile, error) {
 }
 
 func (r *profileResolver) GetById(id string) (Profile, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	profile, ok := r.idToProfileMap[id]
 	if !ok {
 		return nil, false
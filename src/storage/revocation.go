@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"SignTools/src/util"
+	"bytes"
+	"crypto/x509"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ocsp"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type RevocationStatus struct {
+	Revoked   bool
+	RevokedAt time.Time
+	// Serial number of the revoked certificate.
+	Serial    string
+	CheckedAt time.Time
+}
+
+func newRevocationResolver() *revocationResolver {
+	return &revocationResolver{
+		idToStatusMap: map[string]RevocationStatus{},
+		client:        &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// Caches the OCSP revocation status of each profile's signing certificates.
+type revocationResolver struct {
+	mu            sync.RWMutex
+	idToStatusMap map[string]RevocationStatus
+	client        *http.Client
+}
+
+// Checks all profiles against their OCSP responders. If responderUrl is set, it is used instead of
+// the responder specified in each certificate. Profiles that fail to be checked keep their last known status.
+func (r *revocationResolver) Refresh(responderUrl string) {
+	profiles, err := Profiles.GetAll()
+	if err != nil {
+		log.Err(err).Msg("revocation check: get profiles")
+		return
+	}
+	for _, profile := range profiles {
+		r.RefreshProfile(profile, responderUrl)
+	}
+}
+
+// Checks a single profile, e.g. right after it is imported, instead of waiting for the next refresh.
+func (r *revocationResolver) RefreshProfile(profile Profile, responderUrl string) {
+	status, err := r.check(profile, responderUrl)
+	if err != nil {
+		log.Err(err).Str("id", profile.GetId()).Msg("revocation check")
+		return
+	}
+	if status.Revoked {
+		log.Warn().Str("id", profile.GetId()).Str("serial", status.Serial).Msg("profile certificate is revoked")
+	}
+	r.mu.Lock()
+	r.idToStatusMap[profile.GetId()] = status
+	r.mu.Unlock()
+}
+
+// A profile is considered revoked if any of its signing certificates is revoked.
+func (r *revocationResolver) check(profile Profile, responderUrl string) (RevocationStatus, error) {
+	status := RevocationStatus{CheckedAt: time.Now()}
+	for _, cert := range profile.GetCertificates() {
+		issuer := findIssuer(cert, profile.GetAuthorities())
+		if issuer == nil {
+			return status, errors.Errorf("no issuer for certificate %s", cert.SerialNumber.String())
+		}
+		resp, err := r.checkCert(cert, issuer, responderUrl)
+		if err != nil {
+			return status, errors.WithMessagef(err, "check certificate %s", cert.SerialNumber.String())
+		}
+		if resp.Status == ocsp.Revoked {
+			status.Revoked = true
+			status.RevokedAt = resp.RevokedAt
+			status.Serial = cert.SerialNumber.String()
+			return status, nil
+		}
+	}
+	return status, nil
+}
+
+func findIssuer(cert *x509.Certificate, authorities []*x509.Certificate) *x509.Certificate {
+	for _, authority := range authorities {
+		if bytes.Equal(cert.RawIssuer, authority.RawSubject) && cert.CheckSignatureFrom(authority) == nil {
+			return authority
+		}
+	}
+	return nil
+}
+
+func (r *revocationResolver) checkCert(cert *x509.Certificate, issuer *x509.Certificate, responderUrl string) (*ocsp.Response, error) {
+	if responderUrl == "" {
+		if len(cert.OCSPServer) < 1 {
+			return nil, errors.New("certificate has no OCSP responder")
+		}
+		responderUrl = cert.OCSPServer[0]
+	}
+	reqBytes, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, errors.WithMessage(err, "create request")
+	}
+	httpResp, err := r.client.Post(responderUrl, "application/ocsp-request", bytes.NewReader(reqBytes))
+	if err != nil {
+		return nil, errors.WithMessage(err, "send request")
+	}
+	defer httpResp.Body.Close()
+	if err := util.Check2xxCode(httpResp.StatusCode); err != nil {
+		return nil, err
+	}
+	respBytes, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, errors.WithMessage(err, "read response")
+	}
+	resp, err := ocsp.ParseResponseForCert(respBytes, cert, issuer)
+	if err != nil {
+		return nil, errors.WithMessage(err, "parse response")
+	}
+	return resp, nil
+}
+
+func (r *revocationResolver) Get(profileId string) (RevocationStatus, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	status, ok := r.idToStatusMap[profileId]
+	return status, ok
+}
+
+func (r *revocationResolver) IsRevoked(profileId string) bool {
+	status, _ := r.Get(profileId)
+	return status.Revoked
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+// How long a web UI login lasts.
+const SessionLifetime = 7 * 24 * time.Hour
+
+type session struct {
+	user    string
+	expires time.Time
+}
+
+func newSessionResolver() *sessionResolver {
+	return &sessionResolver{sessions: map[string]session{}}
+}
+
+// Sessions are only kept in memory, so restarting the server logs everyone out. Like tokens, they are
+// looked up by the hash of their secret.
+type sessionResolver struct {
+	mu       sync.Mutex
+	sessions map[string]session
+}
+
+// Starts a session for the user and returns its secret.
+func (r *sessionResolver) New(user string) (string, error) {
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for hash, s := range r.sessions {
+		if now.After(s.expires) {
+			delete(r.sessions, hash)
+		}
+	}
+	r.sessions[hashToken(secret)] = session{user: user, expires: now.Add(SessionLifetime)}
+	return secret, nil
+}
+
+// Returns the user of the session with the given secret.
+func (r *sessionResolver) Get(secret string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hash := hashToken(secret)
+	s, ok := r.sessions[hash]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(s.expires) {
+		delete(r.sessions, hash)
+		return "", false
+	}
+	return s.user, true
+}
+
+func (r *sessionResolver) Delete(secret string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, hashToken(secret))
+}
+
+// Ends all sessions of the user.
+func (r *sessionResolver) DeleteUser(user string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for hash, s := range r.sessions {
+		if s.user == user {
+			delete(r.sessions, hash)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrShareLinkInvalid = errors.New("invalid or expired share link")
+	ErrShareLinkUsedUp  = errors.New("share link has no downloads left")
+)
+
+// Lets anyone install or download an app until it expires, or until it has been downloaded MaxDownloads
+// times if that isn't zero. Links aren't stored, their token is signed with the share key instead. Only the
+// download count of links with a maximum is saved.
+type ShareLink struct {
+	Id           string    `json:"id"`
+	AppId        string    `json:"app"`
+	Expires      time.Time `json:"exp"`
+	MaxDownloads int       `json:"max,omitempty"`
+}
+
+type shareDownloads struct {
+	Count int `json:"count"`
+	// When the count can be deleted.
+	Expires time.Time `json:"exp"`
+}
+
+func newShareLinkResolver() *shareLinkResolver {
+	return &shareLinkResolver{}
+}
+
+type shareLinkResolver struct {
+	mu  sync.Mutex
+	key []byte
+}
+
+// Loads the share key, creating it if it doesn't exist yet. Deleting the key invalidates all share links.
+func (r *shareLinkResolver) refresh() error {
+	keyPath := filepath.Join(sharesPath, "key")
+	key, err := os.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		if err := os.WriteFile(keyPath, key, 0600); err != nil {
+			return errors.WithMessage(err, "write share key")
+		}
+	} else if err != nil {
+		return errors.WithMessage(err, "read share key")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.key = key
+	return nil
+}
+
+func (r *shareLinkResolver) sign(payload string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Creates a link to the app and returns its token.
+func (r *shareLinkResolver) New(appId string, lifetime time.Duration, maxDownloads int) (ShareLink, string, error) {
+	link := ShareLink{
+		Id:           uuid.NewString(),
+		AppId:        appId,
+		Expires:      time.Now().Add(lifetime).Truncate(time.Second),
+		MaxDownloads: maxDownloads,
+	}
+	data, err := json.Marshal(link)
+	if err != nil {
+		return ShareLink{}, "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return link, payload + "." + r.sign(payload), nil
+}
+
+// Returns the link of the token if it's valid, not expired and has downloads left.
+func (r *shareLinkResolver) Verify(token string) (ShareLink, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(r.sign(payload))) {
+		return ShareLink{}, ErrShareLinkInvalid
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return ShareLink{}, ErrShareLinkInvalid
+	}
+	var link ShareLink
+	if err := json.Unmarshal(data, &link); err != nil {
+		return ShareLink{}, ErrShareLinkInvalid
+	}
+	if time.Now().After(link.Expires) {
+		return ShareLink{}, ErrShareLinkInvalid
+	}
+	if link.MaxDownloads > 0 {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		downloads, err := r.getDownloads(link)
+		if err != nil {
+			return ShareLink{}, err
+		}
+		if downloads.Count >= link.MaxDownloads {
+			return ShareLink{}, ErrShareLinkUsedUp
+		}
+	}
+	return link, nil
+}
+
+func (r *shareLinkResolver) getDownloads(link ShareLink) (shareDownloads, error) {
+	data, err := os.ReadFile(filepath.Join(sharesPath, link.Id))
+	if os.IsNotExist(err) {
+		return shareDownloads{Expires: link.Expires}, nil
+	} else if err != nil {
+		return shareDownloads{}, errors.WithMessage(err, "read share link downloads")
+	}
+	var downloads shareDownloads
+	if err := json.Unmarshal(data, &downloads); err != nil {
+		return shareDownloads{}, errors.WithMessage(err, "decode share link downloads")
+	}
+	return downloads, nil
+}
+
+// Counts a download of the link, or returns ErrShareLinkUsedUp if it has none left.
+func (r *shareLinkResolver) AddDownload(link ShareLink) error {
+	if link.MaxDownloads < 1 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	downloads, err := r.getDownloads(link)
+	if err != nil {
+		return err
+	}
+	if downloads.Count >= link.MaxDownloads {
+		return ErrShareLinkUsedUp
+	}
+	downloads.Count++
+	data, err := json.Marshal(downloads)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(sharesPath, link.Id), data, 0600); err != nil {
+		return errors.WithMessage(err, "write share link downloads")
+	}
+	return nil
+}
+
+// Deletes the download counts of expired links.
+func (r *shareLinkResolver) Cleanup() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries, err := os.ReadDir(sharesPath)
+	if err != nil {
+		log.Err(err).Msg("share link cleanup")
+		return
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		if _, err := uuid.Parse(entry.Name()); err != nil {
+			continue
+		}
+		downloads, err := r.getDownloads(ShareLink{Id: entry.Name()})
+		if err != nil {
+			log.Err(err).Str("id", entry.Name()).Msg("share link cleanup")
+			continue
+		}
+		if now.After(downloads.Expires) {
+			if err := os.Remove(filepath.Join(sharesPath, entry.Name())); err != nil {
+				log.Err(err).Str("id", entry.Name()).Msg("share link cleanup")
+			}
+		}
+	}
+}
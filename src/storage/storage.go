@@ -12,6 +12,11 @@ var (
 	appsPath     string
 	profilesPath string
 	uploadsPath  string
+	blobsPath    string
+	tokensPath   string
+	usersPath    string
+	auditPath    string
+	sharesPath   string
 )
 
 type ReadonlyFile interface {
@@ -24,26 +29,56 @@ var Apps = newAppResolver()
 var Profiles = newProfileResolver()
 var Jobs = newJobResolver()
 var Uploads = newUploadResolver()
+var Revocations = newRevocationResolver()
+var Blobs = newBlobResolver()
+var Tokens = newTokenResolver()
+var Users = newUserResolver()
+var Sessions = newSessionResolver()
+var Audit = newAuditResolver()
+var ShareLinks = newShareLinkResolver()
 
 func Load() {
 	appsPath = filepath.Join(config.Current.SaveDir, "apps")
 	profilesPath = filepath.Join(config.Current.SaveDir, "profiles")
 	uploadsPath = filepath.Join(config.Current.SaveDir, "uploads")
-	requiredPaths := []string{appsPath, profilesPath, uploadsPath}
+	blobsPath = filepath.Join(config.Current.SaveDir, "blobs")
+	tokensPath = filepath.Join(config.Current.SaveDir, "tokens")
+	usersPath = filepath.Join(config.Current.SaveDir, "users")
+	auditPath = filepath.Join(config.Current.SaveDir, "audit.jsonl")
+	sharesPath = filepath.Join(config.Current.SaveDir, "shares")
+	requiredPaths := []string{appsPath, profilesPath, uploadsPath, blobsPath, tokensPath, usersPath, sharesPath}
 	for _, path := range requiredPaths {
 		if err := os.MkdirAll(path, os.ModePerm); err != nil {
 			log.Fatal().Err(err).Msg("mkdir required path")
 		}
 	}
+	if err := SetMasterKey(config.Current.MasterKey); err != nil {
+		log.Fatal().Err(err).Msg("init profile encryption")
+	}
 	if err := Apps.refresh(); err != nil {
 		log.Fatal().Err(err).Msg("refresh apps")
 	}
+	if err := Blobs.refresh(); err != nil {
+		log.Fatal().Err(err).Msg("refresh blobs")
+	}
 	if err := Profiles.refresh(); err != nil {
 		log.Fatal().Err(err).Msg("refresh profiles")
 	}
 	if err := Uploads.refresh(); err != nil {
 		log.Fatal().Err(err).Msg("refresh uploads")
 	}
+	if err := Tokens.refresh(); err != nil {
+		log.Fatal().Err(err).Msg("refresh tokens")
+	}
+	if err := Users.refresh(); err != nil {
+		log.Fatal().Err(err).Msg("refresh users")
+	}
+	if err := ShareLinks.refresh(); err != nil {
+		log.Fatal().Err(err).Msg("refresh share links")
+	}
+	if err := Users.MigrateBasicAuth(config.Current.BasicAuth); err != nil {
+		log.Fatal().Err(err).Msg("migrate basic auth users")
+	}
 }
 
 type fileGetter struct {
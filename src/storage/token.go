@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"SignTools/src/util"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TokenName    = FSName("name")
+	TokenHash    = FSName("hash")
+	TokenScope   = FSName("scope")
+	TokenUser    = FSName("user")
+	TokenCreated = FSName("created")
+)
+
+// What an API token is allowed to do. Each scope includes the ones before it.
+type Scope string
+
+const (
+	// View apps and profiles.
+	ScopeRead = Scope("read")
+	// Upload, sign and edit apps.
+	ScopeSign = Scope("sign")
+	// Everything, including deleting apps and managing profiles and tokens.
+	ScopeAdmin = Scope("admin")
+)
+
+var Scopes = []Scope{ScopeRead, ScopeSign, ScopeAdmin}
+
+func ParseScope(value string) (Scope, error) {
+	for _, scope := range Scopes {
+		if string(scope) == value {
+			return scope, nil
+		}
+	}
+	return "", errors.Errorf("unknown scope %q", value)
+}
+
+func (s Scope) Allows(required Scope) bool {
+	return scopeRank(s) >= scopeRank(required)
+}
+
+// Returns the scope, reduced to max if it's greater.
+func (s Scope) Limit(max Scope) Scope {
+	if max.Allows(s) {
+		return s
+	}
+	return max
+}
+
+func scopeRank(scope Scope) int {
+	for i, s := range Scopes {
+		if s == scope {
+			return i
+		}
+	}
+	return -1
+}
+
+// The secret itself is only known when the token is created, only its hash is stored.
+type Token struct {
+	Id    string
+	Name  string
+	Scope Scope
+	// The user that the token acts as, empty if basic auth was disabled when it was created.
+	User    string
+	Created time.Time
+	hash    string
+}
+
+// Prefixed to make tokens recognizable, e.g. by secret scanners.
+const tokenPrefix = "st_"
+
+func newTokenResolver() *tokenResolver {
+	return &tokenResolver{
+		idToTokenMap: map[string]*Token{},
+		hashToIdMap:  map[string]string{},
+	}
+}
+
+type tokenResolver struct {
+	mu           sync.RWMutex
+	idToTokenMap map[string]*Token
+	hashToIdMap  map[string]string
+}
+
+func tokenFiles(id string) *FileSystemBase {
+	return &FileSystemBase{resolvePath: func(name FSName) string {
+		return util.SafeJoinFilePaths(tokensPath, id, string(name))
+	}}
+}
+
+func hashToken(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func (r *tokenResolver) refresh() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	idDirs, err := os.ReadDir(tokensPath)
+	if err != nil {
+		return errors.WithMessage(err, "read tokens dir")
+	}
+	for _, idDir := range util.RemoveHiddenDirs(idDirs) {
+		token, err := loadToken(idDir.Name())
+		if err != nil {
+			return errors.WithMessagef(err, "load token id=%s", idDir.Name())
+		}
+		r.idToTokenMap[token.Id] = token
+		r.hashToIdMap[token.hash] = token.Id
+	}
+	return nil
+}
+
+func loadToken(id string) (*Token, error) {
+	files := tokenFiles(id)
+	token := Token{Id: id}
+	values := map[FSName]*string{TokenName: &token.Name, TokenHash: &token.hash, TokenUser: &token.User}
+	for name, value := range values {
+		var err error
+		if *value, err = files.GetString(name); err != nil {
+			return nil, errors.WithMessagef(err, "get %s", name)
+		}
+	}
+	scope, err := files.GetString(TokenScope)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "get %s", TokenScope)
+	}
+	if token.Scope, err = ParseScope(scope); err != nil {
+		return nil, err
+	}
+	created, err := files.GetString(TokenCreated)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "get %s", TokenCreated)
+	}
+	if token.Created, err = time.Parse(time.RFC3339, created); err != nil {
+		return nil, errors.WithMessagef(err, "parse %s", TokenCreated)
+	}
+	return &token, nil
+}
+
+// Creates a token and returns it along with its secret, which can't be retrieved later.
+func (r *tokenResolver) New(name string, scope Scope, user string) (Token, string, error) {
+	if strings.TrimSpace(name) == "" {
+		return Token{}, "", errors.New("token name is empty")
+	}
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return Token{}, "", err
+	}
+	secret := tokenPrefix + base64.RawURLEncoding.EncodeToString(secretBytes)
+	token := Token{
+		Id:      uuid.NewString(),
+		Name:    strings.TrimSpace(name),
+		Scope:   scope,
+		User:    user,
+		Created: time.Now().UTC().Truncate(time.Second),
+		hash:    hashToken(secret),
+	}
+	files := tokenFiles(token.Id)
+	if err := os.MkdirAll(files.resolvePath(""), 0700); err != nil {
+		return Token{}, "", errors.WithMessage(err, "make token dir")
+	}
+	for name, value := range map[FSName]string{
+		TokenName:    token.Name,
+		TokenHash:    token.hash,
+		TokenScope:   string(token.Scope),
+		TokenUser:    token.User,
+		TokenCreated: token.Created.Format(time.RFC3339),
+	} {
+		if err := files.SetString(name, value); err != nil {
+			return Token{}, "", errors.WithMessagef(err, "set %s", name)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.idToTokenMap[token.Id] = &token
+	r.hashToIdMap[token.hash] = token.Id
+	return token, secret, nil
+}
+
+// Returns the tokens from oldest to newest.
+func (r *tokenResolver) GetAll() []Token {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var tokens []Token
+	for _, token := range r.idToTokenMap {
+		tokens = append(tokens, *token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].Created.Equal(tokens[j].Created) {
+			return tokens[i].Name < tokens[j].Name
+		}
+		return tokens[i].Created.Before(tokens[j].Created)
+	})
+	return tokens
+}
+
+func (r *tokenResolver) Get(id string) (Token, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	token, ok := r.idToTokenMap[id]
+	if !ok {
+		return Token{}, false
+	}
+	return *token, true
+}
+
+// Returns the token with the given secret.
+func (r *tokenResolver) Authenticate(secret string) (Token, bool) {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return Token{}, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	id, ok := r.hashToIdMap[hashToken(secret)]
+	if !ok {
+		return Token{}, false
+	}
+	return *r.idToTokenMap[id], true
+}
+
+// Revokes the token. Returns false if it doesn't exist.
+func (r *tokenResolver) Delete(id string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	token, ok := r.idToTokenMap[id]
+	if !ok {
+		return false, nil
+	}
+	delete(r.hashToIdMap, token.hash)
+	delete(r.idToTokenMap, id)
+	if err := os.RemoveAll(tokenFiles(id).resolvePath("")); err != nil {
+		return true, errors.WithMessagef(err, "delete token id=%s", id)
+	}
+	return true, nil
+}
+
+// Revokes all tokens of the user, so that they aren't revived if a user with the same name is created later.
+func (r *tokenResolver) DeleteUser(user string) error {
+	var ids []string
+	r.mu.RLock()
+	for id, token := range r.idToTokenMap {
+		if token.User == user {
+			ids = append(ids, id)
+		}
+	}
+	r.mu.RUnlock()
+	for _, id := range ids {
+		if _, err := r.Delete(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,352 @@
+package storage
+
+import (
+	"SignTools/src/config"
+	"SignTools/src/util"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	UserName         = FSName("name")
+	UserPasswordHash = FSName("password_hash")
+	UserRole         = FSName("role")
+)
+
+// What a user is allowed to do. Each role includes the ones before it.
+type Role string
+
+const (
+	// View apps and profiles.
+	RoleViewer = Role("viewer")
+	// Upload, sign and edit their own apps.
+	RoleSigner = Role("signer")
+	// Everything, including seeing all apps and managing profiles, tokens and users.
+	RoleAdmin = Role("admin")
+)
+
+var Roles = []Role{RoleViewer, RoleSigner, RoleAdmin}
+
+func ParseRole(value string) (Role, error) {
+	for _, role := range Roles {
+		if string(role) == value {
+			return role, nil
+		}
+	}
+	return "", errors.Errorf("unknown role %q", value)
+}
+
+// Returns the API token scope with the same permissions as the role.
+func (r Role) Scope() Scope {
+	switch r {
+	case RoleAdmin:
+		return ScopeAdmin
+	case RoleSigner:
+		return ScopeSign
+	default:
+		return ScopeRead
+	}
+}
+
+type User struct {
+	Id   string
+	Name string
+	Role Role
+	hash string
+}
+
+// Users without a password can only log in with OIDC.
+func (u User) IsExternal() bool {
+	return u.hash == ""
+}
+
+var ErrUserExists = errors.New("user already exists")
+
+func newUserResolver() *userResolver {
+	return &userResolver{
+		idToUserMap: map[string]*User{},
+		nameToIdMap: map[string]string{},
+	}
+}
+
+type userResolver struct {
+	mu          sync.RWMutex
+	idToUserMap map[string]*User
+	nameToIdMap map[string]string
+}
+
+func userFiles(id string) *FileSystemBase {
+	return &FileSystemBase{resolvePath: func(name FSName) string {
+		return util.SafeJoinFilePaths(usersPath, id, string(name))
+	}}
+}
+
+// Compared against when the user doesn't exist, so that the response time doesn't reveal which users exist.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+func (r *userResolver) refresh() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	idDirs, err := os.ReadDir(usersPath)
+	if err != nil {
+		return errors.WithMessage(err, "read users dir")
+	}
+	for _, idDir := range util.RemoveHiddenDirs(idDirs) {
+		user, err := loadUser(idDir.Name())
+		if err != nil {
+			return errors.WithMessagef(err, "load user id=%s", idDir.Name())
+		}
+		r.idToUserMap[user.Id] = user
+		r.nameToIdMap[user.Name] = user.Id
+	}
+	return nil
+}
+
+func loadUser(id string) (*User, error) {
+	files := userFiles(id)
+	user := User{Id: id}
+	var err error
+	if user.Name, err = files.GetString(UserName); err != nil {
+		return nil, errors.WithMessagef(err, "get %s", UserName)
+	}
+	if user.hash, err = files.GetString(UserPasswordHash); err != nil {
+		return nil, errors.WithMessagef(err, "get %s", UserPasswordHash)
+	}
+	role, err := files.GetString(UserRole)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "get %s", UserRole)
+	}
+	if user.Role, err = ParseRole(role); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Checks that the name can be used as a basic auth username and in the allowed users list of a profile.
+func ValidateUserName(name string) error {
+	if name == "" {
+		return errors.New("user name is empty")
+	}
+	if strings.ContainsAny(name, ":,") || strings.IndexFunc(name, unicode.IsSpace) >= 0 {
+		return errors.New("user name can't contain spaces, commas or colons")
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", errors.New("password is empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (r *userResolver) New(name string, password string, role Role) (User, error) {
+	if err := ValidateUserName(name); err != nil {
+		return User{}, err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.nameToIdMap[name]; ok {
+		return User{}, ErrUserExists
+	}
+	user := User{Id: uuid.NewString(), Name: name, Role: role, hash: hash}
+	files := userFiles(user.Id)
+	if err := os.MkdirAll(files.resolvePath(""), 0700); err != nil {
+		return User{}, errors.WithMessage(err, "make user dir")
+	}
+	if err := writeUser(&user); err != nil {
+		return User{}, err
+	}
+	r.idToUserMap[user.Id] = &user
+	r.nameToIdMap[user.Name] = user.Id
+	return user, nil
+}
+
+func writeUser(user *User) error {
+	files := userFiles(user.Id)
+	for name, value := range map[FSName]string{
+		UserName:         user.Name,
+		UserPasswordHash: user.hash,
+		UserRole:         string(user.Role),
+	} {
+		if err := files.SetString(name, value); err != nil {
+			return errors.WithMessagef(err, "set %s", name)
+		}
+	}
+	return nil
+}
+
+// Creates or updates a user that logged in with OIDC. Fails if a user with a password has the same name,
+// so that the identity provider can't take over local users.
+func (r *userResolver) Provision(name string, role Role) (User, error) {
+	if err := ValidateUserName(name); err != nil {
+		return User{}, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id, ok := r.nameToIdMap[name]; ok {
+		user := r.idToUserMap[id]
+		if !user.IsExternal() {
+			return User{}, ErrUserExists
+		}
+		if user.Role != role {
+			updated := *user
+			updated.Role = role
+			if err := writeUser(&updated); err != nil {
+				return User{}, err
+			}
+			*user = updated
+		}
+		return *user, nil
+	}
+	user := User{Id: uuid.NewString(), Name: name, Role: role}
+	if err := os.MkdirAll(userFiles(user.Id).resolvePath(""), 0700); err != nil {
+		return User{}, errors.WithMessage(err, "make user dir")
+	}
+	if err := writeUser(&user); err != nil {
+		return User{}, err
+	}
+	r.idToUserMap[user.Id] = &user
+	r.nameToIdMap[user.Name] = user.Id
+	return user, nil
+}
+
+// Returns the users sorted by name.
+func (r *userResolver) GetAll() []User {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var users []User
+	for _, user := range r.idToUserMap {
+		users = append(users, *user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+	return users
+}
+
+func (r *userResolver) Get(id string) (User, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	user, ok := r.idToUserMap[id]
+	if !ok {
+		return User{}, false
+	}
+	return *user, true
+}
+
+func (r *userResolver) GetByName(name string) (User, bool) {
+	r.mu.RLock()
+	id, ok := r.nameToIdMap[name]
+	r.mu.RUnlock()
+	if !ok {
+		return User{}, false
+	}
+	return r.Get(id)
+}
+
+// Whether any users exist. If none do, authentication is disabled.
+func (r *userResolver) Any() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.idToUserMap) > 0
+}
+
+// Returns the user with the given credentials.
+func (r *userResolver) Authenticate(name string, password string) (User, bool) {
+	user, ok := r.GetByName(name)
+	if !ok || user.IsExternal() {
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return User{}, false
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.hash), []byte(password)); err != nil {
+		return User{}, false
+	}
+	return user, true
+}
+
+// Changes the role and, if not empty, the password of the user. Returns false if the user doesn't exist.
+func (r *userResolver) Update(id string, role Role, password string) (bool, error) {
+	hash := ""
+	if password != "" {
+		var err error
+		if hash, err = hashPassword(password); err != nil {
+			return false, err
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.idToUserMap[id]
+	if !ok {
+		return false, nil
+	}
+	updated := *user
+	updated.Role = role
+	if hash != "" {
+		updated.hash = hash
+	}
+	if err := writeUser(&updated); err != nil {
+		return true, err
+	}
+	*user = updated
+	if hash != "" {
+		Sessions.DeleteUser(user.Name)
+	}
+	return true, nil
+}
+
+// Deletes the user, ends their sessions and revokes their tokens. Returns false if the user doesn't exist.
+func (r *userResolver) Delete(id string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.idToUserMap[id]
+	if !ok {
+		return false, nil
+	}
+	delete(r.nameToIdMap, user.Name)
+	delete(r.idToUserMap, id)
+	Sessions.DeleteUser(user.Name)
+	if err := Tokens.DeleteUser(user.Name); err != nil {
+		return true, errors.WithMessage(err, "revoke tokens")
+	}
+	if err := os.RemoveAll(userFiles(id).resolvePath("")); err != nil {
+		return true, errors.WithMessagef(err, "delete user id=%s", id)
+	}
+	return true, nil
+}
+
+// Creates the users of the basic auth configuration if no users exist yet. The main user becomes an admin,
+// and the additional users become signers.
+func (r *userResolver) MigrateBasicAuth(basicAuth config.BasicAuth) error {
+	if !basicAuth.Enable || r.Any() {
+		return nil
+	}
+	if _, err := r.New(basicAuth.Username, basicAuth.Password, RoleAdmin); err != nil {
+		return errors.WithMessagef(err, "migrate user %s", basicAuth.Username)
+	}
+	for name, password := range basicAuth.Users {
+		if name == basicAuth.Username {
+			continue
+		}
+		if _, err := r.New(name, password, RoleSigner); err != nil {
+			return errors.WithMessagef(err, "migrate user %s", name)
+		}
+	}
+	log.Info().Int("count", len(r.GetAll())).Msg("migrated basic auth users, the credentials in the config are no longer used")
+	return nil
+}